@@ -12,6 +12,7 @@ require (
 	github.com/nicksnyder/go-i18n/v2 v2.1.1
 	github.com/pashagolub/pgxmock v1.5.0
 	github.com/top-gg/go-dbl v0.0.0-20201116001615-e844586b1159
+	golang.org/x/sync v0.2.0
 	golang.org/x/text v0.3.7
 )
 
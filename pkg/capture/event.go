@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/automuteus/utils/pkg/rediskey"
 	"github.com/go-redis/redis/v8"
 	"time"
@@ -19,6 +20,28 @@ const (
 	GameOver
 )
 
+var EventTypeNames = map[EventType]string{
+	Connection: "Connection",
+	Lobby:      "Lobby",
+	State:      "State",
+	Player:     "Player",
+	GameOver:   "GameOver",
+}
+
+func (e EventType) String() string {
+	if name, ok := EventTypeNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(e))
+}
+
+// EventTypeFromInt16 converts an event type as stored in Postgres, returning false if it isn't a known EventType
+func EventTypeFromInt16(v int16) (EventType, bool) {
+	e := EventType(v)
+	_, ok := EventTypeNames[e]
+	return e, ok
+}
+
 type Event struct {
 	EventType EventType `json:"type"`
 	Payload   []byte    `json:"payload"`
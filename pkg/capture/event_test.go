@@ -0,0 +1,29 @@
+package capture
+
+import (
+	"testing"
+)
+
+func TestEventType_String(t *testing.T) {
+	if State.String() != "State" || GameOver.String() != "GameOver" {
+		t.Error("known event types should stringify to their names")
+	}
+	if EventType(42).String() != "EventType(42)" {
+		t.Error("unknown event types should stringify to their numeric value: " + EventType(42).String())
+	}
+}
+
+func TestEventTypeFromInt16(t *testing.T) {
+	for e := range EventTypeNames {
+		v, ok := EventTypeFromInt16(int16(e))
+		if !ok || v != e {
+			t.Errorf("expected %d to convert to the known event type %s", e, e)
+		}
+	}
+
+	for _, v := range []int16{-1, int16(GameOver) + 1, 100} {
+		if _, ok := EventTypeFromInt16(v); ok {
+			t.Errorf("expected %d to be rejected as an unknown event type", v)
+		}
+	}
+}
@@ -1,5 +1,13 @@
 package game
 
+// Color is a player color, as stored in users_games.player_color
+type Color int16
+
+// String returns the color's lowercase name, or an empty string for unknown colors
+func (c Color) String() string {
+	return GetColorStringForInt(int(c))
+}
+
 // Color : Int constant mapping
 const (
 	Red    = 0
@@ -1,5 +1,10 @@
 package game
 
+import (
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"strings"
+)
+
 type Region int
 
 const (
@@ -8,6 +13,13 @@ const (
 	EU
 )
 
+// RegionCodes are the short, stable identifiers used when persisting or parsing a Region
+var RegionCodes = map[Region]string{
+	NA: "na",
+	AS: "as",
+	EU: "eu",
+}
+
 func (r Region) ToString() string {
 	switch r {
 	case NA:
@@ -19,3 +31,66 @@ func (r Region) ToString() string {
 	}
 	return "Unknown"
 }
+
+// RegionMessageIDs are the i18n message IDs for each region's display name
+var RegionMessageIDs = map[Region]string{
+	NA: "regions.NorthAmerica",
+	AS: "regions.Asia",
+	EU: "regions.Europe",
+}
+
+// Localizer is anything that can translate an i18n message, such as *settings.GuildSettings (which can't be referenced
+// directly here without an import cycle)
+type Localizer interface {
+	LocalizeMessage(args ...interface{}) string
+}
+
+// Localize returns the region's display name in the localizer's language, falling back to the English ToString when
+// there's no translation. Undefined regions aren't translated
+func (r Region) Localize(l Localizer) string {
+	id, ok := RegionMessageIDs[r]
+	if !ok {
+		return r.ToString()
+	}
+	return l.LocalizeMessage(&i18n.Message{
+		ID:    id,
+		Other: r.ToString(),
+	})
+}
+
+// UnknownRegionMessageID is the i18n message ID for the display name of regions that aren't defined
+const UnknownRegionMessageID = "regions.Unknown"
+
+// ToStringLocalized is Localize, except that undefined regions are translated too, rather than always being "Unknown".
+// *settings.GuildSettings is a Localizer
+func (r Region) ToStringLocalized(l Localizer) string {
+	if r.Valid() {
+		return r.Localize(l)
+	}
+	return l.LocalizeMessage(&i18n.Message{
+		ID:    UnknownRegionMessageID,
+		Other: r.ToString(),
+	})
+}
+
+// Code returns the short identifier for the region, or an empty string if the region isn't defined
+func (r Region) Code() string {
+	return RegionCodes[r]
+}
+
+// Valid reports whether r is one of the defined regions
+func (r Region) Valid() bool {
+	_, ok := RegionCodes[r]
+	return ok
+}
+
+// RegionFromString parses a region from its short code ("na") or display name ("North America"), ignoring case
+func RegionFromString(input string) (Region, bool) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	for r, code := range RegionCodes {
+		if input == code || input == strings.ToLower(r.ToString()) {
+			return r, true
+		}
+	}
+	return NA, false
+}
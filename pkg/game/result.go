@@ -13,6 +13,8 @@ const (
 	ImpostorDisconnect
 	HumansDisconnect
 	Unknown
+	// Draw is a game that ended without a winner, such as one abandoned partway through
+	Draw
 )
 
 func (r *Gameover) Marshal() ([]byte, error) {
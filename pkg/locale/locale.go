@@ -113,6 +113,8 @@ func LocalizeMessage(args ...interface{}) string {
 			if len(args[3:]) > 0 {
 				if model, ok := args[3].(int); ok {
 					pluralCount = model
+				} else if model, ok := args[3].(string); ok {
+					lang = model
 				}
 			}
 		}
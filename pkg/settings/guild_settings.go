@@ -1,14 +1,29 @@
 package settings
 
 import (
+	"fmt"
 	"github.com/automuteus/utils/pkg/game"
 	"github.com/automuteus/utils/pkg/locale"
 	"github.com/bwmarrin/discordgo"
+	"io"
 	"sync"
+	"text/template"
 )
 
 const DefaultLeaderboardSize = 3
 const DefaultLeaderboardMin = 3
+const DefaultWinStreakThreshold = 3
+
+const DefaultLeaderboardPageSize = 10
+
+// MaxLeaderboardPageSize is the most fields Discord allows in a single embed
+const MaxLeaderboardPageSize = 25
+
+const DefaultCSVDelimiter = ','
+
+// CSVDelimiters are the field delimiters a guild can choose for its data exports. Semicolons are what Excel expects in
+// locales that use a comma as the decimal separator
+var CSVDelimiters = []rune{',', ';', '\t'}
 
 type GuildSettings struct {
 	AdminUserIDs             []string        `json:"adminIDs"`
@@ -25,8 +40,20 @@ type GuildSettings struct {
 	LeaderboardMention       bool   `json:"leaderboardMention"`
 	LeaderboardSize          int    `json:"leaderboardSize"`
 	LeaderboardMin           int    `json:"leaderboardMin"`
+	LeaderboardPageSize      int    `json:"leaderboardPageSize"`
 	MuteSpectator            bool   `json:"muteSpectator"`
 	DisplayRoomCode          string `json:"displayRoomCode"`
+	DefaultRegion            string `json:"defaultRegion"`
+	ShowWinStreaks           bool   `json:"showWinStreaks"`
+	WinStreakThreshold       int    `json:"winStreakThreshold"`
+	// stored inverted so settings saved before this option existed keep showing names
+	HidePlayerNames       bool   `json:"hidePlayerNames"`
+	SignificantEventsOnly bool   `json:"significantEventsOnly"`
+	HideMatchFooter       bool   `json:"hideMatchFooter"`
+	CompactMatchEmbed     bool   `json:"compactMatchEmbed"`
+	CSVDelimiter          string `json:"csvDelimiter"`
+	MatchURLTemplate      string `json:"matchURLTemplate"`
+	RelativeMatchTimes    bool   `json:"relativeMatchTimes"`
 }
 
 func MakeGuildSettings() *GuildSettings {
@@ -44,8 +71,19 @@ func MakeGuildSettings() *GuildSettings {
 		LeaderboardMention:       true,
 		LeaderboardSize:          DefaultLeaderboardSize,
 		LeaderboardMin:           DefaultLeaderboardMin,
+		LeaderboardPageSize:      DefaultLeaderboardPageSize,
 		MuteSpectator:            false,
 		DisplayRoomCode:          "always",
+		DefaultRegion:            game.NA.Code(),
+		ShowWinStreaks:           false,
+		WinStreakThreshold:       DefaultWinStreakThreshold,
+		HidePlayerNames:          false,
+		SignificantEventsOnly:    false,
+		HideMatchFooter:          false,
+		CompactMatchEmbed:        false,
+		CSVDelimiter:             string(DefaultCSVDelimiter),
+		MatchURLTemplate:         "",
+		RelativeMatchTimes:       false,
 		lock:                     sync.RWMutex{},
 	}
 }
@@ -149,10 +187,34 @@ func (gs *GuildSettings) GetLeaderboardMin() int {
 	return gs.LeaderboardMin
 }
 
+// GetLeaderboardMinGames is the minimum number of games a player (or pairing) needs to appear in rankings, to pass as
+// the leaderboardMin/minGames argument of the storage ranking queries. It's the same setting as GetLeaderboardMin
+func (gs *GuildSettings) GetLeaderboardMinGames() int {
+	return gs.GetLeaderboardMin()
+}
+
 func (gs *GuildSettings) SetLeaderboardMin(v int) {
 	gs.LeaderboardMin = v
 }
 
+// GetLeaderboardPageSize is how many entries paginated leaderboards show per page, kept within what fits in one embed.
+// Settings saved before this option existed (or with it unset) get DefaultLeaderboardPageSize
+func (gs *GuildSettings) GetLeaderboardPageSize() int {
+	switch {
+	case gs.LeaderboardPageSize == 0:
+		return DefaultLeaderboardPageSize
+	case gs.LeaderboardPageSize < 1:
+		return 1
+	case gs.LeaderboardPageSize > MaxLeaderboardPageSize:
+		return MaxLeaderboardPageSize
+	}
+	return gs.LeaderboardPageSize
+}
+
+func (gs *GuildSettings) SetLeaderboardPageSize(v int) {
+	gs.LeaderboardPageSize = v
+}
+
 func (gs *GuildSettings) GetMuteSpectator() bool {
 	return gs.MuteSpectator
 }
@@ -161,6 +223,116 @@ func (gs *GuildSettings) SetMuteSpectator(behavior bool) {
 	gs.MuteSpectator = behavior
 }
 
+func (gs *GuildSettings) GetShowWinStreaks() bool {
+	return gs.ShowWinStreaks
+}
+
+func (gs *GuildSettings) SetShowWinStreaks(v bool) {
+	gs.ShowWinStreaks = v
+}
+
+func (gs *GuildSettings) GetWinStreakThreshold() int {
+	if gs.WinStreakThreshold < 1 {
+		return DefaultWinStreakThreshold
+	}
+	return gs.WinStreakThreshold
+}
+
+func (gs *GuildSettings) SetWinStreakThreshold(v int) {
+	gs.WinStreakThreshold = v
+}
+
+func (gs *GuildSettings) GetShowPlayerNames() bool {
+	return !gs.HidePlayerNames
+}
+
+func (gs *GuildSettings) SetShowPlayerNames(v bool) {
+	gs.HidePlayerNames = !v
+}
+
+// GetSignificantEventsOnly reports whether match timelines should leave out phase changes (tasks, discussions and
+// skipped meetings) and only show events that happen to players
+func (gs *GuildSettings) GetSignificantEventsOnly() bool {
+	return gs.SignificantEventsOnly
+}
+
+func (gs *GuildSettings) SetSignificantEventsOnly(v bool) {
+	gs.SignificantEventsOnly = v
+}
+
+// GetShowMatchFooter reports whether match summaries get a footer with the match ID and the time the game ended
+func (gs *GuildSettings) GetShowMatchFooter() bool {
+	return !gs.HideMatchFooter
+}
+
+func (gs *GuildSettings) SetShowMatchFooter(v bool) {
+	gs.HideMatchFooter = !v
+}
+
+// GetCompactMatchEmbed reports whether match summaries should put everything in the embed description rather than in
+// separate fields, which is much shorter on mobile
+func (gs *GuildSettings) GetCompactMatchEmbed() bool {
+	return gs.CompactMatchEmbed
+}
+
+func (gs *GuildSettings) SetCompactMatchEmbed(v bool) {
+	gs.CompactMatchEmbed = v
+}
+
+// GetCSVDelimiter returns the field delimiter for the guild's CSV exports, falling back to a comma if none (or an
+// unsupported one) is stored
+func (gs *GuildSettings) GetCSVDelimiter() rune {
+	for _, v := range CSVDelimiters {
+		if gs.CSVDelimiter == string(v) {
+			return v
+		}
+	}
+	return DefaultCSVDelimiter
+}
+
+// SetCSVDelimiter stores the guild's CSV field delimiter, rejecting anything not in CSVDelimiters
+func (gs *GuildSettings) SetCSVDelimiter(r rune) error {
+	for _, v := range CSVDelimiters {
+		if r == v {
+			gs.CSVDelimiter = string(r)
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported CSV delimiter: %q", r)
+}
+
+// GetMatchURLTemplate returns the template for links from match summaries to an external match page, such as
+// "https://example.com/match/{{.MatchID}}". It's empty if summaries shouldn't link anywhere
+func (gs *GuildSettings) GetMatchURLTemplate() string {
+	return gs.MatchURLTemplate
+}
+
+// SetMatchURLTemplate stores the match page URL template, rejecting templates that don't parse or can't be expanded
+// for a match. An empty string turns the links off
+func (gs *GuildSettings) SetMatchURLTemplate(tmpl string) error {
+	if tmpl != "" {
+		t, err := template.New("matchURL").Parse(tmpl)
+		if err != nil {
+			return err
+		}
+		if err := t.Execute(io.Discard, map[string]interface{}{"MatchID": "ABCDEF:1"}); err != nil {
+			return err
+		}
+	}
+	gs.MatchURLTemplate = tmpl
+	return nil
+}
+
+// GetRelativeMatchTimes reports whether match summaries should show when the game started and ended as Discord
+// relative timestamps ("2 hours ago"), which each viewer sees in their own timezone
+func (gs *GuildSettings) GetRelativeMatchTimes() bool {
+	return gs.RelativeMatchTimes
+}
+
+func (gs *GuildSettings) SetRelativeMatchTimes(v bool) {
+	gs.RelativeMatchTimes = v
+}
+
 func (gs *GuildSettings) GetMapDetailed() bool {
 	return gs.MapVersion == "detailed"
 }
@@ -221,3 +393,20 @@ func (gs *GuildSettings) GetDisplayRoomCode() string {
 func (gs *GuildSettings) SetDisplayRoomCode(r string) {
 	gs.DisplayRoomCode = r
 }
+
+// GetDefaultRegion returns the guild's default region, falling back to NA if none (or an unknown one) is stored
+func (gs *GuildSettings) GetDefaultRegion() game.Region {
+	if r, ok := game.RegionFromString(gs.DefaultRegion); ok {
+		return r
+	}
+	return game.NA
+}
+
+// SetDefaultRegion stores the guild's default region, rejecting values that aren't a defined region
+func (gs *GuildSettings) SetDefaultRegion(r game.Region) error {
+	if !r.Valid() {
+		return fmt.Errorf("invalid region: %d", r)
+	}
+	gs.DefaultRegion = r.Code()
+	return nil
+}
@@ -0,0 +1,223 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/automuteus/utils/pkg/game"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"testing"
+)
+
+func TestGuildSettings_DefaultRegion(t *testing.T) {
+	sett := MakeGuildSettings()
+	if sett.GetDefaultRegion() != game.NA {
+		t.Error("expected new guild settings to default to NA")
+	}
+
+	for r := range game.RegionCodes {
+		if err := sett.SetDefaultRegion(r); err != nil {
+			t.Fatal(err)
+		}
+
+		// round-trip through the same JSON serialization used to persist settings
+		b, err := json.Marshal(sett)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var loaded GuildSettings
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		if loaded.GetDefaultRegion() != r {
+			t.Errorf("expected %s after round-trip, got %s", r.ToString(), loaded.GetDefaultRegion().ToString())
+		}
+
+		parsed, ok := game.RegionFromString(r.ToString())
+		if !ok || parsed != r {
+			t.Errorf("expected RegionFromString to parse %s", r.ToString())
+		}
+	}
+}
+
+func TestGuildSettings_SetDefaultRegionInvalid(t *testing.T) {
+	sett := MakeGuildSettings()
+	if err := sett.SetDefaultRegion(game.EU); err != nil {
+		t.Fatal(err)
+	}
+	if err := sett.SetDefaultRegion(game.Region(42)); err == nil {
+		t.Error("expected an error for an undefined region")
+	}
+	if sett.GetDefaultRegion() != game.EU {
+		t.Error("expected an invalid region to leave the existing default unchanged")
+	}
+
+	// settings persisted before the field existed should still read back a usable region
+	var legacy GuildSettings
+	if err := json.Unmarshal([]byte(`{"language":"en"}`), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.GetDefaultRegion() != game.NA {
+		t.Error("expected missing defaultRegion to fall back to NA")
+	}
+}
+
+func TestRegion_Localize(t *testing.T) {
+	expectedIDs := map[game.Region]string{
+		game.NA: "regions.NorthAmerica",
+		game.AS: "regions.Asia",
+		game.EU: "regions.Europe",
+	}
+	for r, id := range expectedIDs {
+		if game.RegionMessageIDs[r] != id {
+			t.Errorf("expected %s to use message ID %s, got %s", r.ToString(), id, game.RegionMessageIDs[r])
+		}
+	}
+
+	// no translation is loaded for this language, so every region should fall back to English
+	sett := MakeGuildSettings()
+	sett.SetLanguage("xx")
+	for r := range game.RegionCodes {
+		if got := r.Localize(sett); got != r.ToString() {
+			t.Errorf("expected English fallback %q, got %q", r.ToString(), got)
+		}
+	}
+	if got := game.Region(42).Localize(sett); got != "Unknown" {
+		t.Errorf("expected undefined regions to render as Unknown, got %q", got)
+	}
+}
+
+// recordingLocalizer returns the ID of each message it's asked to localize
+type recordingLocalizer struct{}
+
+func (recordingLocalizer) LocalizeMessage(args ...interface{}) string {
+	return args[0].(*i18n.Message).ID
+}
+
+func TestRegion_ToStringLocalized(t *testing.T) {
+	sett := MakeGuildSettings()
+	if got := game.Region(42).ToStringLocalized(sett); got != "Unknown" {
+		t.Errorf("expected undefined regions to fall back to Unknown, got %q", got)
+	}
+	if got := game.Region(-1).ToStringLocalized(recordingLocalizer{}); got != game.UnknownRegionMessageID {
+		t.Errorf("expected undefined regions to be localized with %s, got %q", game.UnknownRegionMessageID, got)
+	}
+	for r, id := range game.RegionMessageIDs {
+		if got := r.ToStringLocalized(recordingLocalizer{}); got != id {
+			t.Errorf("expected %s to be localized with %s, got %q", r.ToString(), id, got)
+		}
+	}
+}
+
+func TestGuildSettings_GetLeaderboardMinGames(t *testing.T) {
+	sett := MakeGuildSettings()
+	if sett.GetLeaderboardMinGames() != DefaultLeaderboardMin {
+		t.Errorf("expected the default of %d, got %d", DefaultLeaderboardMin, sett.GetLeaderboardMinGames())
+	}
+
+	sett.SetLeaderboardMin(10)
+	if sett.GetLeaderboardMinGames() != 10 {
+		t.Errorf("expected the configured value of 10, got %d", sett.GetLeaderboardMinGames())
+	}
+
+	// settings persisted without a value (or with a nonsensical one) fall back to the default
+	sett.SetLeaderboardMin(0)
+	if sett.GetLeaderboardMinGames() != DefaultLeaderboardMin {
+		t.Errorf("expected unset values to fall back to %d, got %d", DefaultLeaderboardMin, sett.GetLeaderboardMinGames())
+	}
+}
+
+func TestGuildSettings_LeaderboardPageSize(t *testing.T) {
+	sett := MakeGuildSettings()
+	if sett.GetLeaderboardPageSize() != DefaultLeaderboardPageSize {
+		t.Errorf("expected a default page size of %d, got %d", DefaultLeaderboardPageSize, sett.GetLeaderboardPageSize())
+	}
+
+	sett.SetLeaderboardPageSize(15)
+	if sett.GetLeaderboardPageSize() != 15 {
+		t.Errorf("expected a page size of 15, got %d", sett.GetLeaderboardPageSize())
+	}
+
+	sett.SetLeaderboardPageSize(100)
+	if sett.GetLeaderboardPageSize() != MaxLeaderboardPageSize {
+		t.Errorf("expected the page size to be clamped to %d, got %d", MaxLeaderboardPageSize, sett.GetLeaderboardPageSize())
+	}
+	sett.SetLeaderboardPageSize(-5)
+	if sett.GetLeaderboardPageSize() != 1 {
+		t.Errorf("expected the page size to be clamped to 1, got %d", sett.GetLeaderboardPageSize())
+	}
+
+	var legacy GuildSettings
+	if err := json.Unmarshal([]byte(`{"language":"en"}`), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.GetLeaderboardPageSize() != DefaultLeaderboardPageSize {
+		t.Error("expected missing leaderboardPageSize to fall back to the default")
+	}
+}
+
+func TestGuildSettings_MatchURLTemplate(t *testing.T) {
+	sett := MakeGuildSettings()
+	if sett.GetMatchURLTemplate() != "" {
+		t.Error("expected no match URL template by default")
+	}
+	if err := sett.SetMatchURLTemplate("https://example.com/match/{{.MatchID"); err == nil {
+		t.Error("expected an error for a template that doesn't parse")
+	}
+	if sett.GetMatchURLTemplate() != "" {
+		t.Error("expected a rejected template not to be stored")
+	}
+	if err := sett.SetMatchURLTemplate("https://example.com/match/{{.MatchID.Number}}"); err == nil {
+		t.Error("expected an error for a template that can't be expanded for a match")
+	}
+	if err := sett.SetMatchURLTemplate("https://example.com/match/{{.MatchID}}"); err != nil {
+		t.Fatal(err)
+	}
+	if sett.GetMatchURLTemplate() != "https://example.com/match/{{.MatchID}}" {
+		t.Errorf("expected the template to be stored, got %q", sett.GetMatchURLTemplate())
+	}
+}
+
+func TestGuildSettings_CSVDelimiter(t *testing.T) {
+	sett := MakeGuildSettings()
+	if sett.GetCSVDelimiter() != ',' {
+		t.Errorf("expected a comma by default, got %q", sett.GetCSVDelimiter())
+	}
+	if err := sett.SetCSVDelimiter('|'); err == nil {
+		t.Error("expected an error for an unsupported delimiter")
+	}
+	if err := sett.SetCSVDelimiter(';'); err != nil {
+		t.Fatal(err)
+	}
+
+	// fields containing commas, as game event payloads do, must survive a semicolon-delimited round-trip
+	record := []string{"1", "123456789", `{"Action":2,"Name":"Alice, the Red"}`}
+	buf := bytes.NewBuffer([]byte{})
+	w := csv.NewWriter(buf)
+	w.Comma = sett.GetCSVDelimiter()
+	if err := w.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if !bytes.Contains(buf.Bytes(), []byte("1;123456789;")) {
+		t.Errorf("expected semicolon-delimited output, got %q", buf.String())
+	}
+
+	r := csv.NewReader(buf)
+	r.Comma = sett.GetCSVDelimiter()
+	parsed, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(record) || parsed[2] != record[2] {
+		t.Errorf("expected %q after parsing, got %q", record, parsed)
+	}
+
+	var legacy GuildSettings
+	if err := json.Unmarshal([]byte(`{"language":"en"}`), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.GetCSVDelimiter() != ',' {
+		t.Error("expected missing csvDelimiter to fall back to a comma")
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/automuteus/utils/pkg/capture"
+	"github.com/automuteus/utils/pkg/game"
+	"strconv"
+)
+
+const AnonymizedTokenLength = 8
+
+// AnonymizeToken returns a stable pseudonym for s; the first 8 hex characters of its SHA-256. The same input always
+// maps to the same token, so rows can still be correlated after anonymizing
+func AnonymizeToken(s string) string {
+	h := sha256.New()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))[:AnonymizedTokenLength]
+}
+
+func anonymizeID(id uint64) uint64 {
+	v, _ := strconv.ParseUint(AnonymizeToken(fmt.Sprintf("%d", id)), 16, 64)
+	return v
+}
+
+// The Anonymize* functions below return anonymized copies (the input is left untouched), which can be passed straight
+// to the existing *ToCSV serializers for a name-stripped export
+
+func AnonymizeGames(g []*PostgresGame) []*PostgresGame {
+	r := make([]*PostgresGame, 0, len(g))
+	for _, v := range g {
+		if v != nil {
+			c := *v
+			c.ConnectCode = AnonymizeToken(v.ConnectCode)
+			r = append(r, &c)
+		}
+	}
+	return r
+}
+
+func AnonymizeUsers(u []*PostgresUser) []*PostgresUser {
+	r := make([]*PostgresUser, 0, len(u))
+	for _, v := range u {
+		if v != nil {
+			c := *v
+			c.UserID = anonymizeID(v.UserID)
+			r = append(r, &c)
+		}
+	}
+	return r
+}
+
+func AnonymizeUsersGames(ug []*PostgresUserGame) []*PostgresUserGame {
+	r := make([]*PostgresUserGame, 0, len(ug))
+	for _, v := range ug {
+		if v != nil {
+			c := *v
+			c.UserID = anonymizeID(v.UserID)
+			c.PlayerName = AnonymizeToken(v.PlayerName)
+			r = append(r, &c)
+		}
+	}
+	return r
+}
+
+func AnonymizeEvents(e []*PostgresGameEvent) []*PostgresGameEvent {
+	r := make([]*PostgresGameEvent, 0, len(e))
+	for _, v := range e {
+		if v != nil {
+			c := *v
+			if v.UserID != nil {
+				uid := anonymizeID(*v.UserID)
+				c.UserID = &uid
+			}
+			c.Payload = anonymizePayload(v.EventType, v.Payload)
+			r = append(r, &c)
+		}
+	}
+	return r
+}
+
+// anonymizePayload replaces the player names and lobby codes inside an event payload. Payloads that should contain
+// those but can't be parsed are dropped entirely, rather than risk leaking them
+func anonymizePayload(eventType int16, payload string) string {
+	switch capture.EventType(eventType) {
+	case capture.Player:
+		player := game.Player{}
+		if err := json.Unmarshal([]byte(payload), &player); err != nil {
+			return ""
+		}
+		player.Name = AnonymizeToken(player.Name)
+		b, _ := json.Marshal(player)
+		return string(b)
+	case capture.GameOver:
+		gameover := game.Gameover{}
+		if err := json.Unmarshal([]byte(payload), &gameover); err != nil {
+			return ""
+		}
+		for i := range gameover.PlayerInfos {
+			gameover.PlayerInfos[i].Name = AnonymizeToken(gameover.PlayerInfos[i].Name)
+		}
+		b, _ := gameover.Marshal()
+		return string(b)
+	case capture.Lobby:
+		lobby := game.Lobby{}
+		if err := json.Unmarshal([]byte(payload), &lobby); err != nil {
+			return ""
+		}
+		lobby.LobbyCode = AnonymizeToken(lobby.LobbyCode)
+		b, _ := json.Marshal(lobby)
+		return string(b)
+	}
+	return payload
+}
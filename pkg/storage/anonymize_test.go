@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"encoding/json"
+	"github.com/automuteus/utils/pkg/capture"
+	"github.com/automuteus/utils/pkg/game"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizeToken(t *testing.T) {
+	if AnonymizeToken("Alice") != AnonymizeToken("Alice") {
+		t.Error("the same name should always yield the same token")
+	}
+	if AnonymizeToken("Alice") == AnonymizeToken("Bob") {
+		t.Error("different names should yield different tokens")
+	}
+	if len(AnonymizeToken("Alice")) != AnonymizedTokenLength {
+		t.Error("tokens should be 8 hex characters")
+	}
+}
+
+func TestAnonymizeUsersGames(t *testing.T) {
+	ug := []*PostgresUserGame{
+		{UserID: UserIDInt, GuildID: GuildIDInt, GameID: 1, PlayerName: "Alice"},
+		nil,
+		{UserID: UserIDInt, GuildID: GuildIDInt, GameID: 2, PlayerName: "Alice"},
+		{UserID: UserIDInt + 1, GuildID: GuildIDInt, GameID: 2, PlayerName: "Bob"},
+	}
+	anon := AnonymizeUsersGames(ug)
+	if len(anon) != 3 {
+		t.Fatalf("expected nil rows to be dropped, got %d rows", len(anon))
+	}
+	if anon[0].UserID != anon[1].UserID || anon[0].PlayerName != anon[1].PlayerName {
+		t.Error("the same player should map to the same tokens across rows")
+	}
+	if anon[0].UserID == anon[2].UserID || anon[0].PlayerName == anon[2].PlayerName {
+		t.Error("different players should map to different tokens")
+	}
+	if anon[0].UserID == UserIDInt || anon[0].PlayerName == "Alice" {
+		t.Error("expected the user ID and name to be replaced")
+	}
+	if ug[0].PlayerName != "Alice" {
+		t.Error("anonymizing should not modify the input rows")
+	}
+	if strings.Contains(UsersGamesToCSV(anon), "Alice") {
+		t.Error("anonymized CSV export should not contain player names")
+	}
+}
+
+func TestAnonymizeEvents(t *testing.T) {
+	uid := UserIDInt
+	payload, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Alice", Color: game.Red})
+	events := []*PostgresGameEvent{
+		{EventID: 1, UserID: &uid, GameID: 1, EventType: int16(capture.Player), Payload: string(payload)},
+		{EventID: 2, UserID: nil, GameID: 1, EventType: int16(capture.State), Payload: DiscussCode},
+		{EventID: 3, UserID: nil, GameID: 1, EventType: int16(capture.Player), Payload: "{not json"},
+	}
+	anon := AnonymizeEvents(events)
+
+	if anon[0].UserID == nil || *anon[0].UserID == UserIDInt {
+		t.Error("expected the event user ID to be replaced")
+	}
+	player := game.Player{}
+	if err := json.Unmarshal([]byte(anon[0].Payload), &player); err != nil {
+		t.Fatal(err)
+	}
+	if player.Name != AnonymizeToken("Alice") || player.Action != game.DIED {
+		t.Error("expected only the player name in the payload to be replaced")
+	}
+	if anon[1].UserID != nil || anon[1].Payload != DiscussCode {
+		t.Error("events without player data should be unchanged")
+	}
+	if anon[2].Payload != "" {
+		t.Error("unparseable player payloads should be dropped rather than leaked")
+	}
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
+)
+
+const DefaultLeaderboardCacheTTL = time.Minute * 5
+
+// QueryCache is a concurrency-safe, in-memory cache for query results. Entries are keyed by the method name and its
+// arguments, and are refetched once they are older than the TTL. Concurrent misses for the same key share a single
+// in-flight fetch, so a burst of identical leaderboard commands only issues one query
+type QueryCache struct {
+	ttl      time.Duration
+	lock     sync.Mutex
+	entries  map[string]queryCacheEntry
+	inFlight singleflight.Group
+
+	// lastSweep is when stale entries were last dropped from entries; see set
+	lastSweep time.Time
+}
+
+type queryCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func NewQueryCache(ttl time.Duration) *QueryCache {
+	if ttl <= 0 {
+		ttl = DefaultLeaderboardCacheTTL
+	}
+	return &QueryCache{
+		ttl:      ttl,
+		lock:     sync.Mutex{},
+		entries:  make(map[string]queryCacheEntry),
+		inFlight: singleflight.Group{},
+	}
+}
+
+func queryCacheKey(method string, args ...interface{}) string {
+	return fmt.Sprintf("%s:%v", method, args)
+}
+
+// Get returns the cached value for the key if it hasn't expired. Otherwise, fetch is called and its result is cached.
+// Errors returned by fetch are passed through to every waiting caller, and are never cached
+func (cache *QueryCache) Get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if v, ok := cache.get(key); ok {
+		return v, nil
+	}
+
+	v, err, _ := cache.inFlight.Do(key, func() (interface{}, error) {
+		// a fetch for this key may have completed between the check above and joining the group
+		if v, ok := cache.get(key); ok {
+			return v, nil
+		}
+		v, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		cache.set(key, v)
+		return v, nil
+	})
+	return v, err
+}
+
+func (cache *QueryCache) get(key string) (interface{}, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().Before(entry.expires) {
+		return entry.value, true
+	}
+	delete(cache.entries, key)
+	return nil, false
+}
+
+func (cache *QueryCache) set(key string, v interface{}) {
+	now := time.Now()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	// keys for guilds that never query again aren't dropped by get, so sweep them out, but at most once per TTL so a
+	// write doesn't usually have to scan every entry
+	if now.Sub(cache.lastSweep) >= cache.ttl {
+		for k, e := range cache.entries {
+			if now.After(e.expires) {
+				delete(cache.entries, k)
+			}
+		}
+		cache.lastSweep = now
+	}
+	cache.entries[key] = queryCacheEntry{
+		value:   v,
+		expires: now.Add(cache.ttl),
+	}
+}
+
+// CachingPsqlInterface is an opt-in wrapper around PsqlInterface that caches the results of the expensive server
+// leaderboard queries. All other methods fall through to the wrapped PsqlInterface
+type CachingPsqlInterface struct {
+	*PsqlInterface
+	cache *QueryCache
+}
+
+func NewCachingPsqlInterface(psqlInterface *PsqlInterface, ttl time.Duration) *CachingPsqlInterface {
+	return &CachingPsqlInterface{
+		PsqlInterface: psqlInterface,
+		cache:         NewQueryCache(ttl),
+	}
+}
+
+func (c *CachingPsqlInterface) cachedQuery(key string, query func(conn PgxIface) (interface{}, error)) (interface{}, error) {
+	return c.cache.Get(key, func() (interface{}, error) {
+		conn, err := c.Pool.Acquire(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Release()
+		return query(c.withQueryTimeout(conn.Conn()))
+	})
+}
+
+func (c *CachingPsqlInterface) TotalWinRankingForServerByRole(guildID uint64, role int16) []*PostgresPlayerRanking {
+	v, err := c.cachedQuery(queryCacheKey("TotalWinRankingForServerByRole", guildID, role), func(conn PgxIface) (interface{}, error) {
+		return totalWinRankingForServerByRole(conn, guildID, role)
+	})
+	if err != nil {
+		c.logError("TotalWinRankingForServerByRole", err, guildID, role)
+	}
+	r, _ := v.([]*PostgresPlayerRanking)
+	return r
+}
+
+func (c *CachingPsqlInterface) TotalWinRankingForServer(guildID uint64) []*PostgresPlayerRanking {
+	return c.TotalWinRankingForServerWithOptions(guildID, WinRankingOptions{})
+}
+
+func (c *CachingPsqlInterface) TotalWinRankingForServerExcludingDisconnects(guildID uint64) []*PostgresPlayerRanking {
+	return c.TotalWinRankingForServerWithOptions(guildID, WinRankingOptions{ExcludeDisconnects: true})
+}
+
+func (c *CachingPsqlInterface) TotalWinRankingForServerWithOptions(guildID uint64, opts WinRankingOptions) []*PostgresPlayerRanking {
+	v, err := c.cachedQuery(queryCacheKey("TotalWinRankingForServer", guildID, opts), func(conn PgxIface) (interface{}, error) {
+		return totalWinRankingForServer(conn, guildID, opts)
+	})
+	if err != nil {
+		c.logError("TotalWinRankingForServerWithOptions", err, guildID, opts)
+	}
+	r, _ := v.([]*PostgresPlayerRanking)
+	return r
+}
+
+func (c *CachingPsqlInterface) BestTeammateForServerByRole(guildID string, role int16, leaderboardMin int) []*PostgresBestTeammatePlayerRanking {
+	v, err := c.cachedQuery(queryCacheKey("BestTeammateForServerByRole", guildID, role, leaderboardMin), func(conn PgxIface) (interface{}, error) {
+		return bestTeammateForServerByRole(conn, guildID, role, leaderboardMin)
+	})
+	if err != nil {
+		c.logError("BestTeammateForServerByRole", err, guildID, role, leaderboardMin)
+	}
+	r, _ := v.([]*PostgresBestTeammatePlayerRanking)
+	return r
+}
+
+func (c *CachingPsqlInterface) WorstTeammateForServerByRole(guildID string, role int16, leaderboardMin int) []*PostgresWorstTeammatePlayerRanking {
+	v, err := c.cachedQuery(queryCacheKey("WorstTeammateForServerByRole", guildID, role, leaderboardMin), func(conn PgxIface) (interface{}, error) {
+		return worstTeammateForServerByRole(conn, guildID, role, leaderboardMin)
+	})
+	if err != nil {
+		c.logError("WorstTeammateForServerByRole", err, guildID, role, leaderboardMin)
+	}
+	r, _ := v.([]*PostgresWorstTeammatePlayerRanking)
+	return r
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"github.com/pashagolub/pgxmock"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCache_Get(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// only a single query is expected; the second Get within the TTL must be served from the cache
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) FROM users_games WHERE users_games.guild_id = (.+) GROUP BY user_id (.+)$").
+		WithArgs(GuildIDInt).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"user_id", "win", "total", "win_rate"}).
+				AddRow(UserIDInt, int64(3), int64(4), float64(75)))
+
+	queries := 0
+	fetch := func() (interface{}, error) {
+		queries++
+		return totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{})
+	}
+
+	cache := NewQueryCache(time.Minute)
+	key := queryCacheKey("TotalWinRankingForServer", GuildIDInt)
+	for i := 0; i < 2; i++ {
+		v, err := cache.Get(key, fetch)
+		if err != nil {
+			t.Error(err)
+		}
+		r, ok := v.([]*PostgresPlayerRanking)
+		if !ok || len(r) != 1 || r[0].UserID != UserIDInt {
+			t.Error("cached value didn't match the ranking returned from Postgres")
+		}
+	}
+	if queries != 1 {
+		t.Errorf("expected 1 query to hit the database, got %d", queries)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestQueryCache_Expiry(t *testing.T) {
+	cache := NewQueryCache(time.Millisecond)
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	_, _ = cache.Get("key", fetch)
+	time.Sleep(time.Millisecond * 5)
+	v, _ := cache.Get("key", fetch)
+	if calls != 2 || v.(int) != 2 {
+		t.Error("expected a stale entry to be refetched")
+	}
+}
+
+func TestQueryCache_Eviction(t *testing.T) {
+	cache := NewQueryCache(time.Millisecond * 20)
+	fetch := func() (interface{}, error) {
+		return 1, nil
+	}
+
+	_, _ = cache.Get("a", fetch)
+	_, _ = cache.Get("b", fetch)
+	time.Sleep(time.Millisecond * 30)
+
+	// a stale entry is dropped as soon as it's looked up
+	_, _ = cache.get("a")
+	if _, ok := cache.entries["a"]; ok {
+		t.Error("expected the stale entry to be dropped on lookup")
+	}
+
+	// one that's never looked up again is swept out by the next write, once a TTL has passed since the last sweep
+	_, _ = cache.Get("c", fetch)
+	if _, ok := cache.entries["b"]; ok {
+		t.Error("expected the stale entry to be swept out by a later write")
+	}
+	_, _ = cache.Get("d", fetch)
+	if len(cache.entries) != 2 {
+		t.Errorf("expected only the 2 fresh entries to remain, got %d", len(cache.entries))
+	}
+}
+
+func TestQueryCache_ErrorsNotCached(t *testing.T) {
+	cache := NewQueryCache(time.Minute)
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return calls, nil
+	}
+
+	if _, err := cache.Get("key", fetch); err == nil {
+		t.Error("expected the fetch error to be returned")
+	}
+	v, err := cache.Get("key", fetch)
+	if err != nil {
+		t.Error(err)
+	}
+	if calls != 2 || v.(int) != 2 {
+		t.Error("expected a failed fetch not to be cached")
+	}
+}
+
+func TestQueryCache_CoalescesConcurrentFetches(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// exactly one query is expected, no matter how many callers miss the cache at once
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) FROM users_games WHERE users_games.guild_id = (.+) GROUP BY user_id (.+)$").
+		WithArgs(GuildIDInt).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"user_id", "win", "total", "win_rate"}).
+				AddRow(UserIDInt, int64(3), int64(4), float64(75)))
+
+	var queries int32
+	release := make(chan struct{})
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		return totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{})
+	}
+
+	const callers = 20
+	cache := NewQueryCache(time.Minute)
+	key := queryCacheKey("TotalWinRankingForServer", GuildIDInt)
+	wg := sync.WaitGroup{}
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := cache.Get(key, fetch)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if r, ok := v.([]*PostgresPlayerRanking); !ok || len(r) != 1 {
+				errs <- errors.New("coalesced caller received an unexpected value")
+			}
+		}()
+	}
+	// give every caller a chance to join the in-flight fetch before it completes
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if q := atomic.LoadInt32(&queries); q != 1 {
+		t.Errorf("expected concurrent callers to share 1 query, got %d", q)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
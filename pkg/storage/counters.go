@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"github.com/georgysavva/scany/pgxscan"
+	"sync/atomic"
+)
+
+// GameCounters keeps running totals of games in progress and finished games, for dashboards that read them far more
+// often than a COUNT(*) should run. They're seeded once with PrimeCounters and then kept up to date by AddInitialGame
+// and UpdateGameAndPlayers, so games created or deleted by other processes (or by DeleteGame) aren't reflected until
+// the next prime
+type GameCounters struct {
+	inProgress int64
+	total      int64
+}
+
+// InProgress is the number of games that have started but not finished
+func (c *GameCounters) InProgress() int64 {
+	if v := atomic.LoadInt64(&c.inProgress); v > 0 {
+		return v
+	}
+	// games that were already running when the counters were primed can finish "twice"
+	return 0
+}
+
+// Total is the number of finished games, across all guilds
+func (c *GameCounters) Total() int64 {
+	return atomic.LoadInt64(&c.total)
+}
+
+func (c *GameCounters) gameStarted() {
+	atomic.AddInt64(&c.inProgress, 1)
+}
+
+func (c *GameCounters) gameFinished() {
+	atomic.AddInt64(&c.inProgress, -1)
+	atomic.AddInt64(&c.total, 1)
+}
+
+func (c *GameCounters) prime(conn PgxIface) error {
+	var r struct {
+		InProgress int64 `db:"in_progress"`
+		Total      int64 `db:"total"`
+	}
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT "+
+		"COUNT(*) FILTER ( WHERE end_time = -1 ) AS in_progress, "+
+		"COUNT(*) FILTER ( WHERE end_time != -1 ) AS total "+
+		"FROM games;")
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.inProgress, r.InProgress)
+	atomic.StoreInt64(&c.total, r.Total)
+	return nil
+}
+
+// PrimeCounters seeds the game counters from the database. Call it once after Init; calling it again resyncs them
+func (psqlInterface *PsqlInterface) PrimeCounters() error {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return psqlInterface.counters.prime(psqlInterface.withQueryTimeout(conn.Conn()))
+}
+
+// Counters returns the live game counters. They read as 0 until PrimeCounters is called
+func (psqlInterface *PsqlInterface) Counters() *GameCounters {
+	return &psqlInterface.counters
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"github.com/pashagolub/pgxmock"
+	"sync"
+	"testing"
+)
+
+func TestGameCounters(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FILTER \\( WHERE end_time = -1 \\) AS in_progress, COUNT\\(\\*\\) FILTER \\( WHERE end_time != -1 \\) AS total FROM games;$").
+		WillReturnRows(pgxmock.NewRows([]string{"in_progress", "total"}).AddRow(int64(2), int64(100)))
+
+	var c GameCounters
+	if err := c.prime(mock); err != nil {
+		t.Fatal(err)
+	}
+	if c.InProgress() != 2 || c.Total() != 100 {
+		t.Errorf("expected 2 in progress and 100 total after priming, got %d and %d", c.InProgress(), c.Total())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.gameStarted()
+			c.gameFinished()
+		}()
+	}
+	c.gameStarted()
+	wg.Wait()
+	if c.InProgress() != 3 || c.Total() != 150 {
+		t.Errorf("expected 3 in progress and 150 total, got %d and %d", c.InProgress(), c.Total())
+	}
+
+	// the 3 running games finishing, plus 2 that started before the counters were primed
+	for i := 0; i < 5; i++ {
+		c.gameFinished()
+	}
+	if c.InProgress() != 0 {
+		t.Errorf("expected games in progress to never read below 0, got %d", c.InProgress())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -2,8 +2,11 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/automuteus/utils/pkg/capture"
+	"github.com/automuteus/utils/pkg/game"
 	"github.com/automuteus/utils/pkg/premium"
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgconn"
@@ -13,7 +16,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,15 +29,37 @@ type PgxIface interface {
 	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
 	Ping(context.Context) error
 	Prepare(context.Context, string, string) (*pgconn.StatementDescription, error)
+	CopyFrom(context.Context, pgx.Identifier, []string, pgx.CopyFromSource) (int64, error)
 }
 
 type PsqlInterface struct {
 	Pool *pgxpool.Pool
 
+	// Logger receives the errors that query methods log instead of returning. Defaults to the standard logger when nil
+	Logger *log.Logger
+
+	// DefaultQueryTimeout bounds each query that doesn't already have a deadline, so a runaway query can't hold a
+	// connection forever. Zero (the default) means no timeout. Schema loading with LoadAndExecFromFile isn't bounded
+	DefaultQueryTimeout time.Duration
+
+	counters GameCounters
+
 	// TODO does this require a lock? How should stuff be written/read from psql in an async way? Is this even a concern?
 	//https://brandur.org/postgres-connections
 }
 
+func (psqlInterface *PsqlInterface) logError(method string, err error, args ...interface{}) {
+	logger := psqlInterface.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	strArgs := make([]string, len(args))
+	for i, v := range args {
+		strArgs[i] = fmt.Sprintf("%v", v)
+	}
+	logger.Printf("[Storage] %s(%s): %s", method, strings.Join(strArgs, ", "), err)
+}
+
 func ConstructPsqlConnectURL(addr, username, password string) string {
 	return fmt.Sprintf("postgres://%s?user=%s&password=%s", addr, username, password)
 }
@@ -83,7 +110,7 @@ func (psqlInterface *PsqlInterface) GetGuildForDownload(guildID uint64) (*Postgr
 	}
 	defer conn.Release()
 
-	guild, err := getGuild(conn.Conn(), guildID)
+	guild, err := getGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
 	if err != nil {
 		return nil, err
 	}
@@ -113,7 +140,7 @@ func insertUser(conn PgxIface, userID uint64) error {
 }
 
 func (psqlInterface *PsqlInterface) OptUserByString(userID string, opt bool) error {
-	uid, err := strconv.ParseUint(userID, 10, 64)
+	uid, err := ParseSnowflake(userID)
 	if err != nil {
 		return err
 	}
@@ -123,7 +150,7 @@ func (psqlInterface *PsqlInterface) OptUserByString(userID string, opt bool) err
 	}
 	defer conn.Release()
 
-	return optUser(conn.Conn(), uid, opt)
+	return optUser(psqlInterface.withQueryTimeout(conn.Conn()), uid, opt)
 }
 
 func optUser(conn PgxIface, uid uint64, opt bool) error {
@@ -154,7 +181,7 @@ func optUser(conn PgxIface, uid uint64, opt bool) error {
 }
 
 func setUserVoteTime(conn PgxIface, userID string, timeUnix int64) error {
-	uid, err := strconv.ParseUint(userID, 10, 64)
+	uid, err := ParseSnowflake(userID)
 	if err != nil {
 		return err
 	}
@@ -175,11 +202,11 @@ func (psqlInterface *PsqlInterface) GetUserByString(userID string) (*PostgresUse
 		return nil, err
 	}
 	defer conn.Release()
-	return getUserByString(conn.Conn(), userID)
+	return getUserByString(psqlInterface.withQueryTimeout(conn.Conn()), userID)
 }
 
 func getUserByString(conn PgxIface, userID string) (*PostgresUser, error) {
-	uid, err := strconv.ParseUint(userID, 10, 64)
+	uid, err := ParseSnowflake(userID)
 	if err != nil {
 		return nil, err
 	}
@@ -201,7 +228,30 @@ func getUser(conn PgxIface, userID uint64) (*PostgresUser, error) {
 
 func (psqlInterface *PsqlInterface) GetGame(guildID, connectCode, matchID string) (*PostgresGame, error) {
 	var games []*PostgresGame
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &games, "SELECT * FROM games WHERE guild_id = $1 AND game_id = $2 AND connect_code = $3;", guildID, matchID, connectCode)
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &games, "SELECT * FROM games WHERE guild_id = $1 AND game_id = $2 AND connect_code = $3;", guildID, matchID, connectCode)
+	if err != nil {
+		return nil, err
+	}
+	if len(games) > 0 {
+		return games[0], nil
+	}
+	return nil, nil
+}
+
+// GetGameByConnectCode returns the most recent game on the guild that used the provided connect code, or nil if there
+// isn't one. Connect codes are reused over time, so only the newest game is returned
+func (psqlInterface *PsqlInterface) GetGameByConnectCode(guildID, connectCode string) (*PostgresGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return getGameByConnectCode(psqlInterface.withQueryTimeout(conn.Conn()), guildID, connectCode)
+}
+
+func getGameByConnectCode(conn PgxIface, guildID, connectCode string) (*PostgresGame, error) {
+	var games []*PostgresGame
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT * FROM games WHERE guild_id = $1 AND connect_code = $2 ORDER BY start_time DESC LIMIT 1;", guildID, connectCode)
 	if err != nil {
 		return nil, err
 	}
@@ -213,22 +263,82 @@ func (psqlInterface *PsqlInterface) GetGame(guildID, connectCode, matchID string
 
 func (psqlInterface *PsqlInterface) GetGameEvents(matchID string) ([]*PostgresGameEvent, error) {
 	var events []*PostgresGameEvent
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &events, "SELECT * FROM game_events WHERE game_id = $1 ORDER BY event_id ASC;", matchID)
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &events, "SELECT * FROM game_events WHERE game_id = $1 ORDER BY event_id ASC;", matchID)
 	if err != nil {
 		return nil, err
 	}
 	return events, nil
 }
 
+// GameEventsPaged returns up to limit of the game's events with event_time > afterEventTime, oldest first. Pass the
+// last returned event's EventTime as afterEventTime to fetch the next page. Since event times are only to the second,
+// a page never ends partway through a second, so no events are skipped between pages; pages may therefore be shorter
+// than limit before the end of the game. If a single second has more than limit events, there's no page that can hold
+// them, so an error is returned instead and the caller should retry with a larger limit
+func (psqlInterface *PsqlInterface) GameEventsPaged(gameID int64, afterEventTime int64, limit int) ([]*PostgresGameEvent, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return gameEventsPaged(psqlInterface.withQueryTimeout(conn.Conn()), gameID, afterEventTime, limit)
+}
+
+func gameEventsPaged(conn PgxIface, gameID int64, afterEventTime int64, limit int) ([]*PostgresGameEvent, error) {
+	if limit < 1 {
+		return nil, errors.New("page limit must be at least 1")
+	}
+	r := []*PostgresGameEvent{}
+	// fetch one extra event to tell whether the page would split a second
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT * FROM game_events WHERE game_id = $1 AND event_time > $2 ORDER BY event_time ASC, event_id ASC LIMIT $3;", gameID, afterEventTime, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) <= limit {
+		return r, nil
+	}
+	next := r[limit]
+	r = r[:limit]
+	end := len(r)
+	for end > 0 && r[end-1].EventTime == next.EventTime {
+		end--
+	}
+	if end == 0 {
+		return nil, fmt.Errorf("page limit %d is too small for the events at event_time %d", limit, next.EventTime)
+	}
+	return r[:end], nil
+}
+
+// GetGameRoster returns every player recorded for the game, crewmates first, then by player name. Unknown games have
+// an empty roster
+func (psqlInterface *PsqlInterface) GetGameRoster(gameID int64) ([]*PostgresUserGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return getGameRoster(psqlInterface.withQueryTimeout(conn.Conn()), gameID)
+}
+
+func getGameRoster(conn PgxIface, gameID int64) ([]*PostgresUserGame, error) {
+	r := []*PostgresUserGame{}
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT * FROM users_games WHERE game_id = $1 ORDER BY player_role ASC, player_name ASC, user_id ASC;", gameID)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
 func insertGame(conn PgxIface, game *PostgresGame) (uint64, error) {
-	t, err := conn.Query(context.Background(), "INSERT INTO games VALUES (DEFAULT, $1, $2, $3, $4, $5) RETURNING game_id;", game.GuildID, game.ConnectCode, game.StartTime, game.WinType, game.EndTime)
+	t, err := conn.Query(context.Background(), "INSERT INTO games (guild_id, connect_code, start_time, win_type, end_time, region) "+
+		"VALUES ($1, $2, $3, $4, $5, $6) RETURNING game_id;",
+		game.GuildID, game.ConnectCode, game.StartTime, game.WinType, game.EndTime, game.Region)
 	if t != nil {
 		for t.Next() {
 			g := uint64(0)
 			err := t.Scan(&g)
 
 			if err != nil {
-				log.Println(err)
 				t.Close()
 				return 0, err
 			}
@@ -275,13 +385,11 @@ func isUserPremium(conn PgxIface, dbl *dbl.Client, userID string) (bool, error)
 		return false, err
 	}
 	if voted {
-		// do this in the background so the overall check is quick. We can overwrite because we know that tx_time=nil
-		go func() {
-			err := setUserVoteTime(conn, userID, time.Now().Unix())
-			if err != nil {
-				log.Println(err)
-			}
-		}()
+		// we can overwrite because we know that tx_time=nil. This isn't done in the background, because conn is released
+		// as soon as the premium check returns. The user is premium even if recording the vote fails
+		if err := setUserVoteTime(conn, userID, time.Now().Unix()); err != nil {
+			return true, err
+		}
 		return true, nil
 	}
 	return false, nil
@@ -297,41 +405,47 @@ func (psqlInterface *PsqlInterface) GetGuildOrUserPremiumStatus(official bool, d
 	}
 	defer conn.Release()
 
-	return guildOrUserPremium(conn.Conn(), dbl, guildID, userID)
+	tier, daysRem, err := guildOrUserPremium(psqlInterface.withQueryTimeout(conn.Conn()), dbl, guildID, userID)
+	if err != nil {
+		// the lookups fall back to the free tier, so a failed one is logged rather than failing the whole check
+		psqlInterface.logError("GetGuildOrUserPremiumStatus", err, guildID, userID)
+	}
+	return tier, daysRem, nil
 }
 
+// guildOrUserPremium returns the premium tier for the guild or, failing that, the user. A non-nil error is a lookup
+// that failed along the way; the tier returned alongside it is still the one to use
 func guildOrUserPremium(conn PgxIface, dbl *dbl.Client, guildID, userID string) (premium.Tier, int, error) {
-	tier, daysRem := getGuildPremiumStatus(conn, guildID, 0)
+	tier, daysRem, lookupErr := getGuildPremiumStatus(conn, guildID, 0)
 	// only check the user premium if the guild doesn't have it
 	if premium.IsExpired(tier, daysRem) && userID != "" {
 		prem, err := isUserPremium(conn, dbl, userID)
 		if err != nil {
-			log.Println(err)
+			lookupErr = err
 		}
 		if prem {
 			// no expiry because the expiry is handled per-user elsewhere
-			return premium.TrialTier, premium.NoExpiryCode, nil
+			return premium.TrialTier, premium.NoExpiryCode, lookupErr
 		}
 	}
-	return tier, daysRem, nil
+	return tier, daysRem, lookupErr
 }
 
-func getGuildPremiumStatus(conn PgxIface, guildID string, depth int) (premium.Tier, int) {
+// getGuildPremiumStatus returns the free tier, along with the error, if the guild can't be looked up
+func getGuildPremiumStatus(conn PgxIface, guildID string, depth int) (premium.Tier, int, error) {
 	// if we somehow recurse too deep...
 	if depth > 3 {
-		return premium.FreeTier, 0
+		return premium.FreeTier, 0, nil
 	}
 
-	gid, err := strconv.ParseUint(guildID, 10, 64)
+	gid, err := ParseSnowflake(guildID)
 	if err != nil {
-		log.Println(err)
-		return premium.FreeTier, 0
+		return premium.FreeTier, 0, err
 	}
 
 	guild, err := getGuild(conn, gid)
 	if err != nil {
-		log.Println(err)
-		return premium.FreeTier, 0
+		return premium.FreeTier, 0, err
 	}
 
 	// if this is a recursive call, then we ignore the transfer (this is how inheriting works)
@@ -339,7 +453,7 @@ func getGuildPremiumStatus(conn PgxIface, guildID string, depth int) (premium.Ti
 		// transferred servers are always treated as free tier, even if their tier/expiry is marked otherwise (the server
 		// that premium was transferred to still uses these values, as "inherited")
 		if guild.TransferredTo != nil {
-			return premium.FreeTier, 0
+			return premium.FreeTier, 0, nil
 		}
 	}
 
@@ -351,7 +465,7 @@ func getGuildPremiumStatus(conn PgxIface, guildID string, depth int) (premium.Ti
 		daysRem = int(premium.SubDays - (diff / SecsInADay))
 		// if the premium for this server is still active, return it (disregarding inheritance)
 		if daysRem > 0 {
-			return premium.Tier(guild.Premium), daysRem
+			return premium.Tier(guild.Premium), daysRem, nil
 		}
 	}
 
@@ -361,7 +475,7 @@ func getGuildPremiumStatus(conn PgxIface, guildID string, depth int) (premium.Ti
 		return getGuildPremiumStatus(conn, fmt.Sprintf("%d", *guild.InheritsFrom), depth+1)
 	}
 
-	return premium.Tier(guild.Premium), daysRem
+	return premium.Tier(guild.Premium), daysRem, nil
 }
 
 func (psqlInterface *PsqlInterface) EnsureGuildExists(guildID uint64, guildName string) (*PostgresGuild, error) {
@@ -371,14 +485,14 @@ func (psqlInterface *PsqlInterface) EnsureGuildExists(guildID uint64, guildName
 	}
 	defer conn.Release()
 
-	guild, err := getGuild(conn.Conn(), guildID)
+	guild, err := getGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
 
 	if guild == nil {
-		err := insertGuild(conn.Conn(), guildID, guildName)
+		err := insertGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID, guildName)
 		if err != nil {
 			return nil, err
 		}
-		return getGuild(conn.Conn(), guildID)
+		return getGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
 	}
 	return guild, err
 }
@@ -389,7 +503,7 @@ func (psqlInterface *PsqlInterface) EnsureUserExists(userID uint64) (*PostgresUs
 		return nil, err
 	}
 	defer conn.Release()
-	return ensureUserExists(conn.Conn(), userID)
+	return ensureUserExists(psqlInterface.withQueryTimeout(conn.Conn()), userID)
 }
 
 func ensureUserExists(conn PgxIface, userID uint64) (*PostgresUser, error) {
@@ -398,7 +512,7 @@ func ensureUserExists(conn PgxIface, userID uint64) (*PostgresUser, error) {
 	if user == nil {
 		err := insertUser(conn, userID)
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
 		return getUser(conn, userID)
 	}
@@ -411,7 +525,7 @@ func (psqlInterface *PsqlInterface) GetGamesForGuild(guildID uint64) ([]*Postgre
 		return nil, err
 	}
 	defer conn.Release()
-	return getGamesForGuild(conn.Conn(), guildID)
+	return getGamesForGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
 }
 
 func getGamesForGuild(conn PgxIface, guildID uint64) ([]*PostgresGame, error) {
@@ -423,13 +537,285 @@ func getGamesForGuild(conn PgxIface, guildID uint64) ([]*PostgresGame, error) {
 	return nil, nil
 }
 
+// RecentGamesForServer returns a page of the guild's finished games, newest first
+func (psqlInterface *PsqlInterface) RecentGamesForServer(guildID string, limit, offset int) ([]*PostgresGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return recentGamesForServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, limit, offset)
+}
+
+func recentGamesForServer(conn PgxIface, guildID string, limit, offset int) ([]*PostgresGame, error) {
+	games := []*PostgresGame{}
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT * FROM games WHERE guild_id = $1 AND end_time != -1 ORDER BY start_time DESC, game_id DESC LIMIT $2 OFFSET $3;", guildID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return games, nil
+}
+
+// GamesByDurationRangeOnServer returns the guild's finished games that lasted between min and max (inclusive), newest
+// first. Game times are stored in whole seconds, so the bounds are truncated to seconds
+func (psqlInterface *PsqlInterface) GamesByDurationRangeOnServer(guildID string, min, max time.Duration) ([]*PostgresGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return gamesByDurationRangeOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, min, max)
+}
+
+func gamesByDurationRangeOnServer(conn PgxIface, guildID string, min, max time.Duration) ([]*PostgresGame, error) {
+	if min < 0 {
+		return nil, fmt.Errorf("minimum duration %s is negative", min)
+	}
+	if min > max {
+		return nil, fmt.Errorf("minimum duration %s is greater than maximum duration %s", min, max)
+	}
+	games := []*PostgresGame{}
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT * FROM games WHERE guild_id = $1 AND end_time != -1 "+
+		"AND (end_time - start_time) BETWEEN $2 AND $3 "+
+		"ORDER BY start_time DESC, game_id DESC;", guildID, int64(min/time.Second), int64(max/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	return games, nil
+}
+
+// FindDuplicateGames returns every game on the guild that shares its connect code with another game whose time span
+// overlaps it, grouped by connect code and oldest first, so that all but one of each group can be removed with
+// DeleteGame. Games that never ended are treated as spanning only their start time
+func (psqlInterface *PsqlInterface) FindDuplicateGames(guildID string) ([]*PostgresGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return findDuplicateGames(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func findDuplicateGames(conn PgxIface, guildID string) ([]*PostgresGame, error) {
+	games := []*PostgresGame{}
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT * FROM games g WHERE g.guild_id = $1 AND EXISTS ("+
+		"SELECT 1 FROM games o WHERE o.guild_id = g.guild_id AND o.connect_code = g.connect_code AND o.game_id <> g.game_id "+
+		"AND o.start_time <= GREATEST(g.end_time, g.start_time) AND g.start_time <= GREATEST(o.end_time, o.start_time)"+
+		") ORDER BY g.connect_code, g.start_time, g.game_id;", guildID)
+	if err != nil {
+		return nil, err
+	}
+	return games, nil
+}
+
+// DuoImposterGames returns the guild's finished games in which userA and userB were both imposters, newest first
+func (psqlInterface *PsqlInterface) DuoImposterGames(userA, userB, guildID string) ([]*PostgresGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return duoImposterGames(psqlInterface.withQueryTimeout(conn.Conn()), userA, userB, guildID)
+}
+
+func duoImposterGames(conn PgxIface, userA, userB, guildID string) ([]*PostgresGame, error) {
+	if userA == userB {
+		return nil, fmt.Errorf("a duo needs two different users, got %s twice", userA)
+	}
+	games := []*PostgresGame{}
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT games.* FROM games "+
+		"INNER JOIN users_games a ON a.game_id = games.game_id AND a.user_id = $1 AND a.player_role = $4 "+
+		"INNER JOIN users_games b ON b.game_id = games.game_id AND b.user_id = $2 AND b.player_role = $4 "+
+		"WHERE games.guild_id = $3 AND games.end_time != -1 "+
+		"ORDER BY games.start_time DESC, games.game_id DESC;", userA, userB, guildID, int16(game.ImposterRole))
+	if err != nil {
+		return nil, err
+	}
+	return games, nil
+}
+
+// FastestTaskWinsOnServer returns the guild's shortest games won by the crewmates completing their tasks, fastest first
+func (psqlInterface *PsqlInterface) FastestTaskWinsOnServer(guildID string, limit int) ([]*PostgresGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return fastestTaskWinsOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, limit)
+}
+
+func fastestTaskWinsOnServer(conn PgxIface, guildID string, limit int) ([]*PostgresGame, error) {
+	games := []*PostgresGame{}
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT * FROM games WHERE guild_id = $1 AND win_type = $2 AND end_time != -1 "+
+		"ORDER BY (end_time - start_time) ASC, start_time ASC, game_id ASC "+
+		"LIMIT $3;", guildID, int16(game.HumansByTask), limit)
+	if err != nil {
+		return nil, err
+	}
+	return games, nil
+}
+
+// AdjacentUserGames returns the user's games on the guild that started immediately before and after gameID, ordered
+// by start time and then game ID. Either is nil if there's no such game
+func (psqlInterface *PsqlInterface) AdjacentUserGames(userID, guildID string, gameID int64) (prev, next *PostgresGame, err error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Release()
+	return adjacentUserGames(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID, gameID)
+}
+
+func adjacentUserGames(conn PgxIface, userID, guildID string, gameID int64) (prev, next *PostgresGame, err error) {
+	prev, err = adjacentUserGame(conn, userID, guildID, gameID, "<", "DESC")
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err = adjacentUserGame(conn, userID, guildID, gameID, ">", "ASC")
+	if err != nil {
+		return nil, nil, err
+	}
+	return prev, next, nil
+}
+
+// adjacentUserGame finds the nearest of the user's games in one direction; cmp and order are never user input
+func adjacentUserGame(conn PgxIface, userID, guildID string, gameID int64, cmp, order string) (*PostgresGame, error) {
+	games := []*PostgresGame{}
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT games.* FROM games "+
+		"INNER JOIN users_games ON users_games.game_id = games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 "+
+		"AND (games.start_time, games.game_id) "+cmp+" (SELECT start_time, game_id FROM games WHERE game_id = $3) "+
+		"ORDER BY games.start_time "+order+", games.game_id "+order+" "+
+		"LIMIT 1;", userID, guildID, gameID)
+	if err != nil {
+		return nil, err
+	}
+	if len(games) == 0 {
+		return nil, nil
+	}
+	return games[0], nil
+}
+
+// ConnectCodesOnServer returns the distinct connect codes used by the guild's games (finished or not), most recently
+// used first
+func (psqlInterface *PsqlInterface) ConnectCodesOnServer(guildID string, limit int) ([]string, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return connectCodesOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, limit)
+}
+
+func connectCodesOnServer(conn PgxIface, guildID string, limit int) ([]string, error) {
+	codes := []string{}
+	err := pgxscan.Select(context.Background(), conn, &codes, "SELECT connect_code FROM games WHERE guild_id = $1 "+
+		"GROUP BY connect_code "+
+		"ORDER BY MAX(start_time) DESC, connect_code ASC "+
+		"LIMIT $2;", guildID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// FindMalformedGames returns the guild's finished games that look like capture bugs, oldest first: those without any
+// players, those that ended before they started, and those with an event payload that can't be parsed
+func (psqlInterface *PsqlInterface) FindMalformedGames(guildID string) ([]*PostgresGame, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return findMalformedGames(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func findMalformedGames(conn PgxIface, guildID string) ([]*PostgresGame, error) {
+	games := []*PostgresGame{}
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT * FROM games WHERE guild_id = $1 AND end_time != -1 "+
+		"AND (end_time < start_time OR NOT EXISTS (SELECT 1 FROM users_games WHERE users_games.game_id = games.game_id)) "+
+		"ORDER BY start_time ASC, game_id ASC;", guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int64]bool, len(games))
+	foundIDs := make([]int64, 0, len(games))
+	for _, v := range games {
+		found[v.GameID] = true
+		foundIDs = append(foundIDs, v.GameID)
+	}
+
+	// payloads are only checked in Go, since they're parsed the same way StatsFromGameAndEvents parses them. A busy guild
+	// has far too many events to load at once, so they're streamed, skipping the games that were already found
+	rows, err := conn.Query(context.Background(), "SELECT game_events.game_id, game_events.event_type, game_events.payload "+
+		"FROM game_events "+
+		"INNER JOIN games ON games.game_id = game_events.game_id "+
+		"WHERE games.guild_id = $1 AND games.end_time != -1 AND NOT (games.game_id = ANY($2));", guildID, foundIDs)
+	if err != nil {
+		return nil, err
+	}
+	var badPayloads []int64
+	for rows.Next() {
+		var gameID int64
+		var eventType int16
+		var payload string
+		if err := rows.Scan(&gameID, &eventType, &payload); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !found[gameID] && !payloadParses(eventType, payload) {
+			found[gameID] = true
+			badPayloads = append(badPayloads, gameID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(badPayloads) == 0 {
+		return games, nil
+	}
+
+	var more []*PostgresGame
+	err = pgxscan.Select(context.Background(), conn, &more, "SELECT * FROM games WHERE game_id = ANY($1);", badPayloads)
+	if err != nil {
+		return nil, err
+	}
+	games = append(games, more...)
+	sort.Slice(games, func(i, j int) bool {
+		if games[i].StartTime != games[j].StartTime {
+			return games[i].StartTime < games[j].StartTime
+		}
+		return games[i].GameID < games[j].GameID
+	})
+	return games, nil
+}
+
+// payloadParses reports whether an event payload is in the format its event type should have. Payloads of event types
+// that aren't known are assumed to be fine
+func payloadParses(eventType int16, payload string) bool {
+	var err error
+	switch capture.EventType(eventType) {
+	case capture.State:
+		_, err = strconv.Atoi(payload)
+	case capture.Player:
+		err = json.Unmarshal([]byte(payload), &game.Player{})
+	case capture.GameOver:
+		err = json.Unmarshal([]byte(payload), &game.Gameover{})
+	case capture.Lobby:
+		err = json.Unmarshal([]byte(payload), &game.Lobby{})
+	}
+	return err == nil
+}
+
 func (psqlInterface *PsqlInterface) GetGamesEventsForGuild(guildID uint64) ([]*PostgresGameEvent, error) {
 	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Release()
-	return getGameEventsForGuild(conn.Conn(), guildID)
+	return getGameEventsForGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
 }
 
 func getGameEventsForGuild(conn PgxIface, guildID uint64) ([]*PostgresGameEvent, error) {
@@ -450,7 +836,7 @@ func (psqlInterface *PsqlInterface) GetUsersForGuild(guildID uint64) ([]*Postgre
 		return nil, err
 	}
 	defer conn.Release()
-	return getUsersForGuild(conn.Conn(), guildID)
+	return getUsersForGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
 }
 
 func getUsersForGuild(conn PgxIface, guildID uint64) ([]*PostgresUser, error) {
@@ -474,7 +860,7 @@ func (psqlInterface *PsqlInterface) GetUsersGamesForGuild(guildID uint64) ([]*Po
 	}
 	defer conn.Release()
 
-	return getUsersGamesForGuild(conn.Conn(), guildID)
+	return getUsersGamesForGuild(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
 }
 
 func getUsersGamesForGuild(conn PgxIface, guildID uint64) ([]*PostgresUserGame, error) {
@@ -489,6 +875,51 @@ func getUsersGamesForGuild(conn PgxIface, guildID uint64) ([]*PostgresUserGame,
 	return r, nil
 }
 
+// ExportUserData gathers the user's row, their users_games rows on every guild, and every event recorded for them.
+// Unlike the guild exports, this ignores the user's opt status, since it's their own data
+func (psqlInterface *PsqlInterface) ExportUserData(userID string) (*UserDataExport, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return exportUserData(psqlInterface.withQueryTimeout(conn.Conn()), userID)
+}
+
+func exportUserData(conn PgxIface, userID string) (*UserDataExport, error) {
+	uid, err := ParseSnowflake(userID)
+	if err != nil {
+		return nil, err
+	}
+	export := &UserDataExport{
+		UsersGames: []*PostgresUserGame{},
+		Events:     []*PostgresGameEvent{},
+	}
+
+	var users []*PostgresUser
+	err = pgxscan.Select(context.Background(), conn, &users, "SELECT * FROM users WHERE user_id = $1;", uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) > 0 {
+		export.User = users[0]
+	}
+
+	err = pgxscan.Select(context.Background(), conn, &export.UsersGames, "SELECT user_id,guild_id,game_id,player_name,player_color,player_role,player_won "+
+		"FROM users_games WHERE user_id = $1 ORDER BY guild_id, game_id;", uid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pgxscan.Select(context.Background(), conn, &export.Events, "SELECT * FROM game_events WHERE user_id = $1 ORDER BY game_id, event_time, event_id;", uid)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// AddInitialGame records a game as it starts, including the region it's hosted in, and returns its new ID. Needs:
+// ALTER TABLE games ADD COLUMN region SMALLINT;
 func (psqlInterface *PsqlInterface) AddInitialGame(game *PostgresGame) (uint64, error) {
 	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
@@ -496,15 +927,21 @@ func (psqlInterface *PsqlInterface) AddInitialGame(game *PostgresGame) (uint64,
 	}
 	defer conn.Release()
 
-	return insertGame(conn.Conn(), game)
+	id, err := insertGame(psqlInterface.withQueryTimeout(conn.Conn()), game)
+	if err == nil {
+		psqlInterface.counters.gameStarted()
+	}
+	return id, err
 }
 
 func (psqlInterface *PsqlInterface) AddEvent(event *PostgresGameEvent) error {
+	ctx, cancel := psqlInterface.execContext()
+	defer cancel()
 	if event.UserID == nil {
-		_, err := psqlInterface.Pool.Exec(context.Background(), "INSERT INTO game_events VALUES (DEFAULT, NULL, $1, $2, $3, $4);", event.GameID, event.EventTime, event.EventType, event.Payload)
+		_, err := psqlInterface.Pool.Exec(ctx, "INSERT INTO game_events VALUES (DEFAULT, NULL, $1, $2, $3, $4);", event.GameID, event.EventTime, event.EventType, event.Payload)
 		return err
 	}
-	_, err := psqlInterface.Pool.Exec(context.Background(), "INSERT INTO game_events VALUES (DEFAULT, $1, $2, $3, $4, $5);", event.UserID, event.GameID, event.EventTime, event.EventType, event.Payload)
+	_, err := psqlInterface.Pool.Exec(ctx, "INSERT INTO game_events VALUES (DEFAULT, $1, $2, $3, $4, $5);", event.UserID, event.GameID, event.EventTime, event.EventType, event.Payload)
 	return err
 }
 
@@ -516,21 +953,63 @@ func (psqlInterface *PsqlInterface) UpdateGameAndPlayers(gameID int64, winType i
 	}
 	defer conn.Release()
 
-	err = updateGame(conn.Conn(), gameID, winType, endTime)
+	err = updateGame(psqlInterface.withQueryTimeout(conn.Conn()), gameID, winType, endTime)
 	if err != nil {
 		return err
 	}
+	psqlInterface.counters.gameFinished()
 
 	for _, player := range players {
-		err := insertPlayer(conn.Conn(), player)
+		err := insertPlayer(psqlInterface.withQueryTimeout(conn.Conn()), player)
 		if err != nil {
-			log.Println(err)
+			psqlInterface.logError("UpdateGameAndPlayers", err, gameID, player.UserID)
 		}
 	}
 
 	return nil
 }
 
+var usersGamesColumns = []string{"user_id", "guild_id", "game_id", "player_name", "player_color", "player_role", "player_won"}
+
+// InsertUserGames bulk-loads users_games rows with COPY, for backfills and imports. The referenced users, guilds and
+// games must already exist. Every row is validated before anything is copied, so a bad row fails the whole batch
+func (psqlInterface *PsqlInterface) InsertUserGames(ctx context.Context, rows []*PostgresUserGame) error {
+	conn, err := psqlInterface.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return insertUserGames(ctx, psqlInterface.withQueryTimeout(conn.Conn()), rows)
+}
+
+func insertUserGames(ctx context.Context, conn PgxIface, rows []*PostgresUserGame) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	values := make([][]interface{}, len(rows))
+	for i, v := range rows {
+		switch {
+		case v == nil:
+			return fmt.Errorf("users_games row %d is nil", i)
+		case v.UserID == 0:
+			return fmt.Errorf("users_games row %d is missing user_id", i)
+		case v.GuildID == 0:
+			return fmt.Errorf("users_games row %d (user %d) is missing guild_id", i, v.UserID)
+		case v.GameID == 0:
+			return fmt.Errorf("users_games row %d (user %d) is missing game_id", i, v.UserID)
+		}
+		values[i] = []interface{}{v.UserID, v.GuildID, v.GameID, v.PlayerName, v.PlayerColor, v.PlayerRole, v.PlayerWon}
+	}
+	n, err := conn.CopyFrom(ctx, pgx.Identifier{"users_games"}, usersGamesColumns, pgx.CopyFromRows(values))
+	if err != nil {
+		return err
+	}
+	if n != int64(len(rows)) {
+		return fmt.Errorf("copied %d of %d users_games rows", n, len(rows))
+	}
+	return nil
+}
+
 func (psqlInterface *PsqlInterface) Close() {
 	psqlInterface.Pool.Close()
 }
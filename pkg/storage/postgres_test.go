@@ -1,9 +1,18 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/automuteus/utils/pkg/capture"
+	"github.com/automuteus/utils/pkg/game"
 	"github.com/automuteus/utils/pkg/premium"
 	"github.com/jackc/pgconn"
 	"github.com/pashagolub/pgxmock"
+	"log"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -109,6 +118,55 @@ func TestIsUserOrGuildPremium(t *testing.T) {
 	}
 }
 
+func TestEnsureUserExists_InsertError(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT \\* FROM users WHERE user_id = \\$1$").
+		WithArgs(UserIDInt).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "opt", "vote_time_unix"}))
+	mock.ExpectExec("^INSERT INTO users VALUES \\(\\$1, true, NULL\\)$").
+		WithArgs(UserIDInt).
+		WillReturnError(errors.New("connection reset"))
+
+	// the insert's error is returned, rather than the lookup's "no user found"
+	if _, err := ensureUserExists(mock, UserIDInt); err == nil || err.Error() != "connection reset" {
+		t.Errorf("expected the insert error to be returned, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestInsertGame(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	region := int16(game.EU)
+	pgame := &PostgresGame{GuildID: GuildIDInt, ConnectCode: "ABCDEF", StartTime: 1000, WinType: -1, EndTime: -1, Region: &region}
+	mock.ExpectQuery("^INSERT INTO games \\(guild_id, connect_code, start_time, win_type, end_time, region\\) "+
+		"VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6\\) RETURNING game_id;$").
+		WithArgs(GuildIDInt, "ABCDEF", int32(1000), int16(-1), int32(-1), &region).
+		WillReturnRows(pgxmock.NewRows([]string{"game_id"}).AddRow(uint64(7)))
+
+	id, err := insertGame(mock, pgame)
+	if err != nil {
+		t.Error(err)
+	}
+	if id != 7 {
+		t.Errorf("expected the new game ID 7, got %d", id)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestInsertUser(t *testing.T) {
 	mock, err := pgxmock.NewConn()
 	if err != nil {
@@ -221,3 +279,647 @@ func TestOptUser(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestGetGameByConnectCode(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	gameColumns := []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}
+
+	// game 1 (start 1000) and game 2 (start 2000) share a code; ordering by start_time DESC yields only game 2
+	mock.ExpectQuery("^SELECT (.+) FROM games WHERE guild_id = (.+) AND connect_code = (.+) ORDER BY start_time DESC LIMIT 1;$").
+		WithArgs(GuildID, "ABCDEF").
+		WillReturnRows(
+			pgxmock.NewRows(gameColumns).
+				AddRow(int64(2), GuildIDInt, "ABCDEF", int32(2000), int16(1), int32(2600)))
+
+	g, err := getGameByConnectCode(mock, GuildID, "ABCDEF")
+	if err != nil {
+		t.Error(err)
+	}
+	if g == nil {
+		t.Fatal("expected a game to be returned for the connect code")
+	}
+	if g.GameID != 2 || g.StartTime != 2000 {
+		t.Error("expected the newest game with the connect code to be returned")
+	}
+
+	// no game with that code should return nil, nil
+	mock.ExpectQuery("^SELECT (.+) FROM games WHERE guild_id = (.+) AND connect_code = (.+) ORDER BY start_time DESC LIMIT 1;$").
+		WithArgs(GuildID, "ZZZZZZ").
+		WillReturnRows(pgxmock.NewRows(gameColumns))
+
+	g, err = getGameByConnectCode(mock, GuildID, "ZZZZZZ")
+	if err != nil {
+		t.Error(err)
+	}
+	if g != nil {
+		t.Error("expected no game to be returned for an unused connect code")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGamesByDurationRangeOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	gameColumns := []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}
+	// games of 4, 5, 7, 10 and 12 minutes; only the middle three are in range
+	lengths := []int32{240, 300, 420, 600, 720}
+	rows := pgxmock.NewRows(gameColumns)
+	for i := len(lengths) - 1; i >= 0; i-- {
+		start := int32(1000 * (i + 1))
+		if lengths[i] >= 300 && lengths[i] <= 600 {
+			rows.AddRow(int64(i+1), GuildIDInt, "ABCDEF", start, int16(1), start+lengths[i])
+		}
+	}
+
+	mock.ExpectQuery("^SELECT (.+) FROM games WHERE guild_id = \\$1 AND end_time != -1 AND \\(end_time - start_time\\) BETWEEN \\$2 AND \\$3 ORDER BY start_time DESC, game_id DESC;$").
+		WithArgs(GuildID, int64(300), int64(600)).
+		WillReturnRows(rows)
+
+	games, err := gamesByDurationRangeOnServer(mock, GuildID, 5*time.Minute, 10*time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(games) != 3 {
+		t.Fatalf("expected 3 games in range, got %d", len(games))
+	}
+	for _, g := range games {
+		length := time.Duration(g.EndTime-g.StartTime) * time.Second
+		if length < 5*time.Minute || length > 10*time.Minute {
+			t.Errorf("game %d lasted %s, outside the requested range", g.GameID, length)
+		}
+	}
+
+	if _, err := gamesByDurationRangeOnServer(mock, GuildID, 10*time.Minute, 5*time.Minute); err == nil {
+		t.Error("expected an error when min is greater than max")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFindDuplicateGames(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	gameColumns := []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}
+	// games 1 and 2 were captured twice for the same lobby; game 3 reused the code later and isn't a duplicate
+	mock.ExpectQuery("^SELECT (.+) FROM games g WHERE g.guild_id = \\$1 AND EXISTS \\((.+) o.connect_code = g.connect_code AND o.game_id <> g.game_id (.+)\\) ORDER BY g.connect_code, g.start_time, g.game_id;$").
+		WithArgs(GuildID).
+		WillReturnRows(
+			pgxmock.NewRows(gameColumns).
+				AddRow(int64(1), GuildIDInt, "ABCDEF", int32(1000), int16(1), int32(1600)).
+				AddRow(int64(2), GuildIDInt, "ABCDEF", int32(1002), int16(1), int32(1601)))
+
+	games, err := findDuplicateGames(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(games) != 2 || games[0].GameID != 1 || games[1].GameID != 2 {
+		t.Fatal("expected the duplicate pair, oldest first")
+	}
+	if games[0].ConnectCode != games[1].ConnectCode {
+		t.Error("expected duplicates to share a connect code")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExportUserData(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	otherGuild := GuildIDInt + 1
+	uid := UserIDInt
+
+	mock.ExpectQuery("^SELECT \\* FROM users WHERE user_id = \\$1;$").
+		WithArgs(UserIDInt).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "opt", "vote_time_unix"}).AddRow(UserIDInt, true, nil))
+	mock.ExpectQuery("^SELECT user_id,guild_id,game_id,player_name,player_color,player_role,player_won FROM users_games WHERE user_id = \\$1 ORDER BY guild_id, game_id;$").
+		WithArgs(UserIDInt).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"user_id", "guild_id", "game_id", "player_name", "player_color", "player_role", "player_won"}).
+				AddRow(UserIDInt, GuildIDInt, int64(1), "Alice", int16(0), int16(0), true).
+				AddRow(UserIDInt, GuildIDInt, int64(2), "Alice", int16(1), int16(1), false).
+				AddRow(UserIDInt, otherGuild, int64(7), "Al", int16(3), int16(0), true))
+	mock.ExpectQuery("^SELECT \\* FROM game_events WHERE user_id = \\$1 ORDER BY game_id, event_time, event_id;$").
+		WithArgs(UserIDInt).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"event_id", "user_id", "game_id", "event_time", "event_type", "payload"}).
+				AddRow(uint64(10), &uid, int64(1), int32(1100), int16(1), `{"Action":2}`).
+				AddRow(uint64(70), &uid, int64(7), int32(7100), int16(1), `{"Action":6}`))
+
+	export, err := exportUserData(mock, UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.User == nil || export.User.UserID != UserIDInt {
+		t.Error("expected the user's row in the export")
+	}
+	if len(export.UsersGames) != 3 || len(export.Events) != 2 {
+		t.Fatalf("expected 3 users_games rows and 2 events, got %d and %d", len(export.UsersGames), len(export.Events))
+	}
+	guilds := map[uint64]bool{}
+	for _, v := range export.UsersGames {
+		if v.UserID != UserIDInt {
+			t.Errorf("expected only the user's own games, got a row for %d", v.UserID)
+		}
+		guilds[v.GuildID] = true
+	}
+	if !guilds[GuildIDInt] || !guilds[otherGuild] {
+		t.Error("expected games from both guilds in the export")
+	}
+	for _, v := range export.Events {
+		if v.UserID == nil || *v.UserID != UserIDInt {
+			t.Error("expected only the user's own events")
+		}
+	}
+	if !strings.Contains(export.ToCSV(), fmt.Sprintf("%d,%d,7,Al,", UserIDInt, otherGuild)) {
+		t.Error("expected the CSV export to include the other guild's game")
+	}
+
+	if _, err := exportUserData(mock, "not-an-id"); err == nil {
+		t.Error("expected an error for an invalid user ID")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDuoImposterGames(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	gameColumns := []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}
+	partner := fmt.Sprintf("%d", UserIDInt+1)
+	// in game 1 both were imposters; in game 2 only the partner was, so it isn't returned
+	mock.ExpectQuery("^SELECT games.\\* FROM games INNER JOIN users_games a (.+) INNER JOIN users_games b (.+) WHERE games.guild_id = \\$3 AND games.end_time != -1 ORDER BY games.start_time DESC, games.game_id DESC;$").
+		WithArgs(UserID, partner, GuildID, int16(game.ImposterRole)).
+		WillReturnRows(
+			pgxmock.NewRows(gameColumns).
+				AddRow(int64(1), GuildIDInt, "ABCDEF", int32(1000), int16(game.ImpostorByKill), int32(1600)))
+
+	games, err := duoImposterGames(mock, UserID, partner, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(games) != 1 || games[0].GameID != 1 {
+		t.Error("expected only the game the pair were imposters in together")
+	}
+
+	if _, err := duoImposterGames(mock, UserID, UserID, GuildID); err == nil {
+		t.Error("expected an error for the same user twice")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdjacentUserGames(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	gameColumns := []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}
+	games := [][]interface{}{
+		{int64(1), GuildIDInt, "ABCDEF", int32(1000), int16(game.ImpostorByKill), int32(1600)},
+		{int64(2), GuildIDInt, "ABCDEF", int32(2000), int16(game.HumansByTask), int32(2600)},
+		{int64(3), GuildIDInt, "ABCDEF", int32(3000), int16(game.HumansByVote), int32(3600)},
+	}
+	// navigating from the middle game finds one on either side
+	mock.ExpectQuery("^SELECT games.\\* FROM games INNER JOIN users_games (.+) AND \\(games.start_time, games.game_id\\) < (.+) ORDER BY games.start_time DESC, games.game_id DESC LIMIT 1;$").
+		WithArgs(UserID, GuildID, int64(2)).
+		WillReturnRows(pgxmock.NewRows(gameColumns).AddRow(games[0]...))
+	mock.ExpectQuery("^SELECT games.\\* FROM games INNER JOIN users_games (.+) AND \\(games.start_time, games.game_id\\) > (.+) ORDER BY games.start_time ASC, games.game_id ASC LIMIT 1;$").
+		WithArgs(UserID, GuildID, int64(2)).
+		WillReturnRows(pgxmock.NewRows(gameColumns).AddRow(games[2]...))
+
+	prev, next, err := adjacentUserGames(mock, UserID, GuildID, 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if prev == nil || prev.GameID != 1 || next == nil || next.GameID != 3 {
+		t.Errorf("expected games 1 and 3 either side of game 2, got %v and %v", prev, next)
+	}
+
+	// the newest game has nothing after it
+	mock.ExpectQuery("^SELECT games.\\* FROM games (.+) < (.+)").
+		WithArgs(UserID, GuildID, int64(3)).
+		WillReturnRows(pgxmock.NewRows(gameColumns).AddRow(games[1]...))
+	mock.ExpectQuery("^SELECT games.\\* FROM games (.+) > (.+)").
+		WithArgs(UserID, GuildID, int64(3)).
+		WillReturnRows(pgxmock.NewRows(gameColumns))
+
+	prev, next, err = adjacentUserGames(mock, UserID, GuildID, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if prev == nil || prev.GameID != 2 || next != nil {
+		t.Error("expected only a previous game for the newest game")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFindMalformedGames(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	gameColumns := []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}
+	// game 1 is clean, game 2 has a truncated player payload, and game 3 has no players (so its events aren't read)
+	mock.ExpectQuery("^SELECT \\* FROM games WHERE guild_id = \\$1 AND end_time != -1 AND \\(end_time < start_time OR NOT EXISTS (.+)\\) ORDER BY start_time ASC, game_id ASC;$").
+		WithArgs(GuildID).
+		WillReturnRows(pgxmock.NewRows(gameColumns).
+			AddRow(int64(3), GuildIDInt, "ABCDEF", int32(3000), int16(game.HumansByTask), int32(3600)))
+	mock.ExpectQuery("^SELECT game_events.game_id, game_events.event_type, game_events.payload FROM game_events "+
+		"INNER JOIN games ON games.game_id = game_events.game_id "+
+		"WHERE games.guild_id = \\$1 AND games.end_time != -1 AND NOT \\(games.game_id = ANY\\(\\$2\\)\\);$").
+		WithArgs(GuildID, []int64{3}).
+		WillReturnRows(pgxmock.NewRows([]string{"game_id", "event_type", "payload"}).
+			AddRow(int64(1), int16(capture.State), TasksCode).
+			AddRow(int64(1), int16(capture.Player), `{"Action":2,"Name":"Alice","Color":0}`).
+			AddRow(int64(2), int16(capture.State), TasksCode).
+			AddRow(int64(2), int16(capture.Player), `{"Action":2,"Na`).
+			AddRow(int64(2), int16(capture.Player), `{"Action":2,"Na`))
+	mock.ExpectQuery("^SELECT \\* FROM games WHERE game_id = ANY\\(\\$1\\);$").
+		WithArgs([]int64{2}).
+		WillReturnRows(pgxmock.NewRows(gameColumns).
+			AddRow(int64(2), GuildIDInt, "ABCDEF", int32(2000), int16(game.ImpostorByKill), int32(2600)))
+
+	games, err := findMalformedGames(mock, GuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 || games[0].GameID != 2 || games[1].GameID != 3 {
+		ids := make([]int64, len(games))
+		for i, v := range games {
+			ids[i] = v.GameID
+		}
+		t.Errorf("expected games 2 and 3, oldest first, got %v", ids)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestConnectCodesOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// ABCDEF was used twice, most recently after GHIJKL
+	type played struct {
+		code  string
+		start int64
+	}
+	games := []played{{"ABCDEF", 1000}, {"GHIJKL", 2000}, {"ABCDEF", 3000}, {"MNOPQR", 500}}
+	latest := make(map[string]int64)
+	for _, g := range games {
+		if g.start > latest[g.code] {
+			latest[g.code] = g.start
+		}
+	}
+	expected := make([]string, 0, len(latest))
+	for code := range latest {
+		expected = append(expected, code)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return latest[expected[i]] > latest[expected[j]]
+	})
+	rows := pgxmock.NewRows([]string{"connect_code"})
+	for _, code := range expected {
+		rows.AddRow(code)
+	}
+	mock.ExpectQuery("^SELECT connect_code FROM games WHERE guild_id = \\$1 GROUP BY connect_code ORDER BY MAX\\(start_time\\) DESC, connect_code ASC LIMIT \\$2;$").
+		WithArgs(GuildID, 10).
+		WillReturnRows(rows)
+
+	codes, err := connectCodesOnServer(mock, GuildID, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(codes) != 3 || codes[0] != "ABCDEF" || codes[1] != "GHIJKL" || codes[2] != "MNOPQR" {
+		t.Errorf("expected each code once, most recently used first, got %v", codes)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFastestTaskWinsOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	type played struct {
+		id      int64
+		result  game.GameResult
+		seconds int32
+	}
+	// the 3 minute game was a sabotage, so it doesn't count
+	games := []played{{1, game.HumansByTask, 900}, {2, game.ImpostorBySabotage, 180}, {3, game.HumansByTask, 420}, {4, game.HumansByTask, 600}}
+	var taskWins []played
+	for _, v := range games {
+		if v.result == game.HumansByTask {
+			taskWins = append(taskWins, v)
+		}
+	}
+	sort.Slice(taskWins, func(i, j int) bool {
+		return taskWins[i].seconds < taskWins[j].seconds
+	})
+	rows := pgxmock.NewRows([]string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"})
+	for _, v := range taskWins[:2] {
+		rows.AddRow(v.id, GuildIDInt, "ABCDEF", int32(1000), int16(v.result), 1000+v.seconds)
+	}
+
+	mock.ExpectQuery("^SELECT \\* FROM games WHERE guild_id = \\$1 AND win_type = \\$2 AND end_time != -1 ORDER BY \\(end_time - start_time\\) ASC, start_time ASC, game_id ASC LIMIT \\$3;$").
+		WithArgs(GuildID, int16(game.HumansByTask), 2).
+		WillReturnRows(rows)
+
+	r, err := fastestTaskWinsOnServer(mock, GuildID, 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 || r[0].GameID != 3 || r[1].GameID != 4 {
+		t.Fatal("expected the two fastest task wins, fastest first")
+	}
+	for _, v := range r {
+		if game.GameResult(v.WinType) != game.HumansByTask {
+			t.Errorf("expected only task wins, got game %d", v.GameID)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRecentGamesForServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	gameColumns := []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}
+
+	mock.ExpectQuery("^SELECT (.+) FROM games WHERE guild_id = (.+) AND end_time != -1 ORDER BY start_time DESC, game_id DESC LIMIT (.+) OFFSET (.+);$").
+		WithArgs(GuildID, 2, 0).
+		WillReturnRows(
+			pgxmock.NewRows(gameColumns).
+				AddRow(int64(3), GuildIDInt, "CCCCCC", int32(3000), int16(1), int32(3600)).
+				AddRow(int64(2), GuildIDInt, "BBBBBB", int32(2000), int16(2), int32(2600)))
+
+	page, err := recentGamesForServer(mock, GuildID, 2, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(page) != 2 || page[0].GameID != 3 || page[1].GameID != 2 {
+		t.Error("expected the first page to contain the 2 newest games, newest first")
+	}
+
+	mock.ExpectQuery("^SELECT (.+) FROM games WHERE guild_id = (.+) AND end_time != -1 ORDER BY start_time DESC, game_id DESC LIMIT (.+) OFFSET (.+);$").
+		WithArgs(GuildID, 2, 2).
+		WillReturnRows(
+			pgxmock.NewRows(gameColumns).
+				AddRow(int64(1), GuildIDInt, "AAAAAA", int32(1000), int16(0), int32(1600)))
+
+	page, err = recentGamesForServer(mock, GuildID, 2, 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(page) != 1 || page[0].GameID != 1 {
+		t.Error("expected the second page to contain only the oldest game")
+	}
+
+	mock.ExpectQuery("^SELECT (.+) FROM games WHERE guild_id = (.+) AND end_time != -1 ORDER BY start_time DESC, game_id DESC LIMIT (.+) OFFSET (.+);$").
+		WithArgs(GuildID, 2, 4).
+		WillReturnRows(pgxmock.NewRows(gameColumns))
+
+	page, err = recentGamesForServer(mock, GuildID, 2, 4)
+	if err != nil {
+		t.Error(err)
+	}
+	if page == nil || len(page) != 0 {
+		t.Error("expected an empty, non-nil page when the offset is past the end")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPsqlInterface_logError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	psql := PsqlInterface{Logger: log.New(buf, "", 0)}
+
+	psql.logError("TotalWinRankingForServer", errors.New("connection refused"), GuildIDInt)
+
+	output := buf.String()
+	if !strings.Contains(output, "TotalWinRankingForServer") {
+		t.Error("expected the method name to appear in the log output: " + output)
+	}
+	if !strings.Contains(output, GuildID) {
+		t.Error("expected the method arguments to appear in the log output: " + output)
+	}
+	if !strings.Contains(output, "connection refused") {
+		t.Error("expected the error to appear in the log output: " + output)
+	}
+}
+
+func TestInsertUserGames(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	rows := []*PostgresUserGame{
+		{UserID: UserIDInt, GuildID: GuildIDInt, GameID: 1, PlayerName: "red guy", PlayerColor: 0, PlayerRole: 0, PlayerWon: true},
+		{UserID: UserIDInt, GuildID: GuildIDInt, GameID: 2, PlayerName: "red guy", PlayerColor: 0, PlayerRole: 1, PlayerWon: false},
+		{UserID: UserIDInt + 1, GuildID: GuildIDInt, GameID: 2, PlayerName: "blue guy", PlayerColor: 1, PlayerRole: 0, PlayerWon: true},
+	}
+	mock.ExpectCopyFrom(`"users_games"`, usersGamesColumns).WillReturnResult(int64(len(rows)))
+	readBack := pgxmock.NewRows(usersGamesColumns)
+	for _, v := range rows {
+		readBack.AddRow(v.UserID, v.GuildID, v.GameID, v.PlayerName, v.PlayerColor, v.PlayerRole, v.PlayerWon)
+	}
+	mock.ExpectQuery("^SELECT DISTINCT users_games.user_id,guild_id,game_id,player_name,player_color,player_role,player_won FROM users_games (.+)").
+		WithArgs(GuildIDInt).
+		WillReturnRows(readBack)
+
+	if err := insertUserGames(context.Background(), mock, rows); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := getUsersGamesForGuild(mock, GuildIDInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(rows) {
+		t.Fatalf("expected %d rows read back, got %d", len(rows), len(loaded))
+	}
+	for i, v := range rows {
+		if *loaded[i] != *v {
+			t.Errorf("row %d: expected %+v, got %+v", i, *v, *loaded[i])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestInsertUserGames_Invalid(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// no COPY is expected; validation should reject the batch before touching the database
+	rows := []*PostgresUserGame{
+		{UserID: UserIDInt, GuildID: GuildIDInt, GameID: 1},
+		{UserID: UserIDInt, GameID: 1},
+	}
+	err = insertUserGames(context.Background(), mock, rows)
+	if err == nil || !strings.Contains(err.Error(), "row 1") || !strings.Contains(err.Error(), "guild_id") {
+		t.Errorf("expected a descriptive error for the row missing guild_id, got %v", err)
+	}
+	if err := insertUserGames(context.Background(), mock, []*PostgresUserGame{nil}); err == nil {
+		t.Error("expected an error for a nil row")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetGameRoster(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT \\* FROM users_games WHERE game_id = \\$1 ORDER BY player_role ASC, player_name ASC, user_id ASC;$").
+		WithArgs(int64(7)).
+		WillReturnRows(
+			pgxmock.NewRows(usersGamesColumns).
+				AddRow(UserIDInt+2, GuildIDInt, int64(7), "alice", int16(1), int16(0), true).
+				AddRow(UserIDInt, GuildIDInt, int64(7), "bob", int16(0), int16(0), true).
+				AddRow(UserIDInt+1, GuildIDInt, int64(7), "carol", int16(2), int16(1), false))
+
+	roster, err := getGameRoster(mock, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roster) != 3 {
+		t.Fatalf("expected all 3 players in the roster, got %d", len(roster))
+	}
+	names := []string{roster[0].PlayerName, roster[1].PlayerName, roster[2].PlayerName}
+	if strings.Join(names, ",") != "alice,bob,carol" || roster[2].PlayerRole != int16(1) {
+		t.Errorf("expected crewmates by name followed by the imposter, got %v", names)
+	}
+
+	mock.ExpectQuery("^SELECT \\* FROM users_games WHERE game_id = \\$1 (.+)$").
+		WithArgs(int64(8)).
+		WillReturnRows(pgxmock.NewRows(usersGamesColumns))
+
+	roster, err = getGameRoster(mock, 8)
+	if err != nil {
+		t.Error(err)
+	}
+	if roster == nil || len(roster) != 0 {
+		t.Error("expected an empty, non-nil roster for an unknown game")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGameEventsPaged(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	eventColumns := []string{"event_id", "user_id", "game_id", "event_time", "event_type", "payload"}
+	// two events share event_time 30, straddling what would be the page boundary
+	events := []*PostgresGameEvent{
+		{EventID: 1, GameID: 7, EventTime: 10, EventType: 1, Payload: "1"},
+		{EventID: 2, GameID: 7, EventTime: 20, EventType: 1, Payload: "2"},
+		{EventID: 3, GameID: 7, EventTime: 30, EventType: 1, Payload: "1"},
+		{EventID: 4, GameID: 7, EventTime: 30, EventType: 1, Payload: "2"},
+		{EventID: 5, GameID: 7, EventTime: 40, EventType: 1, Payload: "1"},
+	}
+	page := func(after int32, n int) *pgxmock.Rows {
+		rows := pgxmock.NewRows(eventColumns)
+		for _, v := range events {
+			if v.EventTime > after && n > 0 {
+				rows.AddRow(v.EventID, v.UserID, v.GameID, v.EventTime, v.EventType, v.Payload)
+				n--
+			}
+		}
+		return rows
+	}
+	query := "^SELECT \\* FROM game_events WHERE game_id = \\$1 AND event_time > \\$2 ORDER BY event_time ASC, event_id ASC LIMIT \\$3;$"
+	mock.ExpectQuery(query).WithArgs(int64(7), int64(0), 4).WillReturnRows(page(0, 4))
+	mock.ExpectQuery(query).WithArgs(int64(7), int64(20), 4).WillReturnRows(page(20, 4))
+
+	first, err := gameEventsPaged(mock, 7, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || first[0].EventID != 1 || first[1].EventID != 2 {
+		t.Fatalf("expected the first page to stop before the split second, got %d events", len(first))
+	}
+
+	second, err := gameEventsPaged(mock, 7, int64(first[len(first)-1].EventTime), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 3 || second[0].EventID != 3 || second[1].EventID != 4 || second[2].EventID != 5 {
+		t.Fatalf("expected the second page to hold the remaining 3 events, got %d", len(second))
+	}
+
+	if _, err := gameEventsPaged(mock, 7, 0, 0); err == nil {
+		t.Error("expected an error for a non-positive limit")
+	}
+
+	// both events at event_time 30 can't fit in a page of 1, and returning just one would skip the other
+	mock.ExpectQuery(query).WithArgs(int64(7), int64(20), 2).WillReturnRows(page(20, 2))
+	if r, err := gameEventsPaged(mock, 7, 20, 1); err == nil {
+		t.Errorf("expected an error when one second has more events than the limit, got %d events", len(r))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
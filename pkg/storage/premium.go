@@ -4,9 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/automuteus/utils/pkg/premium"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"log"
-	"strconv"
 	"time"
 )
 
@@ -71,7 +69,7 @@ func (psqlInterface *PsqlInterface) TransferPremium(origin, dest string) error {
 		return err
 	}
 	defer conn.Release()
-	originGuild, destGuild, err := getOriginAndDestGuilds(conn.Conn(), origin, dest)
+	originGuild, destGuild, err := getOriginAndDestGuilds(psqlInterface.withQueryTimeout(conn.Conn()), origin, dest)
 	if err != nil {
 		return err
 	}
@@ -81,11 +79,11 @@ func (psqlInterface *PsqlInterface) TransferPremium(origin, dest string) error {
 		return err
 	}
 
-	err = setGuildInheritsFrom(conn, dest, origin)
+	err = setGuildInheritsFrom(psqlInterface.withQueryTimeout(conn.Conn()), dest, origin)
 	if err != nil {
 		return err
 	}
-	err = setGuildTransferredTo(conn, origin, dest)
+	err = setGuildTransferredTo(psqlInterface.withQueryTimeout(conn.Conn()), origin, dest)
 	if err != nil {
 		return err
 	}
@@ -109,7 +107,7 @@ func (psqlInterface *PsqlInterface) RevertPremiumTransfer(original, transferred
 		return err
 	}
 	defer conn.Release()
-	return revertPremiumTransfer(conn.Conn(), original, transferred)
+	return revertPremiumTransfer(psqlInterface.withQueryTimeout(conn.Conn()), original, transferred)
 }
 
 func revertPremiumTransfer(conn PgxIface, original, transferred string) error {
@@ -159,7 +157,7 @@ func (psqlInterface *PsqlInterface) AddGoldSubServer(origin, dest string) error
 		return err
 	}
 	defer conn.Release()
-	originGuild, destGuild, err := getOriginAndDestGuilds(conn.Conn(), origin, dest)
+	originGuild, destGuild, err := getOriginAndDestGuilds(psqlInterface.withQueryTimeout(conn.Conn()), origin, dest)
 	if err != nil {
 		return err
 	}
@@ -172,7 +170,7 @@ func (psqlInterface *PsqlInterface) AddGoldSubServer(origin, dest string) error
 		return err
 	}
 
-	err = setGuildInheritsFrom(conn, dest, origin)
+	err = setGuildInheritsFrom(psqlInterface.withQueryTimeout(conn.Conn()), dest, origin)
 	if err != nil {
 		return err
 	}
@@ -180,11 +178,11 @@ func (psqlInterface *PsqlInterface) AddGoldSubServer(origin, dest string) error
 }
 
 func getOriginAndDestGuilds(conn PgxIface, origin, dest string) (*PostgresGuild, *PostgresGuild, error) {
-	originID, err := strconv.ParseUint(origin, 10, 64)
+	originID, err := ParseSnowflake(origin)
 	if err != nil {
 		return nil, nil, err
 	}
-	destID, err := strconv.ParseUint(dest, 10, 64)
+	destID, err := ParseSnowflake(dest)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -199,7 +197,7 @@ func getOriginAndDestGuilds(conn PgxIface, origin, dest string) (*PostgresGuild,
 	return originGuild, destGuild, nil
 }
 
-func setGuildTransferredTo(conn *pgxpool.Conn, guildID, transferTo string) error {
+func setGuildTransferredTo(conn PgxIface, guildID, transferTo string) error {
 	_, err := conn.Exec(context.Background(), "UPDATE guilds SET transferred_to = $2 WHERE guild_id = $1;", guildID, transferTo)
 	if err != nil {
 		return err
@@ -217,7 +215,7 @@ func setGuildTransferredNull(conn PgxIface, guildID string) error {
 	return nil
 }
 
-func setGuildInheritsFrom(conn *pgxpool.Conn, guildID, inheritsFrom string) error {
+func setGuildInheritsFrom(conn PgxIface, guildID, inheritsFrom string) error {
 	_, err := conn.Exec(context.Background(), "UPDATE guilds SET inherits_from = $2 WHERE guild_id = $1;", guildID, inheritsFrom)
 	if err != nil {
 		return err
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/jackc/pgconn"
 	"github.com/pashagolub/pgxmock"
 	"testing"
@@ -120,7 +121,9 @@ func TestCanRevertTransfer(t *testing.T) {
 }
 
 func TestCanRevertTransferMock(t *testing.T) {
-	origin, dest := uint64(123), uint64(321)
+	// real snowflakes, since IDs from before the Discord epoch are rejected
+	origin, dest := GuildIDInt, GuildIDInt+1
+	originID, destID := fmt.Sprintf("%d", origin), fmt.Sprintf("%d", dest)
 	mock, err := pgxmock.NewConn()
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
@@ -138,7 +141,7 @@ func TestCanRevertTransferMock(t *testing.T) {
 			pgxmock.NewRows([]string{"guild_id", "guild_name", "premium", "tx_time_unix", "transferred_to", "inherits_from"}).
 				AddRow(dest, "transferred", int16(0), &now, nil, nil))
 
-	err = revertPremiumTransfer(mock, "123", "321")
+	err = revertPremiumTransfer(mock, originID, destID)
 	if err == nil {
 		t.Error("should not be capable of transferring non-linked servers")
 	}
@@ -157,7 +160,7 @@ func TestCanRevertTransferMock(t *testing.T) {
 			pgxmock.NewRows([]string{"guild_id", "guild_name", "premium", "tx_time_unix", "transferred_to", "inherits_from"}).
 				AddRow(dest, "transferred", int16(0), &now, &origin, nil))
 
-	err = revertPremiumTransfer(mock, "123", "321")
+	err = revertPremiumTransfer(mock, originID, destID)
 	if err == nil {
 		t.Error("should not be capable of transferring non-linked servers")
 	}
@@ -174,7 +177,7 @@ func TestCanRevertTransferMock(t *testing.T) {
 			pgxmock.NewRows([]string{"guild_id", "guild_name", "premium", "tx_time_unix", "transferred_to", "inherits_from"}).
 				AddRow(dest, "transferred", int16(0), &now, &wrongOrigin, nil))
 
-	err = revertPremiumTransfer(mock, "123", "321")
+	err = revertPremiumTransfer(mock, originID, destID)
 	if err == nil {
 		t.Error("should not be capable of transferring non-linked servers")
 	}
@@ -193,14 +196,14 @@ func TestCanRevertTransferMock(t *testing.T) {
 
 	// correct case; expect inherits and transferred to be wiped from both servers
 	mock.ExpectExec("^UPDATE guilds SET inherits_from = NULL WHERE guild_id = (.+)$").
-		WithArgs("321").
+		WithArgs(destID).
 		WillReturnResult(pgconn.CommandTag{})
 
 	mock.ExpectExec("^UPDATE guilds SET transferred_to = NULL WHERE guild_id = (.+)$").
-		WithArgs("123").
+		WithArgs(originID).
 		WillReturnResult(pgconn.CommandTag{})
 
-	err = revertPremiumTransfer(mock, "123", "321")
+	err = revertPremiumTransfer(mock, originID, destID)
 	if err != nil {
 		t.Error(err)
 	}
@@ -209,3 +212,29 @@ func TestCanRevertTransferMock(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestSetGuildTransferredToAndInheritsFrom(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	destID := fmt.Sprintf("%d", GuildIDInt+1)
+
+	mock.ExpectExec("^UPDATE guilds SET inherits_from = \\$2 WHERE guild_id = \\$1;$").
+		WithArgs(destID, GuildID).
+		WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^UPDATE guilds SET transferred_to = \\$2 WHERE guild_id = \\$1;$").
+		WithArgs(GuildID, destID).
+		WillReturnResult(pgconn.CommandTag{})
+
+	if err := setGuildInheritsFrom(mock, destID, GuildID); err != nil {
+		t.Error(err)
+	}
+	if err := setGuildTransferredTo(mock, GuildID, destID); err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/automuteus/utils/pkg/game"
+	"github.com/automuteus/utils/pkg/settings"
+	"github.com/bwmarrin/discordgo"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+// WinStreakEmbedField returns the "on fire" field for a user's current win streak, or nil if the guild has streaks
+// disabled or the streak is below the guild's threshold
+func WinStreakEmbedField(streak int64, sett *settings.GuildSettings) *discordgo.MessageEmbedField {
+	if !sett.GetShowWinStreaks() || streak < int64(sett.GetWinStreakThreshold()) {
+		return nil
+	}
+	return &discordgo.MessageEmbedField{
+		Name: "🔥 " + sett.LocalizeMessage(&i18n.Message{
+			ID:    "responses.userProfileEmbed.OnFire",
+			Other: "On Fire",
+		}),
+		Value: sett.LocalizeMessage(&i18n.Message{
+			ID:    "responses.userProfileEmbed.WinStreak",
+			Other: "{{.Streak}}-game win streak",
+		}, map[string]interface{}{
+			"Streak": streak,
+		}),
+		Inline: false,
+	}
+}
+
+// FullUserStats is everything shown on a user's profile embed, gathered from the individual stats queries (NumWins,
+// ColorRankingForPlayerOnServer, UserMostFrequentKilledBy, etc.)
+type FullUserStats struct {
+	UserID        string
+	GamesPlayed   int64
+	Wins          int64
+	CrewmateGames int64
+	CrewmateWins  int64
+	ImposterGames int64
+	ImposterWins  int64
+	WinStreak     int64
+	// FavoriteColor is the user's most played color, or nil if they haven't played any games
+	FavoriteColor *Int16ModeCount
+	// Nemesis is the imposter who has killed the user most often, or nil if they've never been killed
+	Nemesis *PostgresUserMostFrequentKilledByanking
+}
+
+func percentOf(n, total int64) float64 {
+	if total < 1 {
+		return 0
+	}
+	return float64(n) / float64(total) * 100
+}
+
+// BuildUserProfileEmbed renders a user's overall stats on a guild, as opposed to the single match of ToDiscordEmbed
+func BuildUserProfileEmbed(stats *FullUserStats, sett *settings.GuildSettings) *discordgo.MessageEmbed {
+	fields := []*discordgo.MessageEmbedField{
+		{
+			Name: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.userProfileEmbed.GamesPlayed",
+				Other: "Games Played",
+			}),
+			Value:  fmt.Sprintf("%d", stats.GamesPlayed),
+			Inline: true,
+		},
+		{
+			Name: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.userProfileEmbed.WinRate",
+				Other: "Win Rate",
+			}),
+			Value:  fmt.Sprintf("%.0f%% (%d/%d)", percentOf(stats.Wins, stats.GamesPlayed), stats.Wins, stats.GamesPlayed),
+			Inline: true,
+		},
+	}
+
+	if stats.FavoriteColor != nil {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.userProfileEmbed.FavoriteColor",
+				Other: "Favorite Color",
+			}),
+			Value:  fmt.Sprintf("%s (%d)", game.GetColorStringForInt(int(stats.FavoriteColor.Mode)), stats.FavoriteColor.Count),
+			Inline: true,
+		})
+	}
+
+	fields = append(fields,
+		&discordgo.MessageEmbedField{
+			Name: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.userProfileEmbed.CrewmateWinRate",
+				Other: "Crewmate Win Rate",
+			}),
+			Value:  fmt.Sprintf("%.0f%% (%d/%d)", percentOf(stats.CrewmateWins, stats.CrewmateGames), stats.CrewmateWins, stats.CrewmateGames),
+			Inline: true,
+		},
+		&discordgo.MessageEmbedField{
+			Name: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.userProfileEmbed.ImposterWinRate",
+				Other: "Imposter Win Rate",
+			}),
+			Value:  fmt.Sprintf("%.0f%% (%d/%d)", percentOf(stats.ImposterWins, stats.ImposterGames), stats.ImposterWins, stats.ImposterGames),
+			Inline: true,
+		},
+	)
+
+	if stats.Nemesis != nil {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.userProfileEmbed.Nemesis",
+				Other: "Nemesis",
+			}),
+			Value: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.userProfileEmbed.NemesisValue",
+				Other: "<@{{.UserID}}> ({{.Deaths}} kills)",
+			}, map[string]interface{}{
+				"UserID": stats.Nemesis.TeammateID,
+				"Deaths": stats.Nemesis.TotalDeath,
+			}),
+			Inline: false,
+		})
+	}
+
+	if streak := WinStreakEmbedField(stats.WinStreak, sett); streak != nil {
+		fields = append(fields, streak)
+	}
+
+	return &discordgo.MessageEmbed{
+		Title: sett.LocalizeMessage(&i18n.Message{
+			ID:    "responses.userProfileEmbed.Title",
+			Other: "Player Stats",
+		}),
+		Description: "<@" + stats.UserID + ">",
+		Color:       10181046, // PURPLE
+		Fields:      fields,
+	}
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"github.com/automuteus/utils/pkg/game"
+	"github.com/automuteus/utils/pkg/settings"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWinStreakEmbedField(t *testing.T) {
+	sett := settings.MakeGuildSettings()
+	sett.SetWinStreakThreshold(3)
+
+	if WinStreakEmbedField(5, sett) != nil {
+		t.Error("expected no streak badge while the guild setting is disabled")
+	}
+
+	sett.SetShowWinStreaks(true)
+	if WinStreakEmbedField(2, sett) != nil {
+		t.Error("expected no streak badge below the threshold")
+	}
+	for _, streak := range []int64{3, 7} {
+		field := WinStreakEmbedField(streak, sett)
+		if field == nil {
+			t.Fatalf("expected a streak badge for a %d-game streak", streak)
+		}
+		if !strings.HasPrefix(field.Name, "🔥") {
+			t.Errorf("expected the field name to carry the 🔥 badge, got %q", field.Name)
+		}
+		if !strings.Contains(field.Value, "-game win streak") || !strings.HasPrefix(field.Value, strconv.FormatInt(streak, 10)) {
+			t.Errorf("expected the streak length in the field value, got %q", field.Value)
+		}
+	}
+}
+
+func TestBuildUserProfileEmbed(t *testing.T) {
+	sett := settings.MakeGuildSettings()
+	sett.SetShowWinStreaks(true)
+	stats := &FullUserStats{
+		UserID:        UserID,
+		GamesPlayed:   20,
+		Wins:          11,
+		CrewmateGames: 16,
+		CrewmateWins:  8,
+		ImposterGames: 4,
+		ImposterWins:  3,
+		WinStreak:     4,
+		FavoriteColor: &Int16ModeCount{Count: 12, Mode: game.Cyan},
+		Nemesis:       &PostgresUserMostFrequentKilledByanking{UserID: UserIDInt, TeammateID: 345345345345345345, TotalDeath: 5},
+	}
+
+	embed := BuildUserProfileEmbed(stats, sett)
+	if !strings.Contains(embed.Description, UserID) {
+		t.Error("expected the embed to mention the user")
+	}
+	values := make(map[string]string)
+	for _, f := range embed.Fields {
+		values[f.Name] = f.Value
+	}
+	expected := map[string]string{
+		"Games Played":      "20",
+		"Win Rate":          "55% (11/20)",
+		"Favorite Color":    "cyan (12)",
+		"Crewmate Win Rate": "50% (8/16)",
+		"Imposter Win Rate": "75% (3/4)",
+		"Nemesis":           "<@345345345345345345> (5 kills)",
+		"🔥 On Fire":         "4-game win streak",
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected field %q to be %q, got %q", name, value, values[name])
+		}
+	}
+
+	// a brand-new player has no favorite color or nemesis, and no win rate to divide by
+	embed = BuildUserProfileEmbed(&FullUserStats{UserID: UserID}, sett)
+	for _, f := range embed.Fields {
+		if f.Name == "Favorite Color" || f.Name == "Nemesis" || strings.HasPrefix(f.Name, "🔥") {
+			t.Errorf("expected no %q field for a player without games", f.Name)
+		}
+		if f.Name == "Win Rate" && f.Value != "0% (0/0)" {
+			t.Errorf("expected a 0%% win rate for a player without games, got %q", f.Value)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/automuteus/utils/pkg/discord"
+	"strconv"
+)
+
+// ParseSnowflake parses a Discord user or guild ID, rejecting anything discord.ValidateSnowflake does (empty,
+// non-numeric, out-of-range, or prior to the Discord epoch) so a bad ID fails loudly instead of silently querying for
+// ID 0
+func ParseSnowflake(s string) (uint64, error) {
+	if err := discord.ValidateSnowflake(s); err != nil {
+		return 0, fmt.Errorf("invalid snowflake %q: %w", s, err)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestParseSnowflake(t *testing.T) {
+	id, err := ParseSnowflake(GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if id != GuildIDInt {
+		t.Errorf("expected %d, got %d", GuildIDInt, id)
+	}
+
+	// 1420070399999 is the last millisecond before the Discord epoch, so no snowflake can be that small
+	for _, bad := range []string{"", "abc", "12a3", "-1", "0", "1420070399999", "18446744073709551616"} {
+		if _, err := ParseSnowflake(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+
+	// the largest value that fits in a uint64 is still a valid ID
+	if _, err := ParseSnowflake("18446744073709551615"); err != nil {
+		t.Error(err)
+	}
+}
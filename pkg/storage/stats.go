@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/automuteus/utils/pkg/capture"
 	"github.com/automuteus/utils/pkg/game"
@@ -11,8 +12,10 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
-	"log"
+	"math"
+	"sort"
 	"strconv"
+	"text/template"
 	"time"
 )
 
@@ -26,6 +29,7 @@ const (
 	Discuss
 	PlayerDeath
 	PlayerDisconnect
+	MeetingSkipped
 )
 
 type SimpleEvent struct {
@@ -34,6 +38,11 @@ type SimpleEvent struct {
 	Data            string
 }
 
+// isPhaseEvent reports whether the event marks a change of game phase, rather than something happening to a player
+func (e SimpleEvent) isPhaseEvent() bool {
+	return e.EventType == Tasks || e.EventType == Discuss || e.EventType == MeetingSkipped
+}
+
 type GameStatistics struct {
 	GameDuration time.Duration
 	WinType      game.GameResult
@@ -42,7 +51,36 @@ type GameStatistics struct {
 	NumDeaths      int
 	NumVotedOff    int
 	NumDisconnects int
-	Events         []SimpleEvent
+	// NumPlayers is the number of distinct player names seen in the game's events, since users_games only has rows for
+	// linked players. It's 0 if no player events were recorded
+	NumPlayers int
+	Events     []SimpleEvent
+
+	// HasFirstKill is false when nobody was killed, in which case FirstKillOffset is meaningless
+	HasFirstKill    bool
+	FirstKillOffset time.Duration
+	LastEventOffset time.Duration
+
+	// EndTime is the zero time if the game hasn't finished (or wasn't provided)
+	EndTime time.Time
+
+	// PayloadErrors are from player events whose payload couldn't be read, which are left out of the statistics
+	PayloadErrors []error
+}
+
+// formatMinutesSeconds renders a game offset as MM:SS (minutes aren't capped at 59)
+func formatMinutesSeconds(d time.Duration) string {
+	secs := int64(d / time.Second)
+	return fmt.Sprintf("%02d:%02d", secs/60, secs%60)
+}
+
+// NumKilled is the number of deaths that weren't exiles. Exiles are normally also recorded as deaths, but this never
+// goes negative if they weren't (or if a game's events are incomplete)
+func (stats *GameStatistics) NumKilled() int {
+	if stats.NumDeaths < stats.NumVotedOff {
+		return 0
+	}
+	return stats.NumDeaths - stats.NumVotedOff
 }
 
 func (stats *GameStatistics) ToString() string {
@@ -59,10 +97,13 @@ func (stats *GameStatistics) ToString() string {
 			player := game.Player{}
 			err := json.Unmarshal([]byte(v.Data), &player)
 			if err != nil {
-				log.Println(err)
+				// still show the death, just without a name
+				buf.WriteString(fmt.Sprintf("%s into the game, a player died", v.EventTimeOffset.String()))
 			} else {
 				buf.WriteString(fmt.Sprintf("%s into the game, %s died", v.EventTimeOffset.String(), player.Name))
 			}
+		case v.EventType == MeetingSkipped:
+			buf.WriteString(fmt.Sprintf("%s into the game, no one was ejected", v.EventTimeOffset.String()))
 		}
 		buf.WriteRune('\n')
 	}
@@ -70,8 +111,46 @@ func (stats *GameStatistics) ToString() string {
 	return buf.String()
 }
 
+// FormatCounts renders the meeting, death, exile and kill counts as a localized line, with each count pluralized by
+// the language's rules (so "1 kill" but "2 kills")
+func (stats *GameStatistics) FormatCounts(sett *settings.GuildSettings) string {
+	plural := func(msg *i18n.Message, count int) string {
+		return sett.LocalizeMessage(msg, map[string]interface{}{"Count": count}, count)
+	}
+	return sett.LocalizeMessage(&i18n.Message{
+		ID:    "responses.matchStats.Counts",
+		Other: "{{.Meetings}}, {{.Deaths}} ({{.VotedOff}}, {{.Killed}})",
+	}, map[string]interface{}{
+		"Meetings": plural(&i18n.Message{
+			ID:    "responses.matchStats.Meetings",
+			One:   "{{.Count}} meeting",
+			Other: "{{.Count}} meetings",
+		}, stats.NumMeetings),
+		"Deaths": plural(&i18n.Message{
+			ID:    "responses.matchStats.Deaths",
+			One:   "{{.Count}} death",
+			Other: "{{.Count}} deaths",
+		}, stats.NumDeaths),
+		"VotedOff": plural(&i18n.Message{
+			ID:    "responses.matchStats.VotedOff",
+			One:   "{{.Count}} voted off",
+			Other: "{{.Count}} voted off",
+		}, stats.NumVotedOff),
+		"Killed": plural(&i18n.Message{
+			ID:    "responses.matchStats.Kills",
+			One:   "{{.Count}} kill",
+			Other: "{{.Count}} kills",
+		}, stats.NumKilled()),
+	})
+}
+
 // TODO localize
 func (stats *GameStatistics) FormatDurationAndWin() string {
+	return stats.formatDurationAndWin(fmt.Sprintf("There were %d meetings, %d deaths, and of those deaths, %d were from being voted off and %d were kills",
+		stats.NumMeetings, stats.NumDeaths, stats.NumVotedOff, stats.NumKilled()))
+}
+
+func (stats *GameStatistics) formatDurationAndWin(counts string) string {
 	buf := bytes.NewBuffer([]byte{})
 	winner := ""
 	switch stats.WinType {
@@ -89,16 +168,93 @@ func (stats *GameStatistics) FormatDurationAndWin() string {
 		winner = "Imposters won by voting off the last Human"
 	case game.ImpostorByKill:
 		winner = "Imposters won by killing the last Human"
+	case game.Draw:
+		winner = "nobody won"
 	}
 	buf.WriteString("This display is VERY UNFINISHED and will be refined as time goes on!\n\n")
 
 	buf.WriteString(fmt.Sprintf("Game lasted %s and %s\n", stats.GameDuration.String(), winner))
-	buf.WriteString(fmt.Sprintf("There were %d meetings, %d deaths, and of those deaths, %d were from being voted off\n",
-		stats.NumMeetings, stats.NumDeaths, stats.NumVotedOff))
+	if stats.NumPlayers > 0 {
+		buf.WriteString(fmt.Sprintf("%d players took part\n", stats.NumPlayers))
+	}
+	buf.WriteString(counts + "\n")
 	buf.WriteString("Game Events:\n")
 	return buf.String()
 }
 
+var winTypeMessages = map[game.GameResult]*i18n.Message{
+	game.HumansByTask:       {ID: "responses.matchStatsPlain.HumansByTask", Other: "Crewmates won by completing tasks"},
+	game.HumansByVote:       {ID: "responses.matchStatsPlain.HumansByVote", Other: "Crewmates won by voting off the last Imposter"},
+	game.HumansDisconnect:   {ID: "responses.matchStatsPlain.HumansDisconnect", Other: "Crewmates won because the last Imposter disconnected"},
+	game.ImpostorDisconnect: {ID: "responses.matchStatsPlain.ImpostorDisconnect", Other: "Imposters won because the last Human disconnected"},
+	game.ImpostorBySabotage: {ID: "responses.matchStatsPlain.ImpostorBySabotage", Other: "Imposters won by sabotage"},
+	game.ImpostorByVote:     {ID: "responses.matchStatsPlain.ImpostorByVote", Other: "Imposters won by voting off the last Human"},
+	game.ImpostorByKill:     {ID: "responses.matchStatsPlain.ImpostorByKill", Other: "Imposters won by killing the last Human"},
+	game.Draw:               {ID: "responses.matchStatsPlain.Draw", Other: "Nobody won"},
+}
+
+// FormatGameStatsPlain renders the same localized summary and timeline as ToDiscordEmbed, but as plain text without
+// markdown or emoji, for sinks other than Discord (webhooks, logs, web pages)
+func (stats *GameStatistics) FormatGameStatsPlain(sett *settings.GuildSettings) string {
+	buf := bytes.NewBuffer([]byte{})
+
+	buf.WriteString(sett.LocalizeMessage(&i18n.Message{
+		ID:    "responses.matchStatsPlain.Duration",
+		Other: "Game lasted {{.Duration}}",
+	}, map[string]interface{}{
+		"Duration": stats.GameDuration.String(),
+	}))
+	if msg, ok := winTypeMessages[stats.WinType]; ok {
+		buf.WriteString(". " + sett.LocalizeMessage(msg))
+	}
+	buf.WriteRune('\n')
+	buf.WriteString(stats.FormatCounts(sett))
+	buf.WriteRune('\n')
+
+	for _, v := range stats.Events {
+		line := ""
+		switch v.EventType {
+		case Tasks:
+			line = sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.matchStatsPlain.TasksBegin",
+				Other: "Task phase began",
+			})
+		case Discuss:
+			line = sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.matchStatsPlain.DiscussBegin",
+				Other: "Discussion began",
+			})
+		case MeetingSkipped:
+			line = sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.matchStatsEmbed.MeetingSkipped",
+				Other: "No one was ejected",
+			})
+		case PlayerDeath:
+			player := game.Player{}
+			if !sett.GetShowPlayerNames() || json.Unmarshal([]byte(v.Data), &player) != nil {
+				line = sett.LocalizeMessage(&i18n.Message{
+					ID:    "responses.matchStatsEmbed.PlayerDied",
+					Other: "A player died",
+				})
+			} else {
+				line = sett.LocalizeMessage(&i18n.Message{
+					ID:    "responses.matchStatsPlain.PlayerDied",
+					Other: "{{.Name}} died",
+				}, map[string]interface{}{
+					"Name": player.Name,
+				})
+			}
+		default:
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%s: %s\n", v.EventTimeOffset.String(), line))
+	}
+
+	return buf.String()
+}
+
+// ToDiscordEmbed renders the match timeline. Player names are replaced with generic text when the guild has
+// ShowPlayerNames turned off, and phase changes are left out when it has SignificantEventsOnly turned on
 func (stats *GameStatistics) ToDiscordEmbed(combinedID string, sett *settings.GuildSettings) *discordgo.MessageEmbed {
 	title := sett.LocalizeMessage(&i18n.Message{
 		ID:    "responses.matchStatsEmbed.Title",
@@ -109,10 +265,40 @@ func (stats *GameStatistics) ToDiscordEmbed(combinedID string, sett *settings.Gu
 
 	fields := make([]*discordgo.MessageEmbedField, 0)
 
+	if sett.GetRelativeMatchTimes() && !stats.EndTime.IsZero() {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name: "\u200B",
+			Value: "🕒 " + sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.matchStatsEmbed.Times",
+				Other: "Started {{.Start}}, ended {{.End}}",
+			}, map[string]interface{}{
+				"Start": relativeTimestamp(stats.EndTime.Add(-stats.GameDuration)),
+				"End":   relativeTimestamp(stats.EndTime),
+			}),
+			Inline: false,
+		})
+	}
+
+	if stats.HasFirstKill {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name: "\u200B",
+			Value: "🩸 " + sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.matchStatsEmbed.FirstBlood",
+				Other: "First blood at {{.Time}}",
+			}, map[string]interface{}{
+				"Time": formatMinutesSeconds(stats.FirstKillOffset),
+			}),
+			Inline: false,
+		})
+	}
+
 	fieldsOnLine := 0
 	// TODO collapse by meeting/tasks "blocks" of data
 	// TODO localize
 	for _, v := range stats.Events {
+		if sett.GetSignificantEventsOnly() && v.isPhaseEvent() {
+			continue
+		}
 		switch {
 		case v.EventType == Tasks:
 			fields = append(fields, &discordgo.MessageEmbedField{
@@ -130,17 +316,41 @@ func (stats *GameStatistics) ToDiscordEmbed(combinedID string, sett *settings.Gu
 			fieldsOnLine++
 		case v.EventType == PlayerDeath:
 			player := game.Player{}
-			err := json.Unmarshal([]byte(v.Data), &player)
-			if err != nil {
-				log.Println(err)
-			} else {
+			named := sett.GetShowPlayerNames()
+			if named {
+				if err := json.Unmarshal([]byte(v.Data), &player); err != nil {
+					// still show the death, just without a name
+					named = false
+				}
+			}
+			if !named {
 				fields = append(fields, &discordgo.MessageEmbedField{
-					Name:   v.EventTimeOffset.String(),
-					Value:  fmt.Sprintf("☠️ \"%s\" Died", player.Name),
+					Name: v.EventTimeOffset.String(),
+					Value: "☠️ " + sett.LocalizeMessage(&i18n.Message{
+						ID:    "responses.matchStatsEmbed.PlayerDied",
+						Other: "A player died",
+					}),
 					Inline: false,
 				})
+				fieldsOnLine = 0
+				break
 			}
+			fields = append(fields, &discordgo.MessageEmbedField{
+				Name:   v.EventTimeOffset.String(),
+				Value:  fmt.Sprintf("☠️ \"%s\" Died", player.Name),
+				Inline: false,
+			})
 			fieldsOnLine = 0
+		case v.EventType == MeetingSkipped:
+			fields = append(fields, &discordgo.MessageEmbedField{
+				Name: v.EventTimeOffset.String(),
+				Value: "🤐 " + sett.LocalizeMessage(&i18n.Message{
+					ID:    "responses.matchStatsEmbed.MeetingSkipped",
+					Other: "No one was ejected",
+				}),
+				Inline: true,
+			})
+			fieldsOnLine++
 		}
 		if fieldsOnLine == 2 {
 			fields = append(fields, &discordgo.MessageEmbedField{
@@ -151,14 +361,38 @@ func (stats *GameStatistics) ToDiscordEmbed(combinedID string, sett *settings.Gu
 		}
 	}
 
+	description := stats.formatDurationAndWin(stats.FormatCounts(sett))
+	if sett.GetCompactMatchEmbed() {
+		description, fields = compactEmbedDescription(description, fields), nil
+	}
+
+	var footer *discordgo.MessageEmbedFooter
+	timestamp := ""
+	if sett.GetShowMatchFooter() {
+		footer = &discordgo.MessageEmbedFooter{
+			Text: sett.LocalizeMessage(&i18n.Message{
+				ID:    "responses.matchStatsEmbed.Footer",
+				Other: "Match {{.MatchID}} • AutoMuteUs",
+			}, map[string]interface{}{
+				"MatchID": combinedID,
+			}),
+		}
+		if !stats.EndTime.IsZero() {
+			timestamp = stats.EndTime.UTC().Format(time.RFC3339)
+		}
+	}
+
+	// SetMatchURLTemplate rejects templates that can't be expanded, so one that fails here just leaves the summary unlinked
+	url, _ := matchURL(sett.GetMatchURLTemplate(), combinedID)
+
 	msg := discordgo.MessageEmbed{
-		URL:         "",
+		URL:         url,
 		Type:        "",
 		Title:       title,
-		Description: stats.FormatDurationAndWin(),
-		Timestamp:   "",
+		Description: description,
+		Timestamp:   timestamp,
 		Color:       10181046, // PURPLE
-		Footer:      nil,
+		Footer:      footer,
 		Image:       nil,
 		Thumbnail:   nil,
 		Video:       nil,
@@ -169,6 +403,54 @@ func (stats *GameStatistics) ToDiscordEmbed(combinedID string, sett *settings.Gu
 	return &msg
 }
 
+// relativeTimestamp formats t as a Discord timestamp that renders relative to now, like "2 hours ago"
+func relativeTimestamp(t time.Time) string {
+	return fmt.Sprintf("<t:%d:R>", t.Unix())
+}
+
+// matchURL expands the guild's match page URL template for the given match, or returns "" if there's no template
+func matchURL(tmpl, matchID string) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+	t, err := template.New("matchURL").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.NewBuffer([]byte{})
+	err = t.Execute(buf, map[string]interface{}{
+		"MatchID": matchID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// maxEmbedDescription is Discord's limit on the length of an embed description
+const maxEmbedDescription = 4096
+
+// compactEmbedDescription appends the embed fields to the description as one line each (dropping the blank spacer
+// fields), truncating the result to what Discord accepts
+func compactEmbedDescription(description string, fields []*discordgo.MessageEmbedField) string {
+	buf := bytes.NewBufferString(description)
+	for _, f := range fields {
+		if f.Name == "\u200B" && f.Value == "\u200B" {
+			continue
+		}
+		if f.Name == "\u200B" {
+			buf.WriteString(f.Value + "\n")
+		} else {
+			buf.WriteString(f.Name + " " + f.Value + "\n")
+		}
+	}
+	r := []rune(buf.String())
+	if len(r) > maxEmbedDescription {
+		return string(r[:maxEmbedDescription-1]) + "…"
+	}
+	return string(r)
+}
+
 func StatsFromGameAndEvents(pgame *PostgresGame, events []*PostgresGameEvent) GameStatistics {
 	stats := GameStatistics{
 		GameDuration: 0,
@@ -181,37 +463,75 @@ func StatsFromGameAndEvents(pgame *PostgresGame, events []*PostgresGameEvent) Ga
 	if pgame != nil {
 		stats.GameDuration = time.Second * time.Duration(pgame.EndTime-pgame.StartTime)
 		stats.WinType = game.GameResult(pgame.WinType)
+		if pgame.EndTime != -1 {
+			stats.EndTime = time.Unix(int64(pgame.EndTime), 0)
+		}
 	}
 
 	if len(events) < 2 {
 		return stats
 	}
 
+	// exiles are recorded as deaths too, so those DIED events aren't kills and can't be first blood
+	exiled := exiledPlayerNames(events)
+
+	// a meeting that goes back to tasks without anyone being exiled was skipped (or tied)
+	inMeeting := false
+	exiledThisMeeting := false
+	players := make(map[string]struct{})
+
 	for _, v := range events {
-		if v.EventType == int16(capture.State) {
+		eventType, ok := capture.EventTypeFromInt16(v.EventType)
+		if !ok {
+			// nothing we know how to summarize (newer capture versions, or a bad row)
+			continue
+		}
+		offset := time.Second * time.Duration(v.EventTime-pgame.StartTime)
+		if offset > stats.LastEventOffset {
+			stats.LastEventOffset = offset
+		}
+		switch eventType {
+		case capture.State:
 			if v.Payload == DiscussCode {
 				stats.NumMeetings++
+				inMeeting = true
+				exiledThisMeeting = false
 				stats.Events = append(stats.Events, SimpleEvent{
 					EventType:       Discuss,
 					EventTimeOffset: time.Second * time.Duration(v.EventTime-pgame.StartTime),
 					Data:            "",
 				})
 			} else if v.Payload == TasksCode {
+				if inMeeting && !exiledThisMeeting {
+					stats.Events = append(stats.Events, SimpleEvent{
+						EventType:       MeetingSkipped,
+						EventTimeOffset: time.Second * time.Duration(v.EventTime-pgame.StartTime),
+						Data:            "",
+					})
+				}
+				inMeeting = false
 				stats.Events = append(stats.Events, SimpleEvent{
 					EventType:       Tasks,
 					EventTimeOffset: time.Second * time.Duration(v.EventTime-pgame.StartTime),
 					Data:            "",
 				})
 			}
-		} else if v.EventType == int16(capture.Player) {
+		case capture.Player:
 			player := game.Player{}
 			err := json.Unmarshal([]byte(v.Payload), &player)
 			if err != nil {
-				log.Println(err)
+				stats.PayloadErrors = append(stats.PayloadErrors, err)
 			} else {
+				if player.Name != "" {
+					players[player.Name] = struct{}{}
+				}
 				switch {
 				case player.Action == game.DIED:
 					stats.NumDeaths++
+					if !exiled[player.Name] && (!stats.HasFirstKill || offset < stats.FirstKillOffset) {
+						stats.HasFirstKill = true
+						stats.FirstKillOffset = offset
+					}
 					stats.Events = append(stats.Events, SimpleEvent{
 						EventType:       PlayerDeath,
 						EventTimeOffset: time.Second * time.Duration(v.EventTime-pgame.StartTime),
@@ -219,6 +539,7 @@ func StatsFromGameAndEvents(pgame *PostgresGame, events []*PostgresGameEvent) Ga
 					})
 				case player.Action == game.EXILED:
 					stats.NumVotedOff++
+					exiledThisMeeting = true
 				case player.Action == game.DISCONNECTED:
 					stats.NumDisconnects++
 				}
@@ -226,121 +547,1494 @@ func StatsFromGameAndEvents(pgame *PostgresGame, events []*PostgresGameEvent) Ga
 		}
 	}
 
-	return stats
+	stats.NumPlayers = len(players)
+	return stats
+}
+
+// RecomputeGameStats re-derives a game's statistics from its stored game row and events with StatsFromGameAndEvents,
+// for backfilling numbers that were computed by older versions
+func (psqlInterface *PsqlInterface) RecomputeGameStats(gameID int64) (*GameStatistics, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return recomputeGameStats(psqlInterface.withQueryTimeout(conn.Conn()), gameID)
+}
+
+func recomputeGameStats(conn PgxIface, gameID int64) (*GameStatistics, error) {
+	var games []*PostgresGame
+	err := pgxscan.Select(context.Background(), conn, &games, "SELECT * FROM games WHERE game_id = $1;", gameID)
+	if err != nil {
+		return nil, err
+	}
+	if len(games) == 0 {
+		return nil, fmt.Errorf("no game found with ID %d", gameID)
+	}
+
+	var events []*PostgresGameEvent
+	err = pgxscan.Select(context.Background(), conn, &events, "SELECT * FROM game_events WHERE game_id = $1 ORDER BY event_time ASC, event_id ASC;", gameID)
+	if err != nil {
+		return nil, err
+	}
+	stats := StatsFromGameAndEvents(games[0], events)
+	return &stats, nil
+}
+
+// AverageKillsPerGameOnServer returns the average number of kills (deaths that weren't exiles, as in
+// GameStatistics.NumKilled) per finished game on the guild, or 0 if it has none
+func (psqlInterface *PsqlInterface) AverageKillsPerGameOnServer(guildID string) (float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return averageKillsPerGameOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func averageKillsPerGameOnServer(conn PgxIface, guildID string) (float64, error) {
+	var r float64
+	// a game's exiles are subtracted from its deaths, never going below 0, just like GameStatistics.NumKilled
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COALESCE(AVG(GREATEST(died - exiled, 0)), 0) FROM ("+
+		"SELECT COUNT(ge.event_id) FILTER ( WHERE ge.payload ->> 'Action' = $3 ) AS died, "+
+		"COUNT(ge.event_id) FILTER ( WHERE ge.payload ->> 'Action' = $4 ) AS exiled "+
+		"FROM games "+
+		"LEFT JOIN game_events ge ON ge.game_id = games.game_id AND ge.event_type = $2 "+
+		"WHERE games.guild_id = $1 AND games.end_time != -1 "+
+		"GROUP BY games.game_id"+
+		") per_game;", guildID, int16(capture.Player), strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)))
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// TotalGamesPlayed counts every finished game across all guilds
+func (psqlInterface *PsqlInterface) TotalGamesPlayed() (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return totalGamesPlayed(psqlInterface.withQueryTimeout(conn.Conn()))
+}
+
+func totalGamesPlayed(conn PgxIface) (int64, error) {
+	var r int64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) FROM games WHERE end_time != -1;")
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// StorageMetrics are totals across all guilds for exporting as gauges. The metric tag is the gauge name, and help its
+// description
+type StorageMetrics struct {
+	TotalGames                 int64   `db:"total_games" metric:"automuteus_games_total" help:"Finished games across all guilds"`
+	RecentGames                int64   `db:"recent_games" metric:"automuteus_games_last_24h" help:"Finished games that started in the last 24 hours"`
+	TotalUsers                 int64   `db:"total_users" metric:"automuteus_users_total" help:"Users that have been recorded in any game"`
+	AverageGameDurationSeconds float64 `db:"average_game_duration" metric:"automuteus_game_duration_average_seconds" help:"Average length of a finished game"`
+}
+
+// CollectMetrics gathers StorageMetrics in a single query
+func (psqlInterface *PsqlInterface) CollectMetrics() (*StorageMetrics, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return collectMetrics(psqlInterface.withQueryTimeout(conn.Conn()), time.Now())
+}
+
+func collectMetrics(conn PgxIface, now time.Time) (*StorageMetrics, error) {
+	var r StorageMetrics
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT "+
+		"(SELECT COUNT(*) FROM games WHERE end_time != -1) AS total_games, "+
+		"(SELECT COUNT(*) FROM games WHERE end_time != -1 AND start_time >= $1) AS recent_games, "+
+		"(SELECT COUNT(*) FROM users) AS total_users, "+
+		"(SELECT COALESCE(AVG(end_time - start_time), 0)::float FROM games WHERE end_time != -1) AS average_game_duration;",
+		now.Add(-24*time.Hour).Unix())
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (psqlInterface *PsqlInterface) NumGamesPlayedOnGuild(guildID string) int64 {
+	gid, err := ParseSnowflake(guildID)
+	if err != nil {
+		psqlInterface.logError("NumGamesPlayedOnGuild", err, guildID)
+		return -1
+	}
+	r, err := numGamesPlayedOnGuild(psqlInterface.querier(), gid, false)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+// NumGamesPlayedOnGuildExcludingDraws is NumGamesPlayedOnGuild without the games that ended in a game.Draw
+func (psqlInterface *PsqlInterface) NumGamesPlayedOnGuildExcludingDraws(guildID string) int64 {
+	gid, err := ParseSnowflake(guildID)
+	if err != nil {
+		psqlInterface.logError("NumGamesPlayedOnGuildExcludingDraws", err, guildID)
+		return -1
+	}
+	r, err := numGamesPlayedOnGuild(psqlInterface.querier(), gid, true)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+func numGamesPlayedOnGuild(conn pgxscan.Querier, guildID uint64, excludeDraws bool) (int64, error) {
+	var r int64
+	var err error
+	if excludeDraws {
+		err = pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND end_time != -1 AND win_type != $2;",
+			guildID, int16(game.Draw))
+	} else {
+		err = pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND end_time != -1;", guildID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// NumGamesOnServerSince counts the guild's finished games that started at or after since. The filter is on
+// (guild_id, start_time) only, so it's served by an index on those columns
+func (psqlInterface *PsqlInterface) NumGamesOnServerSince(guildID string, since time.Time) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return numGamesOnServerSince(psqlInterface.withQueryTimeout(conn.Conn()), guildID, since)
+}
+
+func numGamesOnServerSince(conn PgxIface, guildID string, since time.Time) (int64, error) {
+	var r int64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND start_time >= $2 AND end_time != -1;", guildID, since.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// MostActiveDayOnServer returns the calendar date (midnight, in a zone tzOffsetMinutes east of UTC) on which the guild
+// started the most finished games, and how many. The earliest date wins a tie. With no games, the zero time and 0 are
+// returned
+func (psqlInterface *PsqlInterface) MostActiveDayOnServer(guildID string, tzOffsetMinutes int) (time.Time, int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	defer conn.Release()
+	return mostActiveDayOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, tzOffsetMinutes)
+}
+
+func mostActiveDayOnServer(conn PgxIface, guildID string, tzOffsetMinutes int) (time.Time, int64, error) {
+	var r []*Int64ModeCount
+	// shift start_time into local time, then bucket it into whole days since the epoch
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT COUNT(*) AS count, "+
+		"FLOOR((start_time + $2 * 60) / 86400.0)::bigint AS mode "+
+		"FROM games WHERE guild_id=$1 AND end_time != -1 "+
+		"GROUP BY mode "+
+		"ORDER BY count DESC, mode ASC "+
+		"LIMIT 1;", guildID, tzOffsetMinutes)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if len(r) == 0 {
+		return time.Time{}, 0, nil
+	}
+	day := time.Unix(r[0].Mode*86400, 0).UTC()
+	loc := time.FixedZone("", tzOffsetMinutes*60)
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc), r[0].Count, nil
+}
+
+// ServerGameTimeRange returns the start times of the guild's first and most recent finished games, or zero times if it
+// has none
+func (psqlInterface *PsqlInterface) ServerGameTimeRange(guildID string) (first, last time.Time, err error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	defer conn.Release()
+	return serverGameTimeRange(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func serverGameTimeRange(conn PgxIface, guildID string) (first, last time.Time, err error) {
+	var r struct {
+		First *int64 `db:"first"`
+		Last  *int64 `db:"last"`
+	}
+	err = pgxscan.Get(context.Background(), conn, &r, "SELECT MIN(start_time)::bigint AS first, MAX(start_time)::bigint AS last "+
+		"FROM games WHERE guild_id=$1 AND end_time != -1;", guildID)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	// MIN and MAX are NULL when there are no games
+	if r.First == nil || r.Last == nil {
+		return time.Time{}, time.Time{}, nil
+	}
+	return time.Unix(*r.First, 0), time.Unix(*r.Last, 0), nil
+}
+
+// DurationHistogramOnServer counts the guild's finished games by length. buckets are the ascending boundaries between
+// bins, so the result has len(buckets)+1 counts: games shorter than buckets[0], then games at least buckets[i-1] but
+// shorter than buckets[i], and finally games at least as long as the last boundary
+func (psqlInterface *PsqlInterface) DurationHistogramOnServer(guildID string, buckets []time.Duration) ([]int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return durationHistogramOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, buckets)
+}
+
+func durationHistogramOnServer(conn PgxIface, guildID string, buckets []time.Duration) ([]int64, error) {
+	if len(buckets) == 0 {
+		return nil, errors.New("at least one bucket boundary is required")
+	}
+	bounds := make([]int64, len(buckets))
+	for i, v := range buckets {
+		if i > 0 && v <= buckets[i-1] {
+			return nil, fmt.Errorf("bucket boundaries must be ascending, but %s follows %s", v, buckets[i-1])
+		}
+		bounds[i] = int64(v / time.Second)
+	}
+
+	var rows []*Int64ModeCount
+	// width_bucket returns how many of the boundaries are <= the game's length, which is exactly the bin index
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT COUNT(*) AS count, "+
+		"width_bucket((end_time - start_time)::bigint, $2::bigint[])::bigint AS mode "+
+		"FROM games WHERE guild_id=$1 AND end_time != -1 "+
+		"GROUP BY mode;", guildID, bounds)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]int64, len(buckets)+1)
+	for _, v := range rows {
+		if v.Mode >= 0 && v.Mode < int64(len(r)) {
+			r[v.Mode] = v.Count
+		}
+	}
+	return r, nil
+}
+
+// GamesPerRegionOnServer counts the guild's finished games by the region they were hosted in. Games without a recorded
+// region are left out
+func (psqlInterface *PsqlInterface) GamesPerRegionOnServer(guildID string) (map[game.Region]int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return gamesPerRegionOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func gamesPerRegionOnServer(conn PgxIface, guildID string) (map[game.Region]int64, error) {
+	var rows []*Int16ModeCount
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT COUNT(*) AS count, region AS mode "+
+		"FROM games "+
+		"WHERE guild_id = $1 AND end_time != -1 AND region IS NOT NULL "+
+		"GROUP BY region;", guildID)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[game.Region]int64, len(rows))
+	for _, v := range rows {
+		r[game.Region(v.Mode)] = v.Count
+	}
+	return r, nil
+}
+
+// AveragePlayersPerGameOnServer returns the average number of recorded players across the guild's finished games, or 0
+// if there aren't any
+func (psqlInterface *PsqlInterface) AveragePlayersPerGameOnServer(guildID string) (float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return averagePlayersPerGameOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func averagePlayersPerGameOnServer(conn PgxIface, guildID string) (float64, error) {
+	var r float64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COALESCE(AVG(players), 0) FROM ("+
+		"SELECT COUNT(*) AS players "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE games.guild_id = $1 AND games.end_time != -1 "+
+		"GROUP BY users_games.game_id"+
+		") per_game;", guildID)
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// ModePlayerCountOnServer returns the most common number of recorded players across the guild's finished games (the
+// smallest, if there's a tie), or 0 if there are none
+func (psqlInterface *PsqlInterface) ModePlayerCountOnServer(guildID string) (int, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return modePlayerCountOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func modePlayerCountOnServer(conn PgxIface, guildID string) (int, error) {
+	var r int64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COALESCE(mode() WITHIN GROUP (ORDER BY players), 0) FROM ("+
+		"SELECT COUNT(*) AS players "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE games.guild_id = $1 AND games.end_time != -1 "+
+		"GROUP BY users_games.game_id"+
+		") per_game;", guildID)
+	if err != nil {
+		return 0, err
+	}
+	return int(r), nil
+}
+
+// AverageMeetingsBeforeEndOnServer returns the average number of meetings called per finished game on the guild, or 0 if
+// it has none. Like GameStatistics.NumMeetings it counts Discuss phase changes, but only those up to the game's end, and
+// games without any meetings count as 0 rather than being left out
+func (psqlInterface *PsqlInterface) AverageMeetingsBeforeEndOnServer(guildID string) (float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return averageMeetingsBeforeEndOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func averageMeetingsBeforeEndOnServer(conn PgxIface, guildID string) (float64, error) {
+	var r float64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COALESCE(AVG(meetings), 0) FROM ("+
+		"SELECT COUNT(ge.event_id) AS meetings "+
+		"FROM games "+
+		"LEFT JOIN game_events ge ON ge.game_id = games.game_id AND ge.event_type = $2 AND ge.payload #>> '{}' = $3 "+
+		"AND ge.event_time <= games.end_time "+
+		"WHERE games.guild_id = $1 AND games.end_time != -1 "+
+		"GROUP BY games.game_id"+
+		") per_game;", guildID, int16(capture.State), DiscussCode)
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+type closeGamePlayer struct {
+	GameID     int64  `db:"game_id"`
+	UserID     uint64 `db:"user_id"`
+	PlayerRole int16  `db:"player_role"`
+	WinType    int16  `db:"win_type"`
+}
+
+type closeGameRemoval struct {
+	GameID int64  `db:"game_id"`
+	UserID uint64 `db:"user_id"`
+}
+
+// NumCloseGamesOnServer counts the guild's "nail-biter" games. The heuristic: for finished games decided by removing
+// players (HumansByVote, ImpostorByKill, ImpostorByVote), find the final removal (the last player to die or be exiled,
+// counting an exile's DIED and EXILED events once). If
+// exactly one player of the losing team (imposters for HumansByVote, crewmates otherwise) had not already been removed
+// before that event, the game is close. Only players linked to a Discord user are tracked, so games with unlinked
+// players are approximated from the linked ones
+func (psqlInterface *PsqlInterface) NumCloseGamesOnServer(guildID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return numCloseGamesOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func numCloseGamesOnServer(conn PgxIface, guildID string) (int64, error) {
+	var players []*closeGamePlayer
+	err := pgxscan.Select(context.Background(), conn, &players, "SELECT users_games.game_id, users_games.user_id, users_games.player_role, games.win_type "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE games.guild_id = $1 AND games.end_time != -1 AND games.win_type IN ($2, $3, $4);",
+		guildID, int16(game.HumansByVote), int16(game.ImpostorByKill), int16(game.ImpostorByVote))
+	if err != nil {
+		return 0, err
+	}
+	var removals []*closeGameRemoval
+	err = pgxscan.Select(context.Background(), conn, &removals, "SELECT ge.game_id, ge.user_id "+
+		"FROM game_events ge "+
+		"INNER JOIN games ON games.game_id = ge.game_id "+
+		"WHERE games.guild_id = $1 AND games.end_time != -1 AND games.win_type IN ($2, $3, $4) "+
+		"AND ge.user_id IS NOT NULL AND ge.event_type = $5 AND ge.payload ->> 'Action' IN ($6, $7) "+
+		"ORDER BY ge.game_id, ge.event_id;",
+		guildID, int16(game.HumansByVote), int16(game.ImpostorByKill), int16(game.ImpostorByVote),
+		int16(capture.Player), strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)))
+	if err != nil {
+		return 0, err
+	}
+	return countCloseGames(players, removals), nil
+}
+
+// countCloseGames applies the NumCloseGamesOnServer heuristic. removals must be ordered by event within each game
+func countCloseGames(players []*closeGamePlayer, removals []*closeGameRemoval) int64 {
+	losers := make(map[int64]map[uint64]bool)
+	for _, p := range players {
+		losingRole := game.CrewmateRole
+		if game.GameResult(p.WinType) == game.HumansByVote {
+			losingRole = game.ImposterRole
+		}
+		if game.GameRole(p.PlayerRole) != losingRole {
+			continue
+		}
+		if losers[p.GameID] == nil {
+			losers[p.GameID] = make(map[uint64]bool)
+		}
+		losers[p.GameID][p.UserID] = true
+	}
+
+	// exiles are normally also recorded as deaths, so each user only counts once, at their first removal event
+	gameRemovals := make(map[int64][]uint64)
+	seen := make(map[int64]map[uint64]bool)
+	for _, v := range removals {
+		if seen[v.GameID] == nil {
+			seen[v.GameID] = make(map[uint64]bool)
+		}
+		if seen[v.GameID][v.UserID] {
+			continue
+		}
+		seen[v.GameID][v.UserID] = true
+		gameRemovals[v.GameID] = append(gameRemovals[v.GameID], v.UserID)
+	}
+
+	var r int64
+	for gameID, users := range gameRemovals {
+		team, ok := losers[gameID]
+		if !ok {
+			continue
+		}
+		// everyone removed before the last distinct user to be removed
+		removed := make(map[uint64]bool)
+		for _, u := range users[:len(users)-1] {
+			removed[u] = true
+		}
+		survivors := 0
+		for u := range team {
+			if !removed[u] {
+				survivors++
+			}
+		}
+		if survivors == 1 {
+			r++
+		}
+	}
+	return r
+}
+
+func (psqlInterface *PsqlInterface) NumGamesWonAsRoleOnServer(guildID string, role game.GameRole) int64 {
+	gid, err := ParseSnowflake(guildID)
+	if err != nil {
+		psqlInterface.logError("NumGamesWonAsRoleOnServer", err, guildID, role)
+		return -1
+	}
+	var r int64
+	if role == game.CrewmateRole {
+		err = pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND (win_type=0 OR win_type=1 OR win_type=6)", gid)
+	} else {
+		err = pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND (win_type=2 OR win_type=3 OR win_type=4 OR win_type=5)", gid)
+	}
+	if err != nil {
+		psqlInterface.logError("NumGamesWonAsRoleOnServer", err, guildID, role)
+		return -1
+	}
+	return r
+}
+
+// RoleWinBalanceOnServer counts the guild's finished games won by each side, grouping win types the same way as
+// NumGamesWonAsRoleOnServer
+func (psqlInterface *PsqlInterface) RoleWinBalanceOnServer(guildID string) (crewWins, imposterWins int64, err error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Release()
+	return roleWinBalanceOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func roleWinBalanceOnServer(conn PgxIface, guildID string) (crewWins, imposterWins int64, err error) {
+	var r struct {
+		CrewWins     int64 `db:"crew_wins"`
+		ImposterWins int64 `db:"imposter_wins"`
+	}
+	err = pgxscan.Get(context.Background(), conn, &r, "SELECT "+
+		"COUNT(*) FILTER ( WHERE win_type=0 OR win_type=1 OR win_type=6 ) AS crew_wins, "+
+		"COUNT(*) FILTER ( WHERE win_type=2 OR win_type=3 OR win_type=4 OR win_type=5 ) AS imposter_wins "+
+		"FROM games WHERE guild_id=$1 AND end_time != -1;", guildID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.CrewWins, r.ImposterWins, nil
+}
+
+// NumSabotageWinsOnServer counts the guild's finished games that the imposters won by sabotage
+func (psqlInterface *PsqlInterface) NumSabotageWinsOnServer(guildID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return numSabotageWinsOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func numSabotageWinsOnServer(conn PgxIface, guildID string) (int64, error) {
+	var r int64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND win_type=$2 AND end_time != -1;",
+		guildID, int16(game.ImpostorBySabotage))
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// UserSabotageWins counts the guild's finished games that the user won as an imposter by sabotage
+func (psqlInterface *PsqlInterface) UserSabotageWins(userID, guildID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return userSabotageWins(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func userSabotageWins(conn PgxIface, userID, guildID string) (int64, error) {
+	var r int64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND users_games.player_role = $3 "+
+		"AND users_games.player_won = TRUE AND games.win_type = $4 AND games.end_time != -1;",
+		userID, guildID, int16(game.ImposterRole), int16(game.ImpostorBySabotage))
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+func (psqlInterface *PsqlInterface) NumGamesPlayedByUser(userID string) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1;", userID)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+func (psqlInterface *PsqlInterface) NumGuildsPlayedInByUser(userID string) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(DISTINCT guild_id) FROM users_games WHERE user_id=$1;", userID)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+// GuildsPlayedInByUser returns the IDs of every guild the user has played a game in, in ascending order
+func (psqlInterface *PsqlInterface) GuildsPlayedInByUser(userID string) ([]uint64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return guildsPlayedInByUser(psqlInterface.withQueryTimeout(conn.Conn()), userID)
+}
+
+func guildsPlayedInByUser(conn PgxIface, userID string) ([]uint64, error) {
+	r := []uint64{}
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT DISTINCT guild_id FROM users_games WHERE user_id=$1 ORDER BY guild_id ASC;", userID)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (psqlInterface *PsqlInterface) NumGamesPlayedByUserOnServer(userID, guildID string) int64 {
+	gid, err := ParseSnowflake(guildID)
+	if err != nil {
+		psqlInterface.logError("NumGamesPlayedByUserOnServer", err, userID, guildID)
+		return -1
+	}
+	var r int64
+	err = pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2", userID, gid)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+func (psqlInterface *PsqlInterface) NumWinsAsRoleOnServer(userID, guildID string, role int16) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2 AND player_role=$3 AND player_won=true;", userID, guildID, role)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+func (psqlInterface *PsqlInterface) NumWinsAsRole(userID string, role int16) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND player_role=$2 AND player_won=true;", userID, role)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+func (psqlInterface *PsqlInterface) NumGamesAsRoleOnServer(userID, guildID string, role int16) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2 AND player_role=$3;", userID, guildID, role)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+// RolePreference counts the user's games on the guild as a crewmate and as an imposter, whatever the outcome
+func (psqlInterface *PsqlInterface) RolePreference(userID, guildID string) (crewGames, imposterGames int64, err error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Release()
+	return rolePreference(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func rolePreference(conn PgxIface, userID, guildID string) (crewGames, imposterGames int64, err error) {
+	var r struct {
+		CrewGames     int64 `db:"crew_games"`
+		ImposterGames int64 `db:"imposter_games"`
+	}
+	err = pgxscan.Get(context.Background(), conn, &r, "SELECT "+
+		"COUNT(*) FILTER ( WHERE player_role = $3 ) AS crew_games, "+
+		"COUNT(*) FILTER ( WHERE player_role = $4 ) AS imposter_games "+
+		"FROM users_games WHERE user_id=$1 AND guild_id=$2;",
+		userID, guildID, int16(game.CrewmateRole), int16(game.ImposterRole))
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.CrewGames, r.ImposterGames, nil
+}
+
+type roleOutcomeRow struct {
+	Role  int16 `db:"player_role"`
+	Won   bool  `db:"player_won"`
+	Count int64 `db:"count"`
+}
+
+// MostCommonRoleOutcome returns the (role, won) combination the user has on the guild most often, and how many games
+// it covers. Ties go to crewmate over imposter, then to a win over a loss. With no games, count is 0
+func (psqlInterface *PsqlInterface) MostCommonRoleOutcome(userID, guildID string) (role int16, won bool, count int64, err error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, false, 0, err
+	}
+	defer conn.Release()
+	return mostCommonRoleOutcome(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func mostCommonRoleOutcome(conn PgxIface, userID, guildID string) (role int16, won bool, count int64, err error) {
+	var r []*roleOutcomeRow
+	err = pgxscan.Select(context.Background(), conn, &r, "SELECT player_role, player_won, COUNT(*) AS count "+
+		"FROM users_games WHERE user_id=$1 AND guild_id=$2 "+
+		"GROUP BY player_role, player_won "+
+		"ORDER BY count DESC, player_role ASC, player_won DESC "+
+		"LIMIT 1;", userID, guildID)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	if len(r) == 0 {
+		return 0, false, 0, nil
+	}
+	return r[0].Role, r[0].Won, r[0].Count, nil
+}
+
+func (psqlInterface *PsqlInterface) NumGamesAsRole(userID string, role int16) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND player_role=$2;", userID, role)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+func (psqlInterface *PsqlInterface) NumWinsOnServer(userID, guildID string) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2 AND player_won=true;", userID, guildID)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+func (psqlInterface *PsqlInterface) NumWins(userID string) int64 {
+	var r int64
+	err := pgxscan.Get(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND player_won=true;", userID)
+	if err != nil {
+		return -1
+	}
+	return r
+}
+
+// GlobalWinRate returns the user's win rate, as a percentage, across every guild they've played on. Users without any
+// games have a win rate of 0
+func (psqlInterface *PsqlInterface) GlobalWinRate(userID string) (float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return globalWinRate(psqlInterface.withQueryTimeout(conn.Conn()), userID)
+}
+
+func globalWinRate(conn PgxIface, userID string) (float64, error) {
+	var r float64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COALESCE("+
+		"(COUNT(*) FILTER ( WHERE player_won = TRUE )::decimal / NULLIF(COUNT(*), 0)) * 100, 0) AS win_rate "+
+		"FROM users_games WHERE user_id=$1;", userID)
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// WinRateExcludingDisconnects returns the user's win rate on the guild, as a percentage, leaving out every game in
+// which they disconnected. Returns 0 if no games remain
+func (psqlInterface *PsqlInterface) WinRateExcludingDisconnects(userID, guildID string) (float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return winRateExcludingDisconnects(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func winRateExcludingDisconnects(conn PgxIface, userID, guildID string) (float64, error) {
+	var r float64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COALESCE("+
+		"(COUNT(*) FILTER ( WHERE users_games.player_won = TRUE )::decimal / NULLIF(COUNT(*), 0)) * 100, 0) AS win_rate "+
+		"FROM users_games "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND NOT EXISTS ("+
+		"SELECT 1 FROM game_events ge WHERE ge.game_id = users_games.game_id AND ge.user_id = users_games.user_id "+
+		"AND ge.event_type = $3 AND ge.payload ->> 'Action' = $4"+
+		");", userID, guildID, int16(capture.Player), strconv.Itoa(int(game.DISCONNECTED)))
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// WinRateBucket is the win rate over all the games that started within [Start, Start + bucket duration)
+type WinRateBucket struct {
+	Start   time.Time
+	Games   int64
+	WinRate float64
+}
+
+type winRateBucketRow struct {
+	Start   int64   `db:"bucket_start"`
+	Games   int64   `db:"games"`
+	WinRate float64 `db:"win_rate"`
+}
+
+// WinRateTimeSeries returns the user's win rate on the guild over time, oldest first. Buckets are aligned to the Unix
+// epoch, and buckets without any games are omitted
+func (psqlInterface *PsqlInterface) WinRateTimeSeries(userID, guildID string, bucket time.Duration) ([]*WinRateBucket, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return winRateTimeSeries(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID, bucket)
+}
+
+func winRateTimeSeries(conn PgxIface, userID, guildID string, bucket time.Duration) ([]*WinRateBucket, error) {
+	bucketSecs := int64(bucket / time.Second)
+	if bucketSecs < 1 {
+		return nil, errors.New("win rate bucket must be at least 1 second")
+	}
+	var rows []*winRateBucketRow
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT (games.start_time / $3) * $3 AS bucket_start, "+
+		"COUNT(*) AS games, "+
+		"(COUNT(*) FILTER ( WHERE users_games.player_won = TRUE )::decimal / COUNT(*)) * 100 AS win_rate "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1 "+
+		"GROUP BY bucket_start "+
+		"ORDER BY bucket_start ASC;", userID, guildID, bucketSecs)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]*WinRateBucket, len(rows))
+	for i, v := range rows {
+		r[i] = &WinRateBucket{
+			Start:   time.Unix(v.Start, 0),
+			Games:   v.Games,
+			WinRate: v.WinRate,
+		}
+	}
+	return r, nil
+}
+
+type playerCountWinRateRow struct {
+	Players int64   `db:"players"`
+	WinRate float64 `db:"win_rate"`
+}
+
+// WinRateByPlayerCount returns the user's win rate on the guild keyed by lobby size. Lobby size is the number of
+// users_games rows for the game, so unlinked players aren't counted; sizes the user never played are absent
+func (psqlInterface *PsqlInterface) WinRateByPlayerCount(userID, guildID string) (map[int]float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return winRateByPlayerCount(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func winRateByPlayerCount(conn PgxIface, userID, guildID string) (map[int]float64, error) {
+	var rows []*playerCountWinRateRow
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT sizes.players, "+
+		"(COUNT(*) FILTER ( WHERE users_games.player_won = TRUE )::decimal / COUNT(*)) * 100 AS win_rate "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"INNER JOIN (SELECT game_id, COUNT(*) AS players FROM users_games GROUP BY game_id) sizes ON sizes.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1 "+
+		"GROUP BY sizes.players;", userID, guildID)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[int]float64, len(rows))
+	for _, v := range rows {
+		r[int(v.Players)] = v.WinRate
+	}
+	return r, nil
+}
+
+// WinRateVersus returns the user's win rate on the guild in finished games where the opponent was on the other team,
+// and how many such games there were. The win rate is 0 if they've never faced each other
+func (psqlInterface *PsqlInterface) WinRateVersus(userID, opponentID, guildID string) (float64, int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Release()
+	return winRateVersus(psqlInterface.withQueryTimeout(conn.Conn()), userID, opponentID, guildID)
+}
+
+func winRateVersus(conn PgxIface, userID, opponentID, guildID string) (float64, int64, error) {
+	if userID == opponentID {
+		return 0, 0, fmt.Errorf("a user can't be their own opponent, got %s twice", userID)
+	}
+	var r struct {
+		WinRate float64 `db:"win_rate"`
+		Games   int64   `db:"games"`
+	}
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COALESCE("+
+		"(COUNT(*) FILTER ( WHERE users_games.player_won = TRUE )::decimal / NULLIF(COUNT(*), 0)) * 100, 0) AS win_rate, "+
+		"COUNT(*) AS games "+
+		"FROM users_games "+
+		"INNER JOIN users_games opponent ON opponent.game_id = users_games.game_id AND opponent.user_id = $2 "+
+		"AND opponent.player_role <> users_games.player_role "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $3 AND games.end_time != -1;",
+		userID, opponentID, guildID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.WinRate, r.Games, nil
+}
+
+// RoleWinRateBucket is the imposters' win rate over all the guild's games that started within
+// [Start, Start + bucket duration)
+type RoleWinRateBucket struct {
+	Start           time.Time
+	Games           int64
+	ImposterWinRate float64
+}
+
+// ImposterWinRateTimeSeries returns the imposters' win rate across the guild's finished games over time, oldest first.
+// Buckets are aligned to the Unix epoch like WinRateTimeSeries, and buckets without any games are omitted
+func (psqlInterface *PsqlInterface) ImposterWinRateTimeSeries(guildID string, bucket time.Duration) ([]*RoleWinRateBucket, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return imposterWinRateTimeSeries(psqlInterface.withQueryTimeout(conn.Conn()), guildID, bucket)
+}
+
+func imposterWinRateTimeSeries(conn PgxIface, guildID string, bucket time.Duration) ([]*RoleWinRateBucket, error) {
+	bucketSecs := int64(bucket / time.Second)
+	if bucketSecs < 1 {
+		return nil, errors.New("win rate bucket must be at least 1 second")
+	}
+	var rows []*winRateBucketRow
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT (start_time / $2) * $2 AS bucket_start, "+
+		"COUNT(*) AS games, "+
+		"(COUNT(*) FILTER ( WHERE win_type=2 OR win_type=3 OR win_type=4 OR win_type=5 )::decimal / COUNT(*)) * 100 AS win_rate "+
+		"FROM games "+
+		"WHERE guild_id = $1 AND end_time != -1 "+
+		"GROUP BY bucket_start "+
+		"ORDER BY bucket_start ASC;", guildID, bucketSecs)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]*RoleWinRateBucket, len(rows))
+	for i, v := range rows {
+		r[i] = &RoleWinRateBucket{
+			Start:           time.Unix(v.Start, 0),
+			Games:           v.Games,
+			ImposterWinRate: v.WinRate,
+		}
+	}
+	return r, nil
+}
+
+// PlayerCountBucket is the number of players counted within [Start, Start + 1 week)
+type PlayerCountBucket struct {
+	Start   time.Time
+	Players int64
+}
+
+type playerCountBucketRow struct {
+	Start   int64 `db:"bucket_start"`
+	Players int64 `db:"players"`
+}
+
+// NewPlayersPerWeekOnServer returns, oldest first, how many users played their first finished game on the guild in
+// each week. Weeks are aligned to the Unix epoch like WinRateTimeSeries, and weeks without new players are omitted
+func (psqlInterface *PsqlInterface) NewPlayersPerWeekOnServer(guildID string) ([]*PlayerCountBucket, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return newPlayersPerWeekOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func newPlayersPerWeekOnServer(conn PgxIface, guildID string) ([]*PlayerCountBucket, error) {
+	weekSecs := int64(time.Hour * 24 * 7 / time.Second)
+	var rows []*playerCountBucketRow
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT (first_game / $2) * $2 AS bucket_start, "+
+		"COUNT(*) AS players "+
+		"FROM ("+
+		"SELECT users_games.user_id, MIN(games.start_time) AS first_game "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.guild_id = $1 AND games.end_time != -1 "+
+		"GROUP BY users_games.user_id"+
+		") firsts "+
+		"GROUP BY bucket_start "+
+		"ORDER BY bucket_start ASC;", guildID, weekSecs)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]*PlayerCountBucket, len(rows))
+	for i, v := range rows {
+		r[i] = &PlayerCountBucket{
+			Start:   time.Unix(v.Start, 0),
+			Players: v.Players,
+		}
+	}
+	return r, nil
+}
+
+// AverageSurvivalTime returns how long, on average, the user lasted in the guild's finished games before their first
+// death or exile. Games they survived are excluded rather than counted as the full game length, so this is "how long
+// until I die, when I die". Users who have never died get 0
+func (psqlInterface *PsqlInterface) AverageSurvivalTime(userID, guildID string) (time.Duration, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return averageSurvivalTime(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func averageSurvivalTime(conn PgxIface, userID, guildID string) (time.Duration, error) {
+	var secs float64
+	err := pgxscan.Get(context.Background(), conn, &secs, "SELECT COALESCE(AVG(survived), 0) FROM ("+
+		"SELECT MIN(ge.event_time) - games.start_time AS survived "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"INNER JOIN game_events ge ON ge.game_id = users_games.game_id AND ge.user_id = users_games.user_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1 "+
+		"AND ge.event_type = $3 AND ge.payload ->> 'Action' IN ($4, $5) "+
+		"GROUP BY users_games.game_id, games.start_time"+
+		") deaths;", userID, guildID, int16(capture.Player), strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// UserLongestGame returns the length of the user's longest finished game on the guild, or 0 if they have none
+func (psqlInterface *PsqlInterface) UserLongestGame(userID, guildID string) (time.Duration, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return userLongestGame(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func userLongestGame(conn PgxIface, userID, guildID string) (time.Duration, error) {
+	var secs int64
+	err := pgxscan.Get(context.Background(), conn, &secs, "SELECT COALESCE(MAX(games.end_time - games.start_time), 0) "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1;", userID, guildID)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// UserAverageGameDuration returns the mean length of the user's finished games on the guild, or 0 if they have none
+func (psqlInterface *PsqlInterface) UserAverageGameDuration(userID, guildID string) (time.Duration, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return userAverageGameDuration(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func userAverageGameDuration(conn PgxIface, userID, guildID string) (time.Duration, error) {
+	var secs float64
+	err := pgxscan.Get(context.Background(), conn, &secs, "SELECT COALESCE(AVG(games.end_time - games.start_time), 0) "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1;", userID, guildID)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// UserCurrentWinStreak returns how many of the user's most recent finished games on the guild they've won in a row
+func (psqlInterface *PsqlInterface) UserCurrentWinStreak(userID, guildID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return userCurrentWinStreak(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func userCurrentWinStreak(conn PgxIface, userID, guildID string) (int64, error) {
+	var r int64
+	// every finished game after the user's most recent loss is, by definition, part of the current streak
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1 "+
+		"AND games.start_time > COALESCE(("+
+		"SELECT MAX(lost.start_time) FROM users_games lug "+
+		"INNER JOIN games lost ON lost.game_id = lug.game_id "+
+		"WHERE lug.user_id = $1 AND lug.guild_id = $2 AND lost.end_time != -1 AND lug.player_won = FALSE"+
+		"), -1);", userID, guildID)
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// NumKillsAsImposter counts the crewmates killed in the guild's games where the user was an imposter. Kill events don't
+// record who made the kill, so (as in ImposterKillVoteRatioForServer) every crewmate DIED event that wasn't also an
+// EXILE in the same game is credited to each imposter in that game; with two imposters, both get the kill
+func (psqlInterface *PsqlInterface) NumKillsAsImposter(userID, guildID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return numKillsAsImposter(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func numKillsAsImposter(conn PgxIface, userID, guildID string) (int64, error) {
+	var r int64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(ge.event_id) "+
+		"FROM users_games imp "+
+		"INNER JOIN users_games crew ON crew.game_id = imp.game_id AND crew.player_role = $4 "+
+		"INNER JOIN game_events ge ON ge.game_id = crew.game_id AND ge.user_id = crew.user_id AND ge.event_type = $5 AND ge.payload ->> 'Action' = $6 "+
+		"WHERE imp.user_id = $1 AND imp.guild_id = $2 AND imp.player_role = $3 AND NOT EXISTS ("+
+		"SELECT 1 FROM game_events ex WHERE ex.game_id = crew.game_id AND ex.user_id = crew.user_id AND ex.payload ->> 'Action' = $7"+
+		");",
+		userID, guildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player),
+		strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)))
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// LongestInGameKillStreak returns the most kills made between two meetings in any of the user's imposter games on the
+// guild. As with NumKillsAsImposter, kills aren't recorded against the killer, so every death that wasn't an exile is
+// credited to each imposter in the game
+func (psqlInterface *PsqlInterface) LongestInGameKillStreak(userID, guildID string) (int, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return longestInGameKillStreak(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func longestInGameKillStreak(conn PgxIface, userID, guildID string) (int, error) {
+	var events []*PostgresGameEvent
+	err := pgxscan.Select(context.Background(), conn, &events, "SELECT game_events.* FROM game_events "+
+		"INNER JOIN users_games ON users_games.game_id = game_events.game_id "+
+		"INNER JOIN games ON games.game_id = game_events.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND users_games.player_role = $3 AND games.end_time != -1 "+
+		"AND game_events.event_type IN ($4, $5) "+
+		"ORDER BY game_events.game_id ASC, game_events.event_time ASC, game_events.event_id ASC;",
+		userID, guildID, int16(game.ImposterRole), int16(capture.State), int16(capture.Player))
+	if err != nil {
+		return 0, err
+	}
+	longest := 0
+	for start := 0; start < len(events); {
+		end := start
+		for end < len(events) && events[end].GameID == events[start].GameID {
+			end++
+		}
+		if streak := longestKillStreak(events[start:end]); streak > longest {
+			longest = streak
+		}
+		start = end
+	}
+	return longest, nil
+}
+
+// longestKillStreak finds the most deaths between two Discuss phase changes in a single game's ordered events. Exiles
+// are normally also recorded as deaths, so the deaths of exiled players are skipped
+func longestKillStreak(events []*PostgresGameEvent) int {
+	players := make([]*game.Player, len(events))
+	exiled := exiledPlayerNames(events)
+	for i, v := range events {
+		if v.EventType != int16(capture.Player) {
+			continue
+		}
+		player := game.Player{}
+		if err := json.Unmarshal([]byte(v.Payload), &player); err != nil {
+			// unreadable payloads are capture bugs (see FindMalformedGames), not a reason to give up on the user's history
+			continue
+		}
+		players[i] = &player
+	}
+
+	longest, streak := 0, 0
+	for i, v := range events {
+		switch {
+		case v.EventType == int16(capture.State) && v.Payload == DiscussCode:
+			streak = 0
+		case players[i] != nil && players[i].Action == game.DIED && !exiled[players[i].Name]:
+			streak++
+			if streak > longest {
+				longest = streak
+			}
+		}
+	}
+	return longest
+}
+
+// exiledPlayerNames is the set of players exiled in a game's events. An exile is also recorded as a DIED event for the
+// same player, so DIED events for these names are ejections, not kills
+func exiledPlayerNames(events []*PostgresGameEvent) map[string]bool {
+	exiled := make(map[string]bool)
+	for _, v := range events {
+		if v.EventType != int16(capture.Player) {
+			continue
+		}
+		player := game.Player{}
+		if err := json.Unmarshal([]byte(v.Payload), &player); err != nil {
+			// FindMalformedGames reports payloads that can't be read
+			continue
+		}
+		if player.Action == game.EXILED {
+			exiled[player.Name] = true
+		}
+	}
+	return exiled
+}
+
+// MeetingsExperiencedByUser counts the meetings held in the user's finished games on the guild. State events aren't
+// recorded against a user, so there's no way to tell who called a meeting; this is the number the user sat through
+// (alive or dead), not the number they called. For the same reason (and because there's no report PlayerAction),
+// body reports can't be told apart from emergency meetings or credited to whoever reported them
+func (psqlInterface *PsqlInterface) MeetingsExperiencedByUser(userID, guildID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return meetingsExperiencedByUser(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func meetingsExperiencedByUser(conn PgxIface, userID, guildID string) (int64, error) {
+	var r int64
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(ge.event_id) "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"INNER JOIN game_events ge ON ge.game_id = users_games.game_id AND ge.event_type = $3 AND ge.payload #>> '{}' = $4 "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1;",
+		userID, guildID, int16(capture.State), DiscussCode)
+	if err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// DeathPhaseBreakdown counts the user's finished games on the guild in which they died or were exiled, split by
+// whether the most recent phase change before it was to Tasks or to Discuss. Exiles are normally also recorded as
+// deaths, so only the first such event in each game is counted; deaths with no earlier phase change (or after some
+// other phase) aren't counted at all
+func (psqlInterface *PsqlInterface) DeathPhaseBreakdown(userID, guildID string) (duringTasks, duringMeetings int64, err error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Release()
+	return deathPhaseBreakdown(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
 }
 
-func (psqlInterface *PsqlInterface) NumGamesPlayedOnGuild(guildID string) int64 {
-	gid, _ := strconv.ParseInt(guildID, 10, 64)
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND end_time != -1;", gid)
+func deathPhaseBreakdown(conn PgxIface, userID, guildID string) (duringTasks, duringMeetings int64, err error) {
+	var events []*PostgresGameEvent
+	err = pgxscan.Select(context.Background(), conn, &events, "SELECT game_events.* FROM game_events "+
+		"INNER JOIN users_games ON users_games.game_id = game_events.game_id "+
+		"INNER JOIN games ON games.game_id = game_events.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1 "+
+		"AND (game_events.event_type = $3 OR (game_events.event_type = $4 AND game_events.user_id = users_games.user_id "+
+		"AND game_events.payload ->> 'Action' IN ($5, $6))) "+
+		"ORDER BY game_events.game_id ASC, game_events.event_time ASC, game_events.event_id ASC;",
+		userID, guildID, int16(capture.State), int16(capture.Player),
+		strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)))
 	if err != nil {
-		return -1
+		return 0, 0, err
 	}
-	return r
+	duringTasks, duringMeetings = classifyDeathPhases(events)
+	return duringTasks, duringMeetings, nil
 }
 
-func (psqlInterface *PsqlInterface) NumGamesWonAsRoleOnServer(guildID string, role game.GameRole) int64 {
-	gid, _ := strconv.ParseInt(guildID, 10, 64)
-	var r int64
-	var err error
-	if role == game.CrewmateRole {
-		err = pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND (win_type=0 OR win_type=1 OR win_type=6)", gid)
-	} else {
-		err = pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM games WHERE guild_id=$1 AND (win_type=2 OR win_type=3 OR win_type=4 OR win_type=5)", gid)
+// classifyDeathPhases applies the DeathPhaseBreakdown rules to the state events and the user's removal events of their
+// games, ordered by event within each game
+func classifyDeathPhases(events []*PostgresGameEvent) (duringTasks, duringMeetings int64) {
+	phase := ""
+	counted := false
+	for i, v := range events {
+		if i == 0 || v.GameID != events[i-1].GameID {
+			phase, counted = "", false
+		}
+		switch {
+		case v.EventType == int16(capture.State):
+			phase = v.Payload
+		case v.EventType == int16(capture.Player) && !counted:
+			counted = true
+			if phase == TasksCode {
+				duringTasks++
+			} else if phase == DiscussCode {
+				duringMeetings++
+			}
+		}
 	}
+	return duringTasks, duringMeetings
+}
+
+// NumClutchWins counts the user's won crewmate games on the guild in which they were the last crewmate standing: they
+// never died or were exiled, and every other crewmate in the game died or was exiled before it ended. Only players
+// linked to users_games are known, so unlinked crewmates can't spoil (or count towards) a clutch; disconnecting
+// doesn't count as being removed
+func (psqlInterface *PsqlInterface) NumClutchWins(userID, guildID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
-		log.Println(err)
-		return -1
+		return 0, err
 	}
-	return r
+	defer conn.Release()
+	return numClutchWins(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
 }
 
-func (psqlInterface *PsqlInterface) NumGamesPlayedByUser(userID string) int64 {
+func numClutchWins(conn PgxIface, userID, guildID string) (int64, error) {
 	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1;", userID)
+	err := pgxscan.Get(context.Background(), conn, &r, "SELECT COUNT(*) "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND users_games.player_role = $3 "+
+		"AND users_games.player_won = TRUE AND games.end_time != -1 "+
+		// the user made it to the end
+		"AND NOT EXISTS ("+
+		"SELECT 1 FROM game_events me WHERE me.game_id = users_games.game_id AND me.user_id = users_games.user_id "+
+		"AND me.event_type = $4 AND me.payload ->> 'Action' IN ($5, $6) AND me.event_time <= games.end_time"+
+		") "+
+		// there was someone else on their side...
+		"AND EXISTS ("+
+		"SELECT 1 FROM users_games others WHERE others.game_id = users_games.game_id AND others.player_role = $3 "+
+		"AND others.user_id <> users_games.user_id"+
+		") "+
+		// ...and all of them were gone by the time the game ended
+		"AND NOT EXISTS ("+
+		"SELECT 1 FROM users_games alive WHERE alive.game_id = users_games.game_id AND alive.player_role = $3 "+
+		"AND alive.user_id <> users_games.user_id AND NOT EXISTS ("+
+		"SELECT 1 FROM game_events ge WHERE ge.game_id = alive.game_id AND ge.user_id = alive.user_id "+
+		"AND ge.event_type = $4 AND ge.payload ->> 'Action' IN ($5, $6) AND ge.event_time <= games.end_time"+
+		")"+
+		");",
+		userID, guildID, int16(game.CrewmateRole), int16(capture.Player),
+		strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)))
 	if err != nil {
-		return -1
+		return 0, err
 	}
-	return r
+	return r, nil
 }
 
-func (psqlInterface *PsqlInterface) NumGuildsPlayedInByUser(userID string) int64 {
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(DISTINCT guild_id) FROM users_games WHERE user_id=$1;", userID)
+// KillsPerImposterGame is NumKillsAsImposter divided by the number of the user's imposter games on the guild, with the
+// same attribution of kills. Users who have never been an imposter get 0
+func (psqlInterface *PsqlInterface) KillsPerImposterGame(userID, guildID string) (float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
-		return -1
+		return 0, err
 	}
-	return r
+	defer conn.Release()
+	return killsPerImposterGame(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
 }
 
-func (psqlInterface *PsqlInterface) NumGamesPlayedByUserOnServer(userID, guildID string) int64 {
-	var r int64
-	gid, _ := strconv.ParseInt(guildID, 10, 64)
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2", userID, gid)
+func killsPerImposterGame(conn PgxIface, userID, guildID string) (float64, error) {
+	var games int64
+	err := pgxscan.Get(context.Background(), conn, &games, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2 AND player_role=$3;",
+		userID, guildID, int16(game.ImposterRole))
 	if err != nil {
-		return -1
+		return 0, err
 	}
-	return r
+	if games == 0 {
+		return 0, nil
+	}
+	kills, err := numKillsAsImposter(conn, userID, guildID)
+	if err != nil {
+		return 0, err
+	}
+	return float64(kills) / float64(games), nil
 }
 
-func (psqlInterface *PsqlInterface) NumWinsAsRoleOnServer(userID, guildID string, role int16) int64 {
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2 AND player_role=$3 AND player_won=true;", userID, guildID, role)
+// BatchUserWinStats returns the number of games played and won on the guild for each of the users, keyed by user ID,
+// in a single query. Users without any games on the guild are absent from the map
+func (psqlInterface *PsqlInterface) BatchUserWinStats(userIDs []string, guildID string) (map[string]*UserWinStat, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
-		return -1
+		return nil, err
 	}
-	return r
+	defer conn.Release()
+	return batchUserWinStats(psqlInterface.withQueryTimeout(conn.Conn()), userIDs, guildID)
 }
 
-func (psqlInterface *PsqlInterface) NumWinsAsRole(userID string, role int16) int64 {
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND player_role=$2 AND player_won=true;", userID, role)
+func batchUserWinStats(conn PgxIface, userIDs []string, guildID string) (map[string]*UserWinStat, error) {
+	r := make(map[string]*UserWinStat, len(userIDs))
+	if len(userIDs) == 0 {
+		return r, nil
+	}
+	ids := make([]uint64, len(userIDs))
+	for i, v := range userIDs {
+		id, err := ParseSnowflake(v)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	var rows []*UserWinStat
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT user_id, "+
+		"COUNT(*) AS games, "+
+		"COUNT(*) FILTER ( WHERE player_won = TRUE ) AS wins "+
+		"FROM users_games "+
+		"WHERE user_id = ANY($1) AND guild_id = $2 "+
+		"GROUP BY user_id;", ids, guildID)
 	if err != nil {
-		return -1
+		return nil, err
 	}
-	return r
+	for _, v := range rows {
+		r[strconv.FormatUint(v.UserID, 10)] = v
+	}
+	return r, nil
 }
 
-func (psqlInterface *PsqlInterface) NumGamesAsRoleOnServer(userID, guildID string, role int16) int64 {
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2 AND player_role=$3;", userID, guildID, role)
+// UserWinTypeDistribution counts the user's finished games on the guild by how each game ended (its win_type)
+func (psqlInterface *PsqlInterface) UserWinTypeDistribution(userID, guildID string) (map[game.GameResult]int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
-		return -1
+		return nil, err
 	}
-	return r
+	defer conn.Release()
+	return userWinTypeDistribution(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
 }
 
-func (psqlInterface *PsqlInterface) NumGamesAsRole(userID string, role int16) int64 {
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND player_role=$2;", userID, role)
+func userWinTypeDistribution(conn PgxIface, userID, guildID string) (map[game.GameResult]int64, error) {
+	var rows []*Int16ModeCount
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT COUNT(*) AS count, games.win_type AS mode "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1 "+
+		"GROUP BY games.win_type;", userID, guildID)
 	if err != nil {
-		return -1
+		return nil, err
 	}
-	return r
+	r := make(map[game.GameResult]int64, len(rows))
+	for _, v := range rows {
+		r[game.GameResult(v.Mode)] = v.Count
+	}
+	return r, nil
 }
 
-func (psqlInterface *PsqlInterface) NumWinsOnServer(userID, guildID string) int64 {
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND guild_id=$2 AND player_won=true;", userID, guildID)
+// UserAchievedWinTypes returns each win type the user has won at least one game on the guild by, in ascending order
+func (psqlInterface *PsqlInterface) UserAchievedWinTypes(userID, guildID string) ([]game.GameResult, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
-		return -1
+		return nil, err
 	}
-	return r
+	defer conn.Release()
+	return userAchievedWinTypes(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
 }
 
-func (psqlInterface *PsqlInterface) NumWins(userID string) int64 {
-	var r int64
-	err := pgxscan.Get(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) FROM users_games WHERE user_id=$1 AND player_won=true;", userID)
+func userAchievedWinTypes(conn PgxIface, userID, guildID string) ([]game.GameResult, error) {
+	var rows []int16
+	err := pgxscan.Select(context.Background(), conn, &rows, "SELECT DISTINCT games.win_type "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND games.end_time != -1 AND users_games.player_won = TRUE "+
+		"ORDER BY games.win_type;", userID, guildID)
 	if err != nil {
-		return -1
+		return nil, err
 	}
-	return r
+	r := make([]game.GameResult, 0, len(rows))
+	for _, v := range rows {
+		r = append(r, game.GameResult(v))
+	}
+	return r, nil
 }
 
 type Int16ModeCount struct {
 	Count int64 `db:"count"`
 	Mode  int16 `db:"mode"`
 }
+type Int64ModeCount struct {
+	Count int64 `db:"count"`
+	Mode  int64 `db:"mode"`
+}
 type Uint64ModeCount struct {
 	Count int64  `db:"count"`
 	Mode  uint64 `db:"mode"`
@@ -362,14 +2056,94 @@ type StringModeCount struct {
 //}
 func (psqlInterface *PsqlInterface) ColorRankingForPlayerOnServer(userID, guildID string) []*Int16ModeCount {
 	r := []*Int16ModeCount{}
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT count(*),mode() within GROUP (ORDER BY player_color) AS mode FROM users_games WHERE user_id=$1 AND guild_id=$2 GROUP BY player_color ORDER BY count desc;", userID, guildID)
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT count(*),mode() within GROUP (ORDER BY player_color) AS mode FROM users_games WHERE user_id=$1 AND guild_id=$2 GROUP BY player_color ORDER BY count desc, mode asc;", userID, guildID)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("ColorRankingForPlayerOnServer", err, userID, guildID)
 	}
 	return r
 }
 
+// ColorRankingDetailedForPlayerOnServer is ColorRankingForPlayerOnServer with typed colors and each color's share of
+// the user's games on the guild, as a percentage
+func (psqlInterface *PsqlInterface) ColorRankingDetailedForPlayerOnServer(userID, guildID string) ([]*PostgresColorStat, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return colorRankingDetailedForPlayerOnServer(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func colorRankingDetailedForPlayerOnServer(conn PgxIface, userID, guildID string) ([]*PostgresColorStat, error) {
+	r := []*PostgresColorStat{}
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT player_color AS color, "+
+		"COUNT(*) AS count, "+
+		"COUNT(*)::decimal / SUM(COUNT(*)) OVER () * 100 AS percent "+
+		"FROM users_games "+
+		"WHERE user_id=$1 AND guild_id=$2 "+
+		"GROUP BY player_color "+
+		"ORDER BY count DESC, color ASC;", userID, guildID)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (psqlInterface *PsqlInterface) ColorRankingForServer(guildID string) ([]*Int16ModeCount, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return colorRankingForServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID)
+}
+
+func colorRankingForServer(conn PgxIface, guildID string) ([]*Int16ModeCount, error) {
+	var r []*Int16ModeCount
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT count(*),mode() within GROUP (ORDER BY player_color) AS mode FROM users_games WHERE guild_id=$1 GROUP BY player_color ORDER BY count desc, mode asc;", guildID)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type colorWinRateRow struct {
+	Color   game.Color `db:"color"`
+	WinRate float64    `db:"win_rate"`
+}
+
+// LuckiestColorOnServer returns the color with the highest win rate (as a percentage) across the guild's players, among
+// colors played at least minGames times. Ties go to the more played color, then the lower color. It's an error if no
+// color has been played enough
+func (psqlInterface *PsqlInterface) LuckiestColorOnServer(guildID string, minGames int) (game.Color, float64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Release()
+	return luckiestColorOnServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, minGames)
+}
+
+func luckiestColorOnServer(conn PgxIface, guildID string, minGames int) (game.Color, float64, error) {
+	var r []*colorWinRateRow
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT player_color AS color, "+
+		"(COUNT(*) FILTER ( WHERE player_won = TRUE )::decimal / COUNT(*)) * 100 AS win_rate "+
+		"FROM users_games "+
+		"WHERE guild_id=$1 "+
+		"GROUP BY player_color "+
+		"HAVING COUNT(*) >= $2 "+
+		"ORDER BY win_rate DESC, COUNT(*) DESC, color ASC "+
+		"LIMIT 1;", guildID, minGames)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(r) == 0 {
+		return 0, 0, fmt.Errorf("no color has been played at least %d times on guild %s", minGames, guildID)
+	}
+	return r[0].Color, r[0].WinRate, nil
+}
+
 //func (psqlInterface *PsqlInterface) NamesRankingForPlayer(userID string) []*StringModeCount {
 //	r := []*StringModeCount{}
 //	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT count(*),mode() within GROUP (ORDER BY player_name) AS mode FROM users_games WHERE user_id=$1 GROUP BY player_name ORDER BY count desc;", userID)
@@ -382,42 +2156,59 @@ func (psqlInterface *PsqlInterface) ColorRankingForPlayerOnServer(userID, guildI
 
 func (psqlInterface *PsqlInterface) NamesRankingForPlayerOnServer(userID, guildID string) []*StringModeCount {
 	var r []*StringModeCount
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT count(*),mode() within GROUP (ORDER BY player_name) AS mode FROM users_games WHERE user_id=$1 AND guild_id=$2 GROUP BY player_name ORDER BY count desc;", userID, guildID)
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT count(*),mode() within GROUP (ORDER BY player_name) AS mode FROM users_games WHERE user_id=$1 AND guild_id=$2 GROUP BY player_name ORDER BY count desc, mode asc;", userID, guildID)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("NamesRankingForPlayerOnServer", err, userID, guildID)
 	}
 	return r
 }
 
 func (psqlInterface *PsqlInterface) TotalGamesRankingForServer(guildID uint64) []*Uint64ModeCount {
 	var r []*Uint64ModeCount
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT count(*),mode() within GROUP (ORDER BY user_id) AS mode FROM users_games WHERE guild_id=$1 GROUP BY user_id ORDER BY count desc;", guildID)
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT count(*),mode() within GROUP (ORDER BY user_id) AS mode FROM users_games WHERE guild_id=$1 GROUP BY user_id ORDER BY count desc, mode asc;", guildID)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("TotalGamesRankingForServer", err, guildID)
 	}
 	return r
 }
 
 func (psqlInterface *PsqlInterface) OtherPlayersRankingForPlayerOnServer(userID, guildID string) []*PostgresOtherPlayerRanking {
 	var r []*PostgresOtherPlayerRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT distinct B.user_id,"+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT distinct B.user_id,"+
 		"count(*) over (partition by B.user_id),"+
 		"(count(*) over (partition by B.user_id)::decimal / (SELECT count(*) from users_games where user_id=$1 AND guild_id=$2))*100 as percent "+
 		"FROM users_games A INNER JOIN users_games B ON A.game_id = B.game_id AND A.user_id != B.user_id "+
 		"WHERE A.user_id=$1 AND A.guild_id=$2 "+
-		"ORDER BY percent desc", userID, guildID)
+		"ORDER BY percent desc, user_id asc", userID, guildID)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("OtherPlayersRankingForPlayerOnServer", err, userID, guildID)
 	}
 	return r
 }
 
+// TotalWinRankingForServerByRole ranks the guild's players by win rate as the given role. Ties are broken by number of
+// games played, then by ascending user ID, so the order is stable between calls
 func (psqlInterface *PsqlInterface) TotalWinRankingForServerByRole(guildID uint64, role int16) []*PostgresPlayerRanking {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		psqlInterface.logError("TotalWinRankingForServerByRole", err, guildID, role)
+		return nil
+	}
+	defer conn.Release()
+
+	r, err := totalWinRankingForServerByRole(psqlInterface.withQueryTimeout(conn.Conn()), guildID, role)
+	if err != nil {
+		psqlInterface.logError("TotalWinRankingForServerByRole", err, guildID, role)
+	}
+	return r
+}
+
+func totalWinRankingForServerByRole(conn PgxIface, guildID uint64, role int16) ([]*PostgresPlayerRanking, error) {
 	var r []*PostgresPlayerRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT DISTINCT user_id,"+
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT DISTINCT user_id,"+
 		"COUNT(user_id) FILTER ( WHERE player_won = TRUE ) AS win, "+
 		// "COUNT(user_id) FILTER ( WHERE player_won = FALSE ) AS loss," +
 		"COUNT(*) AS total, "+
@@ -426,46 +2217,338 @@ func (psqlInterface *PsqlInterface) TotalWinRankingForServerByRole(guildID uint6
 		"FROM users_games "+
 		"WHERE guild_id = $1 AND player_role = $2 "+
 		"GROUP BY user_id "+
-		"ORDER BY win_rate DESC", guildID, role)
+		"ORDER BY win_rate DESC, total DESC, user_id ASC", guildID, role)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
+// TotalWinRankingForServer ranks the guild's players by win rate. Ties are broken by number of games played, then by
+// ascending user ID, so the order is stable between calls
+func (psqlInterface *PsqlInterface) TotalWinRankingForServer(guildID uint64) []*PostgresPlayerRanking {
+	return psqlInterface.TotalWinRankingForServerWithOptions(guildID, WinRankingOptions{})
+}
+
+// TotalWinRankingForServerExcludingDisconnects is TotalWinRankingForServer without the games that were decided by a
+// disconnect (HumansDisconnect or ImpostorDisconnect), for competitive leaderboards
+func (psqlInterface *PsqlInterface) TotalWinRankingForServerExcludingDisconnects(guildID uint64) []*PostgresPlayerRanking {
+	return psqlInterface.TotalWinRankingForServerWithOptions(guildID, WinRankingOptions{ExcludeDisconnects: true})
+}
+
+// WinRankingOptions adjusts how TotalWinRankingForServerWithOptions counts and orders players
+type WinRankingOptions struct {
+	// ExcludeDisconnects leaves out games decided by a disconnect (HumansDisconnect or ImpostorDisconnect)
+	ExcludeDisconnects bool
+	// OrderByWilsonScore orders by the lower bound of the Wilson score interval for each player's win rate, rather than
+	// the raw win rate, so a handful of lucky games doesn't outrank a long record
+	OrderByWilsonScore bool
+	// MinPlayers, if positive, leaves out games with fewer than this many users_games rows (linked players), since
+	// small lobbies skew win rates
+	MinPlayers int
+}
+
+func (psqlInterface *PsqlInterface) TotalWinRankingForServerWithOptions(guildID uint64, opts WinRankingOptions) []*PostgresPlayerRanking {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		psqlInterface.logError("TotalWinRankingForServerWithOptions", err, guildID, opts)
+		return nil
+	}
+	defer conn.Release()
+
+	r, err := totalWinRankingForServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, opts)
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("TotalWinRankingForServerWithOptions", err, guildID, opts)
 	}
 	return r
 }
 
-func (psqlInterface *PsqlInterface) TotalWinRankingForServer(guildID uint64) []*PostgresPlayerRanking {
+func totalWinRankingForServer(conn PgxIface, guildID uint64, opts WinRankingOptions) ([]*PostgresPlayerRanking, error) {
 	var r []*PostgresPlayerRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT DISTINCT user_id,"+
+	args := []interface{}{guildID}
+	join := ""
+	if opts.ExcludeDisconnects {
+		join = "INNER JOIN games ON games.game_id = users_games.game_id AND games.win_type NOT IN ($2, $3) "
+		args = append(args, int16(game.HumansDisconnect), int16(game.ImpostorDisconnect))
+	}
+	where := "WHERE users_games.guild_id = $1 "
+	if opts.MinPlayers > 0 {
+		args = append(args, opts.MinPlayers)
+		where += fmt.Sprintf("AND users_games.game_id IN ("+
+			"SELECT game_id FROM users_games WHERE guild_id = $1 GROUP BY game_id HAVING COUNT(*) >= $%d"+
+			") ", len(args))
+	}
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT DISTINCT user_id,"+
 		"COUNT(user_id) FILTER ( WHERE player_won = TRUE ) AS win, "+
 		// "COUNT(user_id) FILTER ( WHERE player_won = FALSE ) AS loss," +
 		"COUNT(*) AS total, "+
 		"(COUNT(user_id) FILTER ( WHERE player_won = TRUE )::decimal / COUNT(*)) * 100 AS win_rate "+
 		// "(COUNT(user_id) FILTER ( WHERE player_won = FALSE )::decimal / COUNT(*)) * 100 AS loss_rate" +
+		"FROM users_games "+
+		join+
+		where+
+		"GROUP BY user_id "+
+		"ORDER BY win_rate DESC, total DESC, user_id ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.OrderByWilsonScore {
+		// stable, so equal scores keep the query's total DESC, user_id ASC tie-breaks
+		sort.SliceStable(r, func(i, j int) bool {
+			return WilsonLowerBound(r[i].WinCount, r[i].Count) > WilsonLowerBound(r[j].WinCount, r[j].Count)
+		})
+	}
+	return r, nil
+}
+
+// PlayersWithNoWins returns the IDs of the guild's players who have played at least minGames games without winning any
+func (psqlInterface *PsqlInterface) PlayersWithNoWins(guildID string, minGames int) ([]uint64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return playersWithNoWins(psqlInterface.withQueryTimeout(conn.Conn()), guildID, minGames)
+}
+
+func playersWithNoWins(conn PgxIface, guildID string, minGames int) ([]uint64, error) {
+	r := []uint64{}
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT user_id "+
 		"FROM users_games "+
 		"WHERE guild_id = $1 "+
 		"GROUP BY user_id "+
-		"ORDER BY win_rate DESC", guildID)
+		"HAVING COUNT(*) >= $2 AND COUNT(*) FILTER ( WHERE player_won = TRUE ) = 0 "+
+		"ORDER BY COUNT(*) DESC, user_id ASC;", guildID, minGames)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
+// UserRankOnServer returns the user's position in the guild's win rate ranking, among the total players with at least
+// minGames games. Players with equal win rates share a rank (so ranks can skip numbers). rank is 0 if the user isn't
+// ranked, either because they haven't played on the guild or haven't played minGames yet
+func (psqlInterface *PsqlInterface) UserRankOnServer(userID, guildID string, minGames int) (rank int64, total int64, err error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
 	if err != nil {
-		log.Println(err)
+		return 0, 0, err
 	}
-	return r
+	defer conn.Release()
+	return userRankOnServer(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID, minGames)
+}
+
+func userRankOnServer(conn PgxIface, userID, guildID string, minGames int) (rank int64, total int64, err error) {
+	var r struct {
+		Rank  int64 `db:"rank"`
+		Total int64 `db:"total"`
+	}
+	err = pgxscan.Get(context.Background(), conn, &r, "WITH ranked AS ("+
+		"SELECT user_id, "+
+		"RANK() OVER (ORDER BY COUNT(*) FILTER ( WHERE player_won = TRUE )::decimal / COUNT(*) DESC) AS rank "+
+		"FROM users_games "+
+		"WHERE guild_id = $1 "+
+		"GROUP BY user_id "+
+		"HAVING COUNT(*) >= $3"+
+		") "+
+		"SELECT COALESCE((SELECT rank FROM ranked WHERE user_id = $2), 0) AS rank, COUNT(*) AS total FROM ranked;",
+		guildID, userID, minGames)
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.Rank, r.Total, nil
+}
+
+// WilsonLowerBound is the lower bound of the 95% Wilson score confidence interval for wins out of total, from 0 to 1
+func WilsonLowerBound(wins, total int64) float64 {
+	if total < 1 {
+		return 0
+	}
+	const z = 1.96
+	n := float64(total)
+	p := float64(wins) / n
+	return (p + z*z/(2*n) - z*math.Sqrt((p*(1-p)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
+// MostImprovedPlayersForServer ranks the guild's players by how much their win rate over their most recent half of
+// games improved on their win rate over their first half. With an odd number of games, the middle game is in neither
+// half. Players need at least minGames (and never fewer than 2) finished games to qualify
+func (psqlInterface *PsqlInterface) MostImprovedPlayersForServer(guildID string, minGames int, limit int) ([]*PostgresImprovementRanking, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return mostImprovedPlayersForServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, minGames, limit)
+}
+
+func mostImprovedPlayersForServer(conn PgxIface, guildID string, minGames int, limit int) ([]*PostgresImprovementRanking, error) {
+	// each half needs at least 1 game to compute a rate
+	if minGames < 2 {
+		minGames = 2
+	}
+	var r []*PostgresImprovementRanking
+	err := pgxscan.Select(context.Background(), conn, &r, "WITH numbered AS ("+
+		"SELECT users_games.user_id, users_games.player_won, "+
+		"ROW_NUMBER() OVER (PARTITION BY users_games.user_id ORDER BY games.start_time, games.game_id) AS game_num, "+
+		"COUNT(*) OVER (PARTITION BY users_games.user_id) AS total "+
+		"FROM users_games "+
+		"INNER JOIN games ON games.game_id = users_games.game_id "+
+		"WHERE users_games.guild_id = $1 AND games.end_time != -1"+
+		"), halves AS ("+
+		"SELECT user_id, "+
+		"(COUNT(*) FILTER ( WHERE player_won = TRUE AND game_num <= total / 2 )::decimal / (total / 2)) * 100 AS early_rate, "+
+		"(COUNT(*) FILTER ( WHERE player_won = TRUE AND game_num > total - total / 2 )::decimal / (total / 2)) * 100 AS late_rate "+
+		"FROM numbered "+
+		"WHERE total >= $2 "+
+		"GROUP BY user_id, total"+
+		") "+
+		"SELECT user_id, early_rate, late_rate, late_rate - early_rate AS delta "+
+		"FROM halves "+
+		"ORDER BY delta DESC, user_id ASC "+
+		"LIMIT $3;", guildID, minGames, limit)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 func (psqlInterface *PsqlInterface) DeleteAllGamesForServer(guildID string) error {
-	_, err := psqlInterface.Pool.Exec(context.Background(), "DELETE FROM games WHERE guild_id=$1", guildID)
+	ctx, cancel := psqlInterface.execContext()
+	defer cancel()
+	_, err := psqlInterface.Pool.Exec(ctx, "DELETE FROM games WHERE guild_id=$1", guildID)
 	return err
 }
 
+// DeleteGame removes a single game along with all of its events and players. Nothing is removed if any of the deletes
+// fail, or if no game exists with that ID
+func (psqlInterface *PsqlInterface) DeleteGame(gameID int64) error {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return deleteGame(psqlInterface.withQueryTimeout(conn.Conn()), gameID)
+}
+
+func deleteGame(conn PgxIface, gameID int64) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	// no-op once the transaction has been committed
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM game_events WHERE game_id = $1;", gameID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM users_games WHERE game_id = $1;", gameID)
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(context.Background(), "DELETE FROM games WHERE game_id = $1;", gameID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no game found with ID %d", gameID)
+	}
+	return tx.Commit(context.Background())
+}
+
 func (psqlInterface *PsqlInterface) DeleteAllGamesForUser(userID string) error {
-	_, err := psqlInterface.Pool.Exec(context.Background(), "DELETE FROM users_games WHERE user_id=$1", userID)
+	ctx, cancel := psqlInterface.execContext()
+	defer cancel()
+	_, err := psqlInterface.Pool.Exec(ctx, "DELETE FROM users_games WHERE user_id=$1", userID)
 	return err
 }
 
+// DeleteAllGamesForUserOnServer removes the user's games on a single guild. Like opting out, their events in those games
+// are kept for the game timelines, but are no longer linked to them
+func (psqlInterface *PsqlInterface) DeleteAllGamesForUserOnServer(userID, guildID string) error {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return deleteAllGamesForUserOnServer(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID)
+}
+
+func deleteAllGamesForUserOnServer(conn PgxIface, userID, guildID string) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	// no-op once the transaction has been committed
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE game_events SET user_id = NULL "+
+		"WHERE user_id = $1 AND game_id IN (SELECT game_id FROM games WHERE guild_id = $2);", userID, guildID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM users_games WHERE user_id = $1 AND guild_id = $2;", userID, guildID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// ReassignUserGames moves every game and event recorded for fromUserID over to toUserID, for players who've linked a new
+// Discord account, and returns how many users_games rows were moved. Games that already have toUserID in them are left
+// with the old user, since a game can't have the same player twice. Nothing is moved if any of the updates fail
+func (psqlInterface *PsqlInterface) ReassignUserGames(fromUserID, toUserID string) (int64, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	return reassignUserGames(psqlInterface.withQueryTimeout(conn.Conn()), fromUserID, toUserID)
+}
+
+func reassignUserGames(conn PgxIface, fromUserID, toUserID string) (int64, error) {
+	from, err := ParseSnowflake(fromUserID)
+	if err != nil {
+		return 0, err
+	}
+	to, err := ParseSnowflake(toUserID)
+	if err != nil {
+		return 0, err
+	}
+	if from == to {
+		return 0, fmt.Errorf("can't reassign games from user %d to itself", from)
+	}
+
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	// no-op once the transaction has been committed
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "INSERT INTO users VALUES ($1, true, NULL) ON CONFLICT DO NOTHING;", to)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE game_events SET user_id = $2 "+
+		"WHERE user_id = $1 AND game_id NOT IN (SELECT game_id FROM users_games WHERE user_id = $2);", from, to)
+	if err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(context.Background(), "UPDATE users_games SET user_id = $2 "+
+		"WHERE user_id = $1 AND game_id NOT IN (SELECT game_id FROM users_games WHERE user_id = $2);", from, to)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(context.Background()); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
 func (psqlInterface *PsqlInterface) BestTeammateByRole(userID, guildID string, role int16, leaderboardMin int) []*PostgresBestTeammatePlayerRanking {
 	var r []*PostgresBestTeammatePlayerRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT DISTINCT users_games.user_id, "+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT DISTINCT users_games.user_id, "+
 		"uG.user_id as teammate_id,"+
 		"COUNT(users_games.player_won) as total, "+
 		"COUNT(users_games.player_won) FILTER ( WHERE users_games.player_won = TRUE ) as win, "+
@@ -475,17 +2558,17 @@ func (psqlInterface *PsqlInterface) BestTeammateByRole(userID, guildID string, r
 		"WHERE users_games.guild_id = $1 AND users_games.player_role = $2 AND uG.player_role = $2 AND users_games.user_id = $3 "+
 		"GROUP BY users_games.user_id, uG.user_id "+
 		"HAVING COUNT(users_games.player_won) >= $4 "+
-		"ORDER BY win_rate DESC, win DESC, total DESC", guildID, role, userID, leaderboardMin)
+		"ORDER BY win_rate DESC, win DESC, total DESC, teammate_id ASC", guildID, role, userID, leaderboardMin)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("BestTeammateByRole", err, userID, guildID, role, leaderboardMin)
 	}
 	return r
 }
 
 func (psqlInterface *PsqlInterface) WorstTeammateByRole(userID, guildID string, role int16, leaderboardMin int) []*PostgresWorstTeammatePlayerRanking {
 	var r []*PostgresWorstTeammatePlayerRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT DISTINCT users_games.user_id, "+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT DISTINCT users_games.user_id, "+
 		"uG.user_id as teammate_id,"+
 		"COUNT(users_games.player_won) as total, "+
 		"COUNT(users_games.player_won) FILTER ( WHERE users_games.player_won = FALSE ) as loose, "+
@@ -495,59 +2578,114 @@ func (psqlInterface *PsqlInterface) WorstTeammateByRole(userID, guildID string,
 		"WHERE users_games.guild_id = $1 AND users_games.player_role = $2 AND uG.player_role = $2 AND users_games.user_id = $3 "+
 		"GROUP BY users_games.user_id, uG.user_id "+
 		"HAVING COUNT(users_games.player_won) >= $4 "+
-		"ORDER BY loose_rate DESC, loose DESC, total DESC", guildID, role, userID, leaderboardMin)
+		"ORDER BY loose_rate DESC, loose DESC, total DESC, teammate_id ASC", guildID, role, userID, leaderboardMin)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("WorstTeammateByRole", err, userID, guildID, role, leaderboardMin)
 	}
 	return r
 }
 
+// MostFrequentTeammates returns the users who shared the most games with userID on the guild, regardless of which
+// role either of them played or who won
+func (psqlInterface *PsqlInterface) MostFrequentTeammates(userID, guildID string, limit int) ([]*PostgresTeammateFrequency, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return mostFrequentTeammates(psqlInterface.withQueryTimeout(conn.Conn()), userID, guildID, limit)
+}
+
+func mostFrequentTeammates(conn PgxIface, userID, guildID string, limit int) ([]*PostgresTeammateFrequency, error) {
+	r := []*PostgresTeammateFrequency{}
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT uG.user_id AS teammate_id, "+
+		"COUNT(DISTINCT users_games.game_id) AS games "+
+		"FROM users_games "+
+		"INNER JOIN users_games uG ON users_games.game_id = uG.game_id AND users_games.user_id <> uG.user_id "+
+		"WHERE users_games.guild_id = $1 AND users_games.user_id = $2 "+
+		"GROUP BY uG.user_id "+
+		"ORDER BY games DESC, teammate_id ASC "+
+		"LIMIT $3;", guildID, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
 func (psqlInterface *PsqlInterface) BestTeammateForServerByRole(guildID string, role int16, leaderboardMin int) []*PostgresBestTeammatePlayerRanking {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		psqlInterface.logError("BestTeammateForServerByRole", err, guildID, role, leaderboardMin)
+		return nil
+	}
+	defer conn.Release()
+
+	r, err := bestTeammateForServerByRole(psqlInterface.withQueryTimeout(conn.Conn()), guildID, role, leaderboardMin)
+	if err != nil {
+		psqlInterface.logError("BestTeammateForServerByRole", err, guildID, role, leaderboardMin)
+	}
+	return r
+}
+
+func bestTeammateForServerByRole(conn PgxIface, guildID string, role int16, leaderboardMin int) ([]*PostgresBestTeammatePlayerRanking, error) {
 	var r []*PostgresBestTeammatePlayerRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT DISTINCT "+
-		"CASE WHEN users_games.user_id > uG.user_id THEN users_games.user_id ELSE uG.user_id END, "+
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT DISTINCT "+
+		"CASE WHEN users_games.user_id > uG.user_id THEN users_games.user_id ELSE uG.user_id END as user_id, "+
 		"CASE WHEN users_games.user_id > uG.user_id THEN uG.user_id ELSE users_games.user_id END as teammate_id, "+
 		"COUNT(users_games.player_won) as total, "+
 		"COUNT(users_games.player_won) FILTER ( WHERE users_games.player_won = TRUE ) as win, "+
 		"(COUNT(users_games.user_id) FILTER ( WHERE users_games.player_won = TRUE )::decimal / COUNT(*)) * 100 AS win_rate "+
 		"FROM users_games "+
 		"INNER JOIN users_games uG ON users_games.game_id = uG.game_id AND users_games.user_id <> uG.user_id "+
-		"WHERE users_games.guild_id = $1 AND users_games.player_role = $2 and uG.player_role = $2"+
+		"WHERE users_games.guild_id = $1 AND users_games.player_role = $2 and uG.player_role = $2 "+
 		"GROUP BY users_games.user_id, uG.user_id "+
 		"HAVING COUNT(users_games.player_won) >= $3 "+
-		"ORDER BY win_rate DESC, win DESC, total DESC", guildID, role, leaderboardMin)
+		"ORDER BY win_rate DESC, win DESC, total DESC, user_id ASC, teammate_id ASC", guildID, role, leaderboardMin)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (psqlInterface *PsqlInterface) WorstTeammateForServerByRole(guildID string, role int16, leaderboardMin int) []*PostgresWorstTeammatePlayerRanking {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		psqlInterface.logError("WorstTeammateForServerByRole", err, guildID, role, leaderboardMin)
+		return nil
+	}
+	defer conn.Release()
 
+	r, err := worstTeammateForServerByRole(psqlInterface.withQueryTimeout(conn.Conn()), guildID, role, leaderboardMin)
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("WorstTeammateForServerByRole", err, guildID, role, leaderboardMin)
 	}
 	return r
 }
 
-func (psqlInterface *PsqlInterface) WorstTeammateForServerByRole(guildID string, role int16, leaderboardMin int) []*PostgresWorstTeammatePlayerRanking {
+func worstTeammateForServerByRole(conn PgxIface, guildID string, role int16, leaderboardMin int) ([]*PostgresWorstTeammatePlayerRanking, error) {
 	var r []*PostgresWorstTeammatePlayerRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT DISTINCT "+
-		"CASE WHEN users_games.user_id > uG.user_id THEN users_games.user_id ELSE uG.user_id END, "+
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT DISTINCT "+
+		"CASE WHEN users_games.user_id > uG.user_id THEN users_games.user_id ELSE uG.user_id END as user_id, "+
 		"CASE WHEN users_games.user_id > uG.user_id THEN uG.user_id ELSE users_games.user_id END as teammate_id,"+
 		"COUNT(users_games.player_won) as total, "+
 		"COUNT(users_games.player_won) FILTER ( WHERE users_games.player_won = FALSE ) as loose, "+
 		"(COUNT(users_games.user_id) FILTER ( WHERE users_games.player_won = FALSE )::decimal / COUNT(*)) * 100 AS loose_rate "+
 		"FROM users_games "+
 		"INNER JOIN users_games uG ON users_games.game_id = uG.game_id AND users_games.user_id <> uG.user_id "+
-		"WHERE users_games.guild_id = $1 AND users_games.player_role = $2 AND uG.player_role = $2"+
+		"WHERE users_games.guild_id = $1 AND users_games.player_role = $2 AND uG.player_role = $2 "+
 		"GROUP BY users_games.user_id, uG.user_id "+
 		"HAVING COUNT(users_games.player_won) >= $3 "+
-		"ORDER BY loose_rate DESC, loose DESC, total DESC", guildID, role, leaderboardMin)
-
+		"ORDER BY loose_rate DESC, loose DESC, total DESC, user_id ASC, teammate_id ASC", guildID, role, leaderboardMin)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	return r
+	return r, nil
 }
 
 func (psqlInterface *PsqlInterface) UserWinByActionAndRole(userdID, guildID string, action string, role int16) []*PostgresUserActionRanking {
 	var r []*PostgresUserActionRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT users_games.user_id, "+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT users_games.user_id, "+
 		"COUNT(ge.user_id) FILTER ( WHERE payload ->> 'Action' = $1 ) as total_action, "+
 		"total_user.total as total, "+
 		"total_user.win_rate as win_rate "+
@@ -562,17 +2700,17 @@ func (psqlInterface *PsqlInterface) UserWinByActionAndRole(userdID, guildID stri
 		"WHERE users_games.user_id = $2 AND users_games.guild_id = $3 "+
 		"AND users_games.player_role = $4 "+
 		"GROUP BY users_games.user_id, total, win_rate "+
-		"ORDER BY win_rate DESC, total DESC;", action, userdID, guildID, role)
+		"ORDER BY win_rate DESC, total DESC, user_id ASC;", action, userdID, guildID, role)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("UserWinByActionAndRole", err, userdID, guildID, action, role)
 	}
 	return r
 }
 
 func (psqlInterface *PsqlInterface) UserFrequentFirstTarget(userID, guildID string, action string, leaderboardSize int) []*PostgresUserMostFrequentFirstTargetRanking {
 	var r []*PostgresUserMostFrequentFirstTargetRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) AS total_death, "+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) AS total_death, "+
 		"users_games.user_id, total, "+
 		"COUNT(*)::decimal / total * 100 AS death_rate "+
 		"FROM users_games "+
@@ -581,20 +2719,20 @@ func (psqlInterface *PsqlInterface) UserFrequentFirstTarget(userID, guildID stri
 		"ORDER BY event_time FETCH FIRST 1 ROW ONLY ) AS ge ON TRUE "+
 		"LEFT JOIN LATERAL (SELECT count(*) AS total "+
 		"FROM users_games WHERE users_games.user_id = ge.user_id AND users_games.guild_id = $2 AND player_role = 0) AS TOTAL_GAME ON TRUE "+
-		"WHERE users_games.guild_id = $2 AND users_games.user_id = ge.user_id AND users_games.user_id = $3"+
+		"WHERE users_games.guild_id = $2 AND users_games.user_id = ge.user_id AND users_games.user_id = $3 "+
 		"GROUP BY users_games.user_id, total  "+
-		"ORDER BY total_death DESC "+
+		"ORDER BY total_death DESC, user_id ASC "+
 		"LIMIT $4;", action, guildID, userID, leaderboardSize)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("UserFrequentFirstTarget", err, userID, guildID, action, leaderboardSize)
 	}
 	return r
 }
 
 func (psqlInterface *PsqlInterface) UserMostFrequentFirstTargetForServer(guildID string, action string, leaderboardSize int) []*PostgresUserMostFrequentFirstTargetRanking {
 	var r []*PostgresUserMostFrequentFirstTargetRanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT COUNT(*) AS total_death, "+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT COUNT(*) AS total_death, "+
 		"users_games.user_id, total, "+
 		"COUNT(*)::decimal / total * 100 AS death_rate "+
 		"FROM users_games "+
@@ -603,20 +2741,93 @@ func (psqlInterface *PsqlInterface) UserMostFrequentFirstTargetForServer(guildID
 		"ORDER BY event_time FETCH FIRST 1 ROW ONLY ) AS ge ON TRUE "+
 		"LEFT JOIN LATERAL (SELECT COUNT(*) AS total "+
 		"FROM users_games WHERE users_games.user_id = ge.user_id AND users_games.guild_id = $2 AND player_role = 0) AS TOTAL_GAME ON TRUE "+
-		"WHERE users_games.guild_id = $2 AND users_games.user_id = ge.user_id AND total > 3"+
+		"WHERE users_games.guild_id = $2 AND users_games.user_id = ge.user_id AND total > 3 "+
 		"GROUP BY users_games.user_id, total  "+
-		"ORDER BY death_rate DESC, total_death DESC "+
+		"ORDER BY death_rate DESC, total_death DESC, total DESC, user_id ASC "+
 		"LIMIT $3;", action, guildID, leaderboardSize)
 
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("UserMostFrequentFirstTargetForServer", err, guildID, action, leaderboardSize)
 	}
 	return r
 }
 
+// ImposterKillVoteRatioForServer ranks the guild's imposters (with at least minGames imposter games) by how many of the
+// crewmates removed in their games were killed, rather than voted out. Kills are DIED events for crewmates who weren't
+// also EXILED in the same game, and are credited to every imposter in that game. KillRatio is kills as a percentage of
+// kills + exiles
+func (psqlInterface *PsqlInterface) ImposterKillVoteRatioForServer(guildID string, minGames int) ([]*PostgresImposterStyleRanking, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return imposterKillVoteRatioForServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, minGames)
+}
+
+func imposterKillVoteRatioForServer(conn PgxIface, guildID string, minGames int) ([]*PostgresImposterStyleRanking, error) {
+	var r []*PostgresImposterStyleRanking
+	err := pgxscan.Select(context.Background(), conn, &r, "WITH style AS ("+
+		"SELECT imp.user_id, "+
+		"COUNT(DISTINCT imp.game_id) AS total, "+
+		"COUNT(ge.event_id) FILTER ( WHERE ge.payload ->> 'Action' = $5 AND NOT EXISTS ("+
+		"SELECT 1 FROM game_events ex WHERE ex.game_id = ge.game_id AND ex.user_id = ge.user_id AND ex.payload ->> 'Action' = $6"+
+		") ) AS kills, "+
+		"COUNT(ge.event_id) FILTER ( WHERE ge.payload ->> 'Action' = $6 ) AS exiles "+
+		"FROM users_games imp "+
+		"LEFT JOIN users_games crew ON crew.game_id = imp.game_id AND crew.player_role = $3 "+
+		"LEFT JOIN game_events ge ON ge.game_id = crew.game_id AND ge.user_id = crew.user_id AND ge.event_type = $4 "+
+		"WHERE imp.guild_id = $1 AND imp.player_role = $2 "+
+		"GROUP BY imp.user_id "+
+		"HAVING COUNT(DISTINCT imp.game_id) >= $7"+
+		") "+
+		"SELECT user_id, total, kills, exiles, "+
+		"COALESCE(kills::decimal / NULLIF(kills + exiles, 0) * 100, 0) AS kill_ratio "+
+		"FROM style "+
+		"ORDER BY kill_ratio DESC, total DESC, user_id ASC;",
+		guildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player),
+		strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)), minGames)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TopKillerVictimPairsForServer returns the guild's most frequent (imposter, crewmate) pairs, by how many of the
+// imposter's games the crewmate was killed in. Crewmates who were exiled in a game don't count as killed in it
+func (psqlInterface *PsqlInterface) TopKillerVictimPairsForServer(guildID string, limit int) ([]*PostgresKillerVictimPair, error) {
+	conn, err := psqlInterface.Pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return topKillerVictimPairsForServer(psqlInterface.withQueryTimeout(conn.Conn()), guildID, limit)
+}
+
+func topKillerVictimPairsForServer(conn PgxIface, guildID string, limit int) ([]*PostgresKillerVictimPair, error) {
+	r := []*PostgresKillerVictimPair{}
+	err := pgxscan.Select(context.Background(), conn, &r, "SELECT imp.user_id AS imposter_id, crew.user_id AS victim_id, "+
+		"COUNT(DISTINCT crew.game_id) AS kills "+
+		"FROM users_games imp "+
+		"INNER JOIN users_games crew ON crew.game_id = imp.game_id AND crew.player_role = $3 "+
+		"INNER JOIN game_events ge ON ge.game_id = crew.game_id AND ge.user_id = crew.user_id AND ge.event_type = $4 AND ge.payload ->> 'Action' = $5 "+
+		"WHERE imp.guild_id = $1 AND imp.player_role = $2 AND NOT EXISTS ("+
+		"SELECT 1 FROM game_events ex WHERE ex.game_id = crew.game_id AND ex.user_id = crew.user_id AND ex.payload ->> 'Action' = $6"+
+		") "+
+		"GROUP BY imp.user_id, crew.user_id "+
+		"ORDER BY kills DESC, imposter_id ASC, victim_id ASC "+
+		"LIMIT $7;",
+		guildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player),
+		strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.EXILED)), limit)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
 func (psqlInterface *PsqlInterface) UserMostFrequentKilledBy(userID, guildID string) []*PostgresUserMostFrequentKilledByanking {
 	var r []*PostgresUserMostFrequentKilledByanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT users_games.user_id, "+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT users_games.user_id, "+
 		"usG.user_id as teammate_id, "+
 		"COUNT(ge.user_id) FILTER ( WHERE payload ->> 'Action' = $1 ) as total_death, "+
 		"COUNT(usG.user_id) as encounter, (COUNT(ge.user_id) FILTER ( WHERE payload ->> 'Action' = $1 ))::decimal/count(usG.player_name) * 100 as death_rate "+
@@ -628,16 +2839,16 @@ func (psqlInterface *PsqlInterface) UserMostFrequentKilledBy(userID, guildID str
 		"LEFT JOIN game_events ge ON users_games.game_id = ge.game_id AND ge.user_id = $3 "+
 		"WHERE users_games.guild_id = $4 AND users_games.user_id = $3 AND users_games.player_role = $5 "+
 		"GROUP BY users_games.user_id, usG.user_id, users_games.user_id, total "+
-		"ORDER BY death_rate DESC, total_death DESC, encounter DESC;", strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.ImposterRole)), userID, guildID, strconv.Itoa(int(game.CrewmateRole)))
+		"ORDER BY death_rate DESC, total_death DESC, encounter DESC, user_id ASC, teammate_id ASC;", strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.ImposterRole)), userID, guildID, strconv.Itoa(int(game.CrewmateRole)))
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("UserMostFrequentKilledBy", err, userID, guildID)
 	}
 	return r
 }
 
 func (psqlInterface *PsqlInterface) UserMostFrequentKilledByServer(guildID string) []*PostgresUserMostFrequentKilledByanking {
 	var r []*PostgresUserMostFrequentKilledByanking
-	err := pgxscan.Select(context.Background(), psqlInterface.Pool, &r, "SELECT users_games.user_id, "+
+	err := pgxscan.Select(context.Background(), psqlInterface.querier(), &r, "SELECT users_games.user_id, "+
 		"usG.user_id as teammate_id, "+
 		"COUNT(ge.user_id) FILTER ( WHERE payload ->> 'Action' = $1 ) as total_death, "+
 		"COUNT(usG.user_id) as encounter, (COUNT(ge.user_id) FILTER ( WHERE payload ->> 'Action' = $1 ))::decimal/count(usG.player_name) * 100 as death_rate "+
@@ -649,9 +2860,9 @@ func (psqlInterface *PsqlInterface) UserMostFrequentKilledByServer(guildID strin
 		"INNER JOIN game_events ge ON users_games.game_id = ge.game_id AND ge.user_id = users_games.user_id "+
 		"WHERE users_games.guild_id = $3 AND users_games.player_role = $4 "+
 		"GROUP BY users_games.user_id, usG.user_id, users_games.user_id, total "+
-		"ORDER BY death_rate DESC, total_death DESC, encounter DESC;", strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.ImposterRole)), guildID, strconv.Itoa(int(game.CrewmateRole)))
+		"ORDER BY death_rate DESC, total_death DESC, encounter DESC, user_id ASC, teammate_id ASC;", strconv.Itoa(int(game.DIED)), strconv.Itoa(int(game.ImposterRole)), guildID, strconv.Itoa(int(game.CrewmateRole)))
 	if err != nil {
-		log.Println(err)
+		psqlInterface.logError("UserMostFrequentKilledByServer", err, guildID)
 	}
 	return r
 }
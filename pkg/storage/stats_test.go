@@ -0,0 +1,2611 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/automuteus/utils/pkg/capture"
+	"github.com/automuteus/utils/pkg/game"
+	"github.com/automuteus/utils/pkg/settings"
+	"github.com/pashagolub/pgxmock"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+)
+
+func TestColorRankingForServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT count\\(\\*\\),mode\\(\\) (.+) FROM users_games WHERE guild_id=(.+) GROUP BY player_color ORDER BY count desc, mode asc;$").
+		WithArgs(GuildID).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"count", "mode"}).
+				AddRow(int64(12), int16(0)).
+				AddRow(int64(7), int16(5)).
+				AddRow(int64(1), int16(11)))
+
+	colors, err := colorRankingForServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(colors) != 3 {
+		t.Fatalf("expected 3 colors in the ranking, got %d", len(colors))
+	}
+	if colors[0].Mode != 0 || colors[0].Count != 12 {
+		t.Error("expected red to be the most played color with 12 games")
+	}
+	if colors[2].Mode != 11 || colors[2].Count != 1 {
+		t.Error("expected lime to be the least played color with 1 game")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWinRateTimeSeries(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	week := time.Hour * 24 * 7
+	weekSecs := int64(week / time.Second)
+	firstWeek := weekSecs * 2700
+	secondWeek := firstWeek + weekSecs
+
+	mock.ExpectQuery("^SELECT \\(games.start_time / (.+)\\) \\* (.+) AS bucket_start, (.+) GROUP BY bucket_start ORDER BY bucket_start ASC;$").
+		WithArgs(UserID, GuildID, weekSecs).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"bucket_start", "games", "win_rate"}).
+				AddRow(firstWeek, int64(4), float64(25)).
+				AddRow(secondWeek, int64(2), float64(100)))
+
+	series, err := winRateTimeSeries(mock, UserID, GuildID, week)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("expected 2 weekly buckets, got %d", len(series))
+	}
+	if !series[0].Start.Equal(time.Unix(firstWeek, 0)) || series[0].Games != 4 || series[0].WinRate != 25 {
+		t.Error("first weekly bucket didn't match what was returned from Postgres")
+	}
+	if series[1].Start.Sub(series[0].Start) != week || series[1].Games != 2 || series[1].WinRate != 100 {
+		t.Error("second weekly bucket didn't match what was returned from Postgres")
+	}
+
+	_, err = winRateTimeSeries(mock, UserID, GuildID, time.Millisecond)
+	if err == nil {
+		t.Error("expected a sub-second bucket to be rejected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestImposterWinRateTimeSeries(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	day := time.Hour * 24
+	daySecs := int64(day / time.Second)
+	firstDay := daySecs * 19000
+	secondDay := firstDay + daySecs
+
+	// imposters won 1 of 4 games on the first day, and 2 of 2 on the second
+	mock.ExpectQuery("^SELECT \\(start_time / \\$2\\) \\* \\$2 AS bucket_start, COUNT\\(\\*\\) AS games, (.+) AS win_rate FROM games WHERE guild_id = \\$1 AND end_time != -1 GROUP BY bucket_start ORDER BY bucket_start ASC;$").
+		WithArgs(GuildID, daySecs).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"bucket_start", "games", "win_rate"}).
+				AddRow(firstDay, int64(4), float64(25)).
+				AddRow(secondDay, int64(2), float64(100)))
+
+	series, err := imposterWinRateTimeSeries(mock, GuildID, day)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("expected 2 daily buckets, got %d", len(series))
+	}
+	if !series[0].Start.Equal(time.Unix(firstDay, 0)) || series[0].Games != 4 || series[0].ImposterWinRate != 25 {
+		t.Error("first daily bucket didn't match what was returned from Postgres")
+	}
+	if series[1].Start.Sub(series[0].Start) != day || series[1].Games != 2 || series[1].ImposterWinRate != 100 {
+		t.Error("second daily bucket didn't match what was returned from Postgres")
+	}
+
+	_, err = imposterWinRateTimeSeries(mock, GuildID, 0)
+	if err == nil {
+		t.Error("expected a zero bucket to be rejected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMostImprovedPlayersForServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^WITH numbered AS \\((.+)\\) SELECT user_id, early_rate, late_rate, late_rate - early_rate AS delta FROM halves ORDER BY delta DESC, user_id ASC LIMIT (.+);$").
+		WithArgs(GuildID, 10, 5).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"user_id", "early_rate", "late_rate", "delta"}).
+				AddRow(UserIDInt, float64(20), float64(80), float64(60)).
+				AddRow(UserIDInt+1, float64(50), float64(50), float64(0)))
+
+	r, err := mostImprovedPlayersForServer(mock, GuildID, 10, 5)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("expected 2 ranked players, got %d", len(r))
+	}
+	if r[0].UserID != UserIDInt || r[0].EarlyRate != 20 || r[0].LateRate != 80 || r[0].Delta != 60 {
+		t.Error("expected the clearly improved player to rank first")
+	}
+
+	// a minimum below 2 would leave one of the halves empty
+	mock.ExpectQuery("^WITH numbered AS (.+)$").
+		WithArgs(GuildID, 2, 5).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "early_rate", "late_rate", "delta"}))
+
+	_, err = mostImprovedPlayersForServer(mock, GuildID, 0, 5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGlobalWinRate(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// the rate is taken over every users_games row of the user, with no guild filter, so it combines all their guilds
+	query := "SELECT COALESCE(" +
+		"(COUNT(*) FILTER ( WHERE player_won = TRUE )::decimal / NULLIF(COUNT(*), 0)) * 100, 0) AS win_rate " +
+		"FROM users_games WHERE user_id=$1;"
+	mock.ExpectQuery("^" + regexp.QuoteMeta(query) + "$").
+		WithArgs(UserID).
+		WillReturnRows(pgxmock.NewRows([]string{"win_rate"}).AddRow(float64(50)))
+
+	rate, err := globalWinRate(mock, UserID)
+	if err != nil {
+		t.Error(err)
+	}
+	if rate != 50 {
+		t.Errorf("expected a combined win rate of 50, got %f", rate)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRecomputeGameStats(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	died, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Alice", Color: game.Red})
+	exiledDied, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Bob", Color: game.Blue})
+	exiled, _ := json.Marshal(game.Player{Action: game.EXILED, Name: "Bob", Color: game.Blue})
+	mock.ExpectQuery("^SELECT \\* FROM games WHERE game_id = \\$1;$").
+		WithArgs(int64(1)).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}).
+				AddRow(int64(1), GuildIDInt, "ABCDEF", int32(1000), int16(game.ImpostorByKill), int32(1600)))
+	mock.ExpectQuery("^SELECT \\* FROM game_events WHERE game_id = \\$1 ORDER BY event_time ASC, event_id ASC;$").
+		WithArgs(int64(1)).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"event_id", "user_id", "game_id", "event_time", "event_type", "payload"}).
+				AddRow(uint64(1), nil, int64(1), int32(1000), int16(capture.State), TasksCode).
+				AddRow(uint64(2), nil, int64(1), int32(1090), int16(capture.Player), string(died)).
+				AddRow(uint64(3), nil, int64(1), int32(1200), int16(capture.State), DiscussCode).
+				AddRow(uint64(4), nil, int64(1), int32(1250), int16(capture.Player), string(exiledDied)).
+				AddRow(uint64(5), nil, int64(1), int32(1250), int16(capture.Player), string(exiled)).
+				AddRow(uint64(6), nil, int64(1), int32(1260), int16(capture.State), TasksCode))
+
+	stats, err := recomputeGameStats(mock, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.GameDuration != 10*time.Minute || stats.WinType != game.ImpostorByKill {
+		t.Error("expected the duration and result from the game row")
+	}
+	// the exiled player is recorded as both dead and exiled, and must only count as a kill once
+	if stats.NumMeetings != 1 || stats.NumDeaths != 2 || stats.NumVotedOff != 1 || stats.NumKilled() != 1 {
+		t.Errorf("unexpected counts: %d meetings, %d deaths, %d voted off, %d killed",
+			stats.NumMeetings, stats.NumDeaths, stats.NumVotedOff, stats.NumKilled())
+	}
+
+	mock.ExpectQuery("^SELECT \\* FROM games WHERE game_id = \\$1;$").
+		WithArgs(int64(2)).
+		WillReturnRows(pgxmock.NewRows([]string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}))
+	if _, err := recomputeGameStats(mock, 2); err == nil {
+		t.Error("expected an error for a game that doesn't exist")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStatsFromGameAndEvents_UnknownEventType(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.HumansByVote), EndTime: 1600}
+	events := []*PostgresGameEvent{
+		{EventID: 1, GameID: 1, EventTime: 1010, EventType: int16(capture.State), Payload: DiscussCode},
+		// an event type we don't know about, with a payload that would otherwise read as a meeting
+		{EventID: 2, GameID: 1, EventTime: 1020, EventType: 99, Payload: DiscussCode},
+		{EventID: 3, GameID: 1, EventTime: 1030, EventType: int16(capture.State), Payload: TasksCode},
+	}
+
+	stats := StatsFromGameAndEvents(pgame, events)
+	if stats.NumMeetings != 1 {
+		t.Errorf("expected the unknown event type to be skipped, got %d meetings", stats.NumMeetings)
+	}
+	for _, v := range stats.Events {
+		if v.EventTimeOffset == time.Second*20 {
+			t.Error("expected no timeline event for the unknown event type")
+		}
+	}
+}
+
+func TestStatsFromGameAndEvents_MeetingSkipped(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.HumansByVote), EndTime: 1600}
+	exiled, _ := json.Marshal(game.Player{Action: game.EXILED, Name: "Alice", Color: game.Red})
+	events := []*PostgresGameEvent{
+		// the first meeting ends without anyone being ejected
+		{EventID: 1, GameID: 1, EventTime: 1060, EventType: int16(capture.State), Payload: DiscussCode},
+		{EventID: 2, GameID: 1, EventTime: 1120, EventType: int16(capture.State), Payload: TasksCode},
+		// the second meeting ejects Alice
+		{EventID: 3, GameID: 1, EventTime: 1300, EventType: int16(capture.State), Payload: DiscussCode},
+		{EventID: 4, GameID: 1, EventTime: 1350, EventType: int16(capture.Player), Payload: string(exiled)},
+		{EventID: 5, GameID: 1, EventTime: 1360, EventType: int16(capture.State), Payload: TasksCode},
+	}
+
+	stats := StatsFromGameAndEvents(pgame, events)
+	skipped := 0
+	for _, v := range stats.Events {
+		if v.EventType == MeetingSkipped {
+			skipped++
+			if v.EventTimeOffset != time.Second*120 {
+				t.Errorf("expected the skipped meeting at 2m0s, got %s", v.EventTimeOffset)
+			}
+		}
+	}
+	if skipped != 1 {
+		t.Fatalf("expected exactly 1 skipped meeting in the timeline, got %d", skipped)
+	}
+
+	embed := stats.ToDiscordEmbed("ABCDEF:1", settings.MakeGuildSettings())
+	found := false
+	for _, f := range embed.Fields {
+		if strings.Contains(f.Value, "No one was ejected") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the skipped meeting to be rendered in the embed")
+	}
+}
+
+func TestStatsFromGameAndEvents_FirstBlood(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.ImpostorByKill), EndTime: 1600}
+	first, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Alice", Color: game.Red})
+	second, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Bob", Color: game.Blue})
+	events := []*PostgresGameEvent{
+		{EventID: 1, GameID: 1, EventTime: 1000, EventType: int16(capture.State), Payload: TasksCode},
+		{EventID: 2, GameID: 1, EventTime: 1095, EventType: int16(capture.Player), Payload: string(first)},
+		{EventID: 3, GameID: 1, EventTime: 1250, EventType: int16(capture.Player), Payload: string(second)},
+		{EventID: 4, GameID: 1, EventTime: 1300, EventType: int16(capture.State), Payload: DiscussCode},
+	}
+
+	stats := StatsFromGameAndEvents(pgame, events)
+	if !stats.HasFirstKill {
+		t.Fatal("expected a first kill to be recorded")
+	}
+	if stats.FirstKillOffset != time.Second*95 {
+		t.Errorf("expected first blood at 1m35s, got %s", stats.FirstKillOffset)
+	}
+	if stats.LastEventOffset != time.Second*300 {
+		t.Errorf("expected the last event at 5m0s, got %s", stats.LastEventOffset)
+	}
+
+	embed := stats.ToDiscordEmbed("ABCDEF:1", settings.MakeGuildSettings())
+	found := false
+	for _, f := range embed.Fields {
+		if strings.Contains(f.Value, "First blood at 01:35") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the first blood time to be rendered in the embed")
+	}
+}
+
+func TestStatsFromGameAndEvents_FirstBloodAfterExile(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.ImpostorByKill), EndTime: 1600}
+	exiledDied, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Alice", Color: game.Red})
+	exiled, _ := json.Marshal(game.Player{Action: game.EXILED, Name: "Alice", Color: game.Red})
+	killed, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Bob", Color: game.Blue})
+	events := []*PostgresGameEvent{
+		{EventID: 1, GameID: 1, EventTime: 1000, EventType: int16(capture.State), Payload: TasksCode},
+		// Alice is voted out in the first meeting, before anyone is killed
+		{EventID: 2, GameID: 1, EventTime: 1030, EventType: int16(capture.State), Payload: DiscussCode},
+		{EventID: 3, GameID: 1, EventTime: 1060, EventType: int16(capture.Player), Payload: string(exiledDied)},
+		{EventID: 4, GameID: 1, EventTime: 1060, EventType: int16(capture.Player), Payload: string(exiled)},
+		{EventID: 5, GameID: 1, EventTime: 1070, EventType: int16(capture.State), Payload: TasksCode},
+		{EventID: 6, GameID: 1, EventTime: 1200, EventType: int16(capture.Player), Payload: string(killed)},
+	}
+
+	stats := StatsFromGameAndEvents(pgame, events)
+	if !stats.HasFirstKill {
+		t.Fatal("expected a first kill to be recorded")
+	}
+	if stats.FirstKillOffset != time.Second*200 {
+		t.Errorf("expected first blood at 3m20s (not the exile at 1m0s), got %s", stats.FirstKillOffset)
+	}
+
+	// a game whose only death is an exile has no first blood at all
+	stats = StatsFromGameAndEvents(pgame, events[:5])
+	if stats.HasFirstKill {
+		t.Errorf("expected no first kill when the only death was an exile, got one at %s", stats.FirstKillOffset)
+	}
+}
+
+func TestDeleteGame(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// every delete must be scoped to the target game
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM game_events WHERE game_id = (.+);$").
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 14))
+	mock.ExpectExec("^DELETE FROM users_games WHERE game_id = (.+);$").
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 8))
+	mock.ExpectExec("^DELETE FROM games WHERE game_id = (.+);$").
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectCommit()
+
+	err = deleteGame(mock, 2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReassignUserGames(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// the old account played 3 games, none of them alongside the new one
+	newUserIDInt := UserIDInt + 1
+	newUserID := fmt.Sprintf("%d", newUserIDInt)
+	oldGames := int64(3)
+
+	// events are moved before users_games, while the new account's existing games can still be told apart
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO users VALUES \\(\\$1, true, NULL\\) ON CONFLICT DO NOTHING;$").
+		WithArgs(newUserIDInt).
+		WillReturnResult(pgxmock.NewResult("INSERT", 0))
+	mock.ExpectExec("^UPDATE game_events SET user_id = \\$2 WHERE user_id = \\$1 AND game_id NOT IN (.+);$").
+		WithArgs(UserIDInt, newUserIDInt).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 7))
+	mock.ExpectExec("^UPDATE users_games SET user_id = \\$2 WHERE user_id = \\$1 AND game_id NOT IN (.+);$").
+		WithArgs(UserIDInt, newUserIDInt).
+		WillReturnResult(pgxmock.NewResult("UPDATE", oldGames))
+	mock.ExpectCommit()
+
+	moved, err := reassignUserGames(mock, UserID, newUserID)
+	if err != nil {
+		t.Error(err)
+	}
+	if moved != oldGames {
+		t.Errorf("expected %d games to be moved, got %d", oldGames, moved)
+	}
+
+	if _, err := reassignUserGames(mock, UserID, UserID); err == nil {
+		t.Error("expected an error when reassigning a user's games to itself")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteGame_NotFound(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM game_events WHERE game_id = (.+);$").
+		WithArgs(int64(404)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec("^DELETE FROM users_games WHERE game_id = (.+);$").
+		WithArgs(int64(404)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec("^DELETE FROM games WHERE game_id = (.+);$").
+		WithArgs(int64(404)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectRollback()
+
+	err = deleteGame(mock, 404)
+	if err == nil {
+		t.Error("expected an error when deleting a game that doesn't exist")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteAllGamesForUserOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// both statements must be scoped to the guild, so the user's rows on other guilds survive
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE game_events SET user_id = NULL WHERE user_id = (.+) AND game_id IN \\(SELECT game_id FROM games WHERE guild_id = (.+)\\);$").
+		WithArgs(UserID, GuildID).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 6))
+	mock.ExpectExec("^DELETE FROM users_games WHERE user_id = (.+) AND guild_id = (.+);$").
+		WithArgs(UserID, GuildID).
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+	mock.ExpectCommit()
+
+	err = deleteAllGamesForUserOnServer(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestImposterKillVoteRatioForServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^WITH style AS \\((.+)\\) SELECT user_id, total, kills, exiles, (.+) FROM style ORDER BY kill_ratio DESC, total DESC, user_id ASC;$").
+		WithArgs(GuildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player), "2", "6", 3).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"user_id", "total", "kills", "exiles", "kill_ratio"}).
+				AddRow(UserIDInt, int64(5), int64(9), int64(1), float64(90)).
+				AddRow(UserIDInt+1, int64(4), int64(2), int64(6), float64(25)))
+
+	r, err := imposterKillVoteRatioForServer(mock, GuildID, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("expected 2 ranked imposters, got %d", len(r))
+	}
+	if r[0].UserID != UserIDInt || r[0].Kills != 9 || r[0].Exiles != 1 || r[0].KillRatio != 90 {
+		t.Error("expected the kill-heavy imposter to rank first")
+	}
+	if r[1].UserID != UserIDInt+1 || r[1].Kills != 2 || r[1].Exiles != 6 || r[1].KillRatio != 25 {
+		t.Error("expected the vote-heavy imposter to rank last")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserWinTypeDistribution(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) AS count, games.win_type AS mode FROM users_games INNER JOIN games (.+) GROUP BY games.win_type;$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"count", "mode"}).
+				AddRow(int64(4), int16(game.HumansByTask)).
+				AddRow(int64(2), int16(game.ImpostorByKill)))
+
+	r, err := userWinTypeDistribution(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 {
+		t.Errorf("expected 2 win types, got %d", len(r))
+	}
+	if r[game.HumansByTask] != 4 {
+		t.Errorf("expected 4 HumansByTask games, got %d", r[game.HumansByTask])
+	}
+	if r[game.ImpostorByKill] != 2 {
+		t.Errorf("expected 2 ImpostorByKill games, got %d", r[game.ImpostorByKill])
+	}
+	if _, ok := r[game.HumansByVote]; ok {
+		t.Error("expected win types without games to be absent")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRoleWinBalanceOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	results := []game.GameResult{
+		game.HumansByTask, game.HumansByVote, game.HumansDisconnect,
+		game.ImpostorByKill, game.ImpostorByKill, game.ImpostorBySabotage, game.ImpostorByVote, game.ImpostorDisconnect,
+	}
+	var crew, imposter int64
+	for _, v := range results {
+		switch v {
+		case game.HumansByVote, game.HumansByTask, game.HumansDisconnect:
+			crew++
+		default:
+			imposter++
+		}
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FILTER (.+) AS crew_wins, COUNT\\(\\*\\) FILTER (.+) AS imposter_wins FROM games WHERE guild_id=\\$1 AND end_time != -1;$").
+		WithArgs(GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"crew_wins", "imposter_wins"}).AddRow(crew, imposter))
+
+	crewWins, imposterWins, err := roleWinBalanceOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if crewWins != 3 || imposterWins != 5 {
+		t.Errorf("expected 3 crewmate and 5 imposter wins, got %d and %d", crewWins, imposterWins)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNumSabotageWinsOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	results := []game.GameResult{game.ImpostorBySabotage, game.ImpostorByKill, game.ImpostorBySabotage, game.HumansByTask}
+	var sabotages int64
+	for _, v := range results {
+		if v == game.ImpostorBySabotage {
+			sabotages++
+		}
+	}
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM games WHERE guild_id=\\$1 AND win_type=\\$2 AND end_time != -1;$").
+		WithArgs(GuildID, int16(game.ImpostorBySabotage)).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(sabotages))
+
+	r, err := numSabotageWinsOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 2 {
+		t.Errorf("expected 2 sabotage wins, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserSabotageWins(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM users_games INNER JOIN games (.+) AND users_games.player_won = TRUE AND games.win_type = \\$4 AND games.end_time != -1;$").
+		WithArgs(UserID, GuildID, int16(game.ImposterRole), int16(game.ImpostorBySabotage)).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(3)))
+
+	r, err := userSabotageWins(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 3 {
+		t.Errorf("expected 3 sabotage wins, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserAchievedWinTypes(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// the user won by tasks and by kills, and lost an ImpostorByVote game, which must not be returned
+	type played struct {
+		winType game.GameResult
+		won     bool
+	}
+	games := []played{
+		{game.HumansByTask, true},
+		{game.ImpostorByKill, true},
+		{game.HumansByTask, true},
+		{game.ImpostorByVote, false},
+	}
+	rows := pgxmock.NewRows([]string{"win_type"})
+	seen := map[game.GameResult]bool{}
+	for _, v := range []game.GameResult{game.HumansByTask, game.ImpostorByKill, game.ImpostorByVote} {
+		for _, g := range games {
+			if g.winType == v && g.won && !seen[v] {
+				seen[v] = true
+				rows.AddRow(int16(v))
+			}
+		}
+	}
+	mock.ExpectQuery("^SELECT DISTINCT games.win_type FROM users_games INNER JOIN games (.+) AND users_games.player_won = TRUE ORDER BY games.win_type;$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(rows)
+
+	r, err := userAchievedWinTypes(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 || r[0] != game.HumansByTask || r[1] != game.ImpostorByKill {
+		t.Errorf("expected only the won win types, got %v", r)
+	}
+	for _, v := range r {
+		if v == game.ImpostorByVote {
+			t.Error("expected a win type the user only lost to be absent")
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestBatchUserWinStats(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// the third user hasn't played on the guild
+	userIDs := []string{UserID, fmt.Sprintf("%d", UserIDInt+1), fmt.Sprintf("%d", UserIDInt+2)}
+	mock.ExpectQuery("^SELECT user_id, COUNT\\(\\*\\) AS games, (.+) FROM users_games WHERE user_id = ANY\\(\\$1\\) AND guild_id = \\$2 GROUP BY user_id;$").
+		WithArgs([]uint64{UserIDInt, UserIDInt + 1, UserIDInt + 2}, GuildID).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"user_id", "games", "wins"}).
+				AddRow(UserIDInt, int64(10), int64(4)).
+				AddRow(UserIDInt+1, int64(3), int64(3)))
+
+	r, err := batchUserWinStats(mock, userIDs, GuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("expected stats for 2 users, got %d", len(r))
+	}
+	if v := r[userIDs[0]]; v == nil || v.Games != 10 || v.Wins != 4 {
+		t.Error("expected 4 wins in 10 games for the first user")
+	}
+	if v := r[userIDs[1]]; v == nil || v.Games != 3 || v.Wins != 3 {
+		t.Error("expected 3 wins in 3 games for the second user")
+	}
+	if _, ok := r[userIDs[2]]; ok {
+		t.Error("expected a user without games to be absent")
+	}
+
+	if _, err := batchUserWinStats(mock, []string{UserID, "abc"}, GuildID); err == nil {
+		t.Error("expected an error for an invalid user ID")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRolePreference(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FILTER \\( WHERE player_role = \\$3 \\) AS crew_games, COUNT\\(\\*\\) FILTER \\( WHERE player_role = \\$4 \\) AS imposter_games FROM users_games WHERE user_id=\\$1 AND guild_id=\\$2;$").
+		WithArgs(UserID, GuildID, int16(game.CrewmateRole), int16(game.ImposterRole)).
+		WillReturnRows(pgxmock.NewRows([]string{"crew_games", "imposter_games"}).AddRow(int64(17), int64(5)))
+
+	crew, imposter, err := rolePreference(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if crew != 17 || imposter != 5 {
+		t.Errorf("expected 17 crewmate and 5 imposter games, got %d and %d", crew, imposter)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FILTER").
+		WithArgs(UserID, GuildID, int16(game.CrewmateRole), int16(game.ImposterRole)).
+		WillReturnError(errors.New("connection reset"))
+	if _, _, err := rolePreference(mock, UserID, GuildID); err == nil {
+		t.Error("expected the query error to be returned")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserCurrentWinStreak(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM users_games INNER JOIN games (.+) AND games.start_time > COALESCE\\(\\(SELECT MAX\\(lost.start_time\\) (.+) lug.player_won = FALSE\\), -1\\);$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(4)))
+
+	r, err := userCurrentWinStreak(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 4 {
+		t.Errorf("expected a streak of 4, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNumKillsAsImposter(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(ge.event_id\\) FROM users_games imp (.+) WHERE imp.user_id = \\$1 AND imp.guild_id = \\$2 AND imp.player_role = \\$3 AND NOT EXISTS \\((.+)\\);$").
+		WithArgs(UserID, GuildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player), "2", "6").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(11)))
+
+	r, err := numKillsAsImposter(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 11 {
+		t.Errorf("expected 11 kills, got %d", r)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(ge.event_id\\) FROM users_games imp").
+		WithArgs(UserID, GuildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player), "2", "6").
+		WillReturnError(errors.New("connection reset"))
+	if _, err := numKillsAsImposter(mock, UserID, GuildID); err == nil {
+		t.Error("expected the query error to be returned")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMostCommonRoleOutcome(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// mostly winning crewmate games, with a few losses and a couple of imposter games
+	type outcome struct {
+		role int16
+		won  bool
+	}
+	games := []outcome{
+		{int16(game.CrewmateRole), true}, {int16(game.CrewmateRole), true}, {int16(game.CrewmateRole), true},
+		{int16(game.CrewmateRole), true}, {int16(game.CrewmateRole), false}, {int16(game.CrewmateRole), false},
+		{int16(game.ImposterRole), true}, {int16(game.ImposterRole), false},
+	}
+	counts := make(map[outcome]int64)
+	for _, g := range games {
+		counts[g]++
+	}
+	var top outcome
+	for o, c := range counts {
+		if c > counts[top] {
+			top = o
+		}
+	}
+
+	mock.ExpectQuery("^SELECT player_role, player_won, COUNT\\(\\*\\) AS count FROM users_games WHERE user_id=\\$1 AND guild_id=\\$2 GROUP BY player_role, player_won ORDER BY count DESC, player_role ASC, player_won DESC LIMIT 1;$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"player_role", "player_won", "count"}).AddRow(top.role, top.won, counts[top]))
+
+	role, won, count, err := mostCommonRoleOutcome(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if role != int16(game.CrewmateRole) || !won || count != 4 {
+		t.Errorf("expected 4 crewmate wins, got role %d, won %t, count %d", role, won, count)
+	}
+
+	mock.ExpectQuery("^SELECT player_role, player_won").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"player_role", "player_won", "count"}))
+
+	_, _, count, err = mostCommonRoleOutcome(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 0 {
+		t.Errorf("expected a count of 0 for a user without games, got %d", count)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMostActiveDayOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// UTC-5; three games late on the evening of 2023-11-14 local time (already the 15th in UTC) and one on the 16th
+	offset := -5 * 60
+	loc := time.FixedZone("", offset*60)
+	starts := []time.Time{
+		time.Date(2023, 11, 14, 20, 0, 0, 0, loc),
+		time.Date(2023, 11, 14, 21, 30, 0, 0, loc),
+		time.Date(2023, 11, 14, 23, 15, 0, 0, loc),
+		time.Date(2023, 11, 16, 12, 0, 0, 0, loc),
+	}
+	counts := map[int64]int64{}
+	for _, v := range starts {
+		counts[(v.Unix()+int64(offset*60))/86400]++
+	}
+	var busiest, most int64
+	for day, c := range counts {
+		if c > most {
+			busiest, most = day, c
+		}
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) AS count, FLOOR\\(\\(start_time \\+ \\$2 \\* 60\\) / 86400.0\\)::bigint AS mode FROM games WHERE guild_id=\\$1 AND end_time != -1 GROUP BY mode ORDER BY count DESC, mode ASC LIMIT 1;$").
+		WithArgs(GuildID, offset).
+		WillReturnRows(pgxmock.NewRows([]string{"count", "mode"}).AddRow(most, busiest))
+
+	day, count, err := mostActiveDayOnServer(mock, GuildID, offset)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 games on the busiest day, got %d", count)
+	}
+	if !day.Equal(time.Date(2023, 11, 14, 0, 0, 0, 0, loc)) {
+		t.Errorf("expected the busiest day to be 2023-11-14 local time, got %s", day)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) AS count, (.+) LIMIT 1;$").
+		WithArgs(GuildID, offset).
+		WillReturnRows(pgxmock.NewRows([]string{"count", "mode"}))
+
+	day, count, err = mostActiveDayOnServer(mock, GuildID, offset)
+	if err != nil {
+		t.Error(err)
+	}
+	if !day.IsZero() || count != 0 {
+		t.Error("expected zero values for a guild without games")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMeetingsExperiencedByUser(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// two games with two and three meetings; the tasks phases in between aren't meetings
+	events := [][]string{
+		{TasksCode, DiscussCode, TasksCode, DiscussCode, TasksCode},
+		{TasksCode, DiscussCode, TasksCode, DiscussCode, TasksCode, DiscussCode},
+	}
+	var meetings int64
+	for _, g := range events {
+		for _, payload := range g {
+			if payload == DiscussCode {
+				meetings++
+			}
+		}
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(ge.event_id\\) FROM users_games INNER JOIN games (.+) INNER JOIN game_events ge (.+) WHERE users_games.user_id = \\$1 AND users_games.guild_id = \\$2 AND games.end_time != -1;$").
+		WithArgs(UserID, GuildID, int16(capture.State), DiscussCode).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(meetings))
+
+	r, err := meetingsExperiencedByUser(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 5 {
+		t.Errorf("expected 5 meetings, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeathPhaseBreakdown(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	eventColumns := []string{"event_id", "user_id", "game_id", "event_time", "event_type", "payload"}
+	user := UserIDInt
+	// game 1: killed during tasks; game 2: exiled at a meeting (an EXILED and a DIED event, only counted once);
+	// game 3: died before any phase change, so it isn't counted
+	mock.ExpectQuery("^SELECT game_events.\\* FROM game_events INNER JOIN users_games (.+) INNER JOIN games (.+) WHERE users_games.user_id = \\$1 AND users_games.guild_id = \\$2 AND games.end_time != -1 AND (.+) ORDER BY game_events.game_id ASC, game_events.event_time ASC, game_events.event_id ASC;$").
+		WithArgs(UserID, GuildID, int16(capture.State), int16(capture.Player), "2", "6").
+		WillReturnRows(pgxmock.NewRows(eventColumns).
+			AddRow(uint64(1), nil, int64(1), int32(1000), int16(capture.State), TasksCode).
+			AddRow(uint64(2), &user, int64(1), int32(1100), int16(capture.Player), `{"Action":2}`).
+			AddRow(uint64(3), nil, int64(1), int32(1200), int16(capture.State), DiscussCode).
+			AddRow(uint64(4), nil, int64(2), int32(2000), int16(capture.State), TasksCode).
+			AddRow(uint64(5), nil, int64(2), int32(2100), int16(capture.State), DiscussCode).
+			AddRow(uint64(6), &user, int64(2), int32(2150), int16(capture.Player), `{"Action":6}`).
+			AddRow(uint64(7), &user, int64(2), int32(2150), int16(capture.Player), `{"Action":2}`).
+			AddRow(uint64(8), nil, int64(2), int32(2160), int16(capture.State), TasksCode).
+			AddRow(uint64(9), &user, int64(3), int32(3000), int16(capture.Player), `{"Action":2}`).
+			AddRow(uint64(10), nil, int64(3), int32(3010), int16(capture.State), TasksCode))
+
+	duringTasks, duringMeetings, err := deathPhaseBreakdown(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if duringTasks != 1 || duringMeetings != 1 {
+		t.Errorf("expected 1 death during tasks and 1 during a meeting, got %d and %d", duringTasks, duringMeetings)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLongestInGameKillStreak(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	death := func(name string, action game.PlayerAction) string {
+		b, _ := json.Marshal(game.Player{Action: action, Name: name})
+		return string(b)
+	}
+	eventColumns := []string{"event_id", "user_id", "game_id", "event_time", "event_type", "payload"}
+	// 2 kills, a meeting exiling Dave (recorded as a death too), then 3 kills; game 2 has a payload that can't be read,
+	// which is skipped rather than failing the whole history
+	mock.ExpectQuery("^SELECT game_events.\\* FROM game_events INNER JOIN users_games (.+) INNER JOIN games (.+) AND game_events.event_type IN \\(\\$4, \\$5\\) ORDER BY game_events.game_id ASC, game_events.event_time ASC, game_events.event_id ASC;$").
+		WithArgs(UserID, GuildID, int16(game.ImposterRole), int16(capture.State), int16(capture.Player)).
+		WillReturnRows(pgxmock.NewRows(eventColumns).
+			AddRow(uint64(1), nil, int64(1), int32(1000), int16(capture.State), TasksCode).
+			AddRow(uint64(2), nil, int64(1), int32(1050), int16(capture.Player), death("Alice", game.DIED)).
+			AddRow(uint64(3), nil, int64(1), int32(1100), int16(capture.Player), death("Bob", game.DIED)).
+			AddRow(uint64(4), nil, int64(1), int32(1200), int16(capture.State), DiscussCode).
+			AddRow(uint64(5), nil, int64(1), int32(1250), int16(capture.Player), death("Dave", game.EXILED)).
+			AddRow(uint64(6), nil, int64(1), int32(1250), int16(capture.Player), death("Dave", game.DIED)).
+			AddRow(uint64(7), nil, int64(1), int32(1260), int16(capture.State), TasksCode).
+			AddRow(uint64(8), nil, int64(1), int32(1300), int16(capture.Player), death("Erin", game.DIED)).
+			AddRow(uint64(9), nil, int64(1), int32(1350), int16(capture.Player), death("Frank", game.DIED)).
+			AddRow(uint64(10), nil, int64(1), int32(1400), int16(capture.Player), death("Grace", game.DIED)).
+			AddRow(uint64(11), nil, int64(2), int32(2000), int16(capture.State), TasksCode).
+			AddRow(uint64(12), nil, int64(2), int32(2100), int16(capture.Player), death("Alice", game.DIED)).
+			AddRow(uint64(13), nil, int64(2), int32(2150), int16(capture.Player), `{"Action":2,"Name":`))
+
+	r, err := longestInGameKillStreak(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 3 {
+		t.Errorf("expected a longest streak of 3 kills, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNumClutchWins(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// what makes a clutch is all in the SQL, so pin every clause of it: the user won as a crewmate without being
+	// removed, there was another crewmate, and every other crewmate was removed before the end
+	query := "SELECT COUNT(*) " +
+		"FROM users_games " +
+		"INNER JOIN games ON games.game_id = users_games.game_id " +
+		"WHERE users_games.user_id = $1 AND users_games.guild_id = $2 AND users_games.player_role = $3 " +
+		"AND users_games.player_won = TRUE AND games.end_time != -1 " +
+		"AND NOT EXISTS (" +
+		"SELECT 1 FROM game_events me WHERE me.game_id = users_games.game_id AND me.user_id = users_games.user_id " +
+		"AND me.event_type = $4 AND me.payload ->> 'Action' IN ($5, $6) AND me.event_time <= games.end_time" +
+		") " +
+		"AND EXISTS (" +
+		"SELECT 1 FROM users_games others WHERE others.game_id = users_games.game_id AND others.player_role = $3 " +
+		"AND others.user_id <> users_games.user_id" +
+		") " +
+		"AND NOT EXISTS (" +
+		"SELECT 1 FROM users_games alive WHERE alive.game_id = users_games.game_id AND alive.player_role = $3 " +
+		"AND alive.user_id <> users_games.user_id AND NOT EXISTS (" +
+		"SELECT 1 FROM game_events ge WHERE ge.game_id = alive.game_id AND ge.user_id = alive.user_id " +
+		"AND ge.event_type = $4 AND ge.payload ->> 'Action' IN ($5, $6) AND ge.event_time <= games.end_time" +
+		")" +
+		");"
+	mock.ExpectQuery("^"+regexp.QuoteMeta(query)+"$").
+		WithArgs(UserID, GuildID, int16(game.CrewmateRole), int16(capture.Player), "2", "6").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(1)))
+
+	r, err := numClutchWins(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 1 {
+		t.Errorf("expected 1 clutch win, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestKillsPerImposterGame(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM users_games WHERE user_id=\\$1 AND guild_id=\\$2 AND player_role=\\$3;$").
+		WithArgs(UserID, GuildID, int16(game.ImposterRole)).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(2)))
+	mock.ExpectQuery("^SELECT COUNT\\(ge.event_id\\) FROM users_games imp").
+		WithArgs(UserID, GuildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player), "2", "6").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(4)))
+
+	r, err := killsPerImposterGame(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 2.0 {
+		t.Errorf("expected 2.0 kills per game, got %f", r)
+	}
+
+	// never an imposter; the kill count isn't even queried
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM users_games WHERE user_id=\\$1 AND guild_id=\\$2 AND player_role=\\$3;$").
+		WithArgs(UserID, GuildID, int16(game.ImposterRole)).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(0)))
+
+	r, err = killsPerImposterGame(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 0 {
+		t.Errorf("expected 0 for a user who was never an imposter, got %f", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDurationHistogramOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	buckets := []time.Duration{5 * time.Minute, 10 * time.Minute, 15 * time.Minute}
+	bounds := []int64{300, 600, 900}
+	lengths := []int64{120, 299, 300, 480, 720, 900, 1500, 2000}
+	counts := map[int64]int64{}
+	for _, l := range lengths {
+		bin := int64(0)
+		for _, b := range bounds {
+			if l >= b {
+				bin++
+			}
+		}
+		counts[bin]++
+	}
+	rows := pgxmock.NewRows([]string{"count", "mode"})
+	for bin, c := range counts {
+		rows.AddRow(c, bin)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) AS count, width_bucket\\(\\(end_time - start_time\\)::bigint, \\$2::bigint\\[\\]\\)::bigint AS mode FROM games WHERE guild_id=\\$1 AND end_time != -1 GROUP BY mode;$").
+		WithArgs(GuildID, bounds).
+		WillReturnRows(rows)
+
+	r, err := durationHistogramOnServer(mock, GuildID, buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{2, 2, 1, 3}
+	if len(r) != len(expected) {
+		t.Fatalf("expected %d bins, got %d", len(expected), len(r))
+	}
+	for i := range expected {
+		if r[i] != expected[i] {
+			t.Errorf("expected %d games in bin %d, got %d", expected[i], i, r[i])
+		}
+	}
+
+	if _, err := durationHistogramOnServer(mock, GuildID, []time.Duration{10 * time.Minute, 5 * time.Minute}); err == nil {
+		t.Error("expected an error for descending boundaries")
+	}
+	if _, err := durationHistogramOnServer(mock, GuildID, nil); err == nil {
+		t.Error("expected an error without any boundaries")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestServerGameTimeRange(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	starts := []int64{1_650_000_000, 1_600_000_000, 1_700_000_000}
+	first, last := starts[0], starts[0]
+	for _, v := range starts {
+		if v < first {
+			first = v
+		}
+		if v > last {
+			last = v
+		}
+	}
+	mock.ExpectQuery("^SELECT MIN\\(start_time\\)::bigint AS first, MAX\\(start_time\\)::bigint AS last FROM games WHERE guild_id=\\$1 AND end_time != -1;$").
+		WithArgs(GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"first", "last"}).AddRow(&first, &last))
+
+	f, l, err := serverGameTimeRange(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if !f.Equal(time.Unix(1_600_000_000, 0)) || !l.Equal(time.Unix(1_700_000_000, 0)) {
+		t.Errorf("expected the earliest and latest start times, got %s and %s", f, l)
+	}
+
+	mock.ExpectQuery("^SELECT MIN\\(start_time\\)::bigint AS first").
+		WithArgs(GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"first", "last"}).AddRow(nil, nil))
+
+	f, l, err = serverGameTimeRange(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if !f.IsZero() || !l.IsZero() {
+		t.Error("expected zero times for a guild without games")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNumGamesOnServerSince(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	since := now.Add(-7 * 24 * time.Hour)
+	// two games inside the window, one from the week before, and one still in progress
+	starts := []int64{now.Add(-time.Hour).Unix(), since.Unix(), since.Add(-time.Second).Unix(), now.Unix()}
+	ends := []int64{now.Unix(), since.Add(time.Hour).Unix(), since.Unix(), -1}
+	var expected int64
+	for i := range starts {
+		if starts[i] >= since.Unix() && ends[i] != -1 {
+			expected++
+		}
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM games WHERE guild_id=\\$1 AND start_time >= \\$2 AND end_time != -1;$").
+		WithArgs(GuildID, since.Unix()).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(expected))
+
+	r, err := numGamesOnServerSince(mock, GuildID, since)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 2 {
+		t.Errorf("expected 2 games in the window, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTotalWinRankingForServer_TieBreak(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// both users have a 50% win rate over 4 games; only the user_id tie-break orders them
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) FROM users_games WHERE users_games.guild_id = \\$1 GROUP BY user_id ORDER BY win_rate DESC, total DESC, user_id ASC$").
+		WithArgs(GuildIDInt).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"user_id", "win", "total", "win_rate"}).
+				AddRow(UserIDInt, int64(2), int64(4), float64(50)).
+				AddRow(UserIDInt+1, int64(2), int64(4), float64(50)))
+
+	r, err := totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 || r[0].UserID != UserIDInt || r[1].UserID != UserIDInt+1 {
+		t.Error("expected users with equal win rates and totals to be ordered by ascending user_id")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNumCloseGamesOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	crew, imp := int16(game.CrewmateRole), int16(game.ImposterRole)
+	// game 1 (close): two imposters, one exiled earlier, so only the second remained when the final vote happened
+	// game 2 (blowout): imposters won by kill while three crewmates were still alive before the final kill
+	// game 3 (close): one crewmate was killed, then the last one was voted off
+	// every exile is recorded as a DIED and an EXILED event, in either order
+	players := pgxmock.NewRows([]string{"game_id", "user_id", "player_role", "win_type"})
+	for _, p := range []struct {
+		game int64
+		user uint64
+		role int16
+		win  game.GameResult
+	}{
+		{1, 1, imp, game.HumansByVote}, {1, 2, imp, game.HumansByVote}, {1, 3, crew, game.HumansByVote}, {1, 4, crew, game.HumansByVote},
+		{2, 1, imp, game.ImpostorByKill}, {2, 2, crew, game.ImpostorByKill}, {2, 3, crew, game.ImpostorByKill}, {2, 4, crew, game.ImpostorByKill},
+		{3, 1, imp, game.ImpostorByVote}, {3, 2, crew, game.ImpostorByVote}, {3, 3, crew, game.ImpostorByVote},
+	} {
+		players.AddRow(p.game, p.user, p.role, int16(p.win))
+	}
+	mock.ExpectQuery("^SELECT users_games.game_id, users_games.user_id, users_games.player_role, games.win_type FROM users_games (.+);$").
+		WithArgs(GuildID, int16(game.HumansByVote), int16(game.ImpostorByKill), int16(game.ImpostorByVote)).
+		WillReturnRows(players)
+	mock.ExpectQuery("^SELECT ge.game_id, ge.user_id FROM game_events ge (.+) ORDER BY ge.game_id, ge.event_id;$").
+		WithArgs(GuildID, int16(game.HumansByVote), int16(game.ImpostorByKill), int16(game.ImpostorByVote), int16(capture.Player), "2", "6").
+		WillReturnRows(
+			pgxmock.NewRows([]string{"game_id", "user_id"}).
+				AddRow(int64(1), uint64(3)).
+				AddRow(int64(1), uint64(1)).
+				AddRow(int64(1), uint64(1)).
+				AddRow(int64(1), uint64(2)).
+				AddRow(int64(1), uint64(2)).
+				AddRow(int64(2), uint64(2)).
+				AddRow(int64(3), uint64(2)).
+				AddRow(int64(3), uint64(3)).
+				AddRow(int64(3), uint64(3)))
+
+	r, err := numCloseGamesOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 2 {
+		t.Errorf("expected 2 close games, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGameStatistics_ToDiscordEmbed_Footer(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.HumansByTask), EndTime: 1600}
+	stats := StatsFromGameAndEvents(pgame, nil)
+	sett := settings.MakeGuildSettings()
+
+	embed := stats.ToDiscordEmbed("ABCDEF:1", sett)
+	if embed.Footer == nil || !strings.Contains(embed.Footer.Text, "ABCDEF:1") {
+		t.Fatal("expected the footer to contain the match ID")
+	}
+	if embed.Timestamp != time.Unix(1600, 0).UTC().Format(time.RFC3339) {
+		t.Errorf("expected the embed timestamp to be the game end time, got %q", embed.Timestamp)
+	}
+
+	sett.SetShowMatchFooter(false)
+	embed = stats.ToDiscordEmbed("ABCDEF:1", sett)
+	if embed.Footer != nil || embed.Timestamp != "" {
+		t.Error("expected no footer or timestamp when the footer is turned off")
+	}
+}
+
+func TestGameStatistics_ToDiscordEmbed_URL(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.HumansByTask), EndTime: 1600}
+	stats := StatsFromGameAndEvents(pgame, nil)
+	sett := settings.MakeGuildSettings()
+
+	if embed := stats.ToDiscordEmbed("ABCDEF:1", sett); embed.URL != "" {
+		t.Errorf("expected no URL without a template, got %q", embed.URL)
+	}
+
+	if err := sett.SetMatchURLTemplate("https://example.com/match/{{.MatchID}}"); err != nil {
+		t.Fatal(err)
+	}
+	if embed := stats.ToDiscordEmbed("ABCDEF:1", sett); embed.URL != "https://example.com/match/ABCDEF:1" {
+		t.Errorf("expected the expanded match URL, got %q", embed.URL)
+	}
+}
+
+func TestGameStatistics_ToDiscordEmbed_RelativeTimes(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.HumansByTask), EndTime: 1600}
+	stats := StatsFromGameAndEvents(pgame, nil)
+	sett := settings.MakeGuildSettings()
+
+	for _, f := range stats.ToDiscordEmbed("ABCDEF:1", sett).Fields {
+		if strings.Contains(f.Value, "<t:") {
+			t.Errorf("expected no relative timestamps by default, got %q", f.Value)
+		}
+	}
+
+	sett.SetRelativeMatchTimes(true)
+	embed := stats.ToDiscordEmbed("ABCDEF:1", sett)
+	if len(embed.Fields) == 0 || !strings.Contains(embed.Fields[0].Value, "Started <t:1000:R>, ended <t:1600:R>") {
+		t.Errorf("expected relative start and end timestamps, got %v", embed.Fields)
+	}
+}
+
+func TestGameStatistics_ToDiscordEmbed_Compact(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.ImpostorByKill), EndTime: 1600}
+	died, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Alice", Color: game.Red})
+	events := []*PostgresGameEvent{
+		{EventID: 1, GameID: 1, EventTime: 1000, EventType: int16(capture.State), Payload: TasksCode},
+		{EventID: 2, GameID: 1, EventTime: 1095, EventType: int16(capture.Player), Payload: string(died)},
+		{EventID: 3, GameID: 1, EventTime: 1300, EventType: int16(capture.State), Payload: DiscussCode},
+		{EventID: 4, GameID: 1, EventTime: 1360, EventType: int16(capture.State), Payload: TasksCode},
+	}
+	stats := StatsFromGameAndEvents(pgame, events)
+	sett := settings.MakeGuildSettings()
+
+	full := stats.ToDiscordEmbed("ABCDEF:1", sett)
+	sett.SetCompactMatchEmbed(true)
+	compact := stats.ToDiscordEmbed("ABCDEF:1", sett)
+
+	if len(compact.Fields) >= len(full.Fields) {
+		t.Errorf("expected the compact embed to have fewer fields than %d, got %d", len(full.Fields), len(compact.Fields))
+	}
+	for _, s := range []string{"10m0s", "1 meeting,", "1 death ", "First blood at 01:35", "\"Alice\" Died"} {
+		if !strings.Contains(compact.Description, s) {
+			t.Errorf("expected the compact description to contain %q", s)
+		}
+	}
+	if compact.Footer == nil || compact.Title != full.Title {
+		t.Error("expected the compact embed to keep the title and footer")
+	}
+}
+
+func TestStatsFromGameAndEvents_PlayersFromEvents(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.ImpostorByKill), EndTime: 1600}
+	joined, _ := json.Marshal(game.Player{Action: game.JOINED, Name: "Bob", Color: game.Blue})
+	died, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Alice", Color: game.Red})
+	// no users_games rows exist for this game; only events
+	events := []*PostgresGameEvent{
+		{EventID: 1, GameID: 1, EventTime: 1000, EventType: int16(capture.Player), Payload: string(joined)},
+		{EventID: 2, GameID: 1, EventTime: 1001, EventType: int16(capture.State), Payload: TasksCode},
+		{EventID: 3, GameID: 1, EventTime: 1095, EventType: int16(capture.Player), Payload: string(died)},
+		{EventID: 4, GameID: 1, EventTime: 1200, EventType: int16(capture.Player), Payload: string(joined)},
+	}
+
+	stats := StatsFromGameAndEvents(pgame, events)
+	if stats.NumPlayers != 2 {
+		t.Errorf("expected 2 distinct players from the events, got %d", stats.NumPlayers)
+	}
+	embed := stats.ToDiscordEmbed("ABCDEF:1", settings.MakeGuildSettings())
+	if !strings.Contains(embed.Description, "2 players took part") {
+		t.Error("expected the player count derived from events in the embed")
+	}
+
+	// with nothing to count players from, the line is left out rather than claiming 0 players
+	empty := StatsFromGameAndEvents(pgame, nil)
+	if strings.Contains(empty.ToDiscordEmbed("ABCDEF:1", settings.MakeGuildSettings()).Description, "players took part") {
+		t.Error("expected no player count without any player events")
+	}
+}
+
+func TestGameStatistics_FormatCounts(t *testing.T) {
+	sett := settings.MakeGuildSettings()
+
+	one := GameStatistics{NumMeetings: 1, NumDeaths: 1, NumVotedOff: 0}
+	if got := one.FormatCounts(sett); got != "1 meeting, 1 death (0 voted off, 1 kill)" {
+		t.Errorf("unexpected singular counts: %q", got)
+	}
+	two := GameStatistics{NumMeetings: 2, NumDeaths: 3, NumVotedOff: 1}
+	if got := two.FormatCounts(sett); got != "2 meetings, 3 deaths (1 voted off, 2 kills)" {
+		t.Errorf("unexpected plural counts: %q", got)
+	}
+
+	embed := two.ToDiscordEmbed("ABCDEF:1", sett)
+	if !strings.Contains(embed.Description, "2 meetings, 3 deaths (1 voted off, 2 kills)") {
+		t.Error("expected the pluralized counts in the embed description")
+	}
+}
+
+func TestGameStatistics_ToDiscordEmbed_HidePlayerNames(t *testing.T) {
+	stats := GameStatistics{
+		Events: []SimpleEvent{
+			{EventType: PlayerDeath, EventTimeOffset: 30 * time.Second, Data: `{"Action":2,"Name":"SecretName","Color":0}`},
+		},
+	}
+	sett := settings.MakeGuildSettings()
+	if !sett.GetShowPlayerNames() {
+		t.Fatal("expected player names to be shown by default")
+	}
+
+	embed := stats.ToDiscordEmbed("ABCDEF:1", sett)
+	if len(embed.Fields) != 1 || !strings.Contains(embed.Fields[0].Value, "SecretName") {
+		t.Error("expected the player's name in the embed by default")
+	}
+
+	sett.SetShowPlayerNames(false)
+	embed = stats.ToDiscordEmbed("ABCDEF:1", sett)
+	for _, f := range embed.Fields {
+		if strings.Contains(f.Name, "SecretName") || strings.Contains(f.Value, "SecretName") {
+			t.Errorf("expected the player's name to be omitted, got field %q: %q", f.Name, f.Value)
+		}
+	}
+	if len(embed.Fields) != 1 || !strings.Contains(embed.Fields[0].Value, "A player died") {
+		t.Error("expected the death to still be shown without the name")
+	}
+}
+
+func TestGameStatistics_ToDiscordEmbed_MalformedPlayer(t *testing.T) {
+	stats := GameStatistics{
+		Events: []SimpleEvent{
+			{EventType: PlayerDeath, EventTimeOffset: 30 * time.Second, Data: `{"Action":2,"Name":`},
+		},
+	}
+
+	embed := stats.ToDiscordEmbed("ABCDEF:1", settings.MakeGuildSettings())
+	if len(embed.Fields) != 1 {
+		t.Fatalf("expected the death to still have a field, got %d fields", len(embed.Fields))
+	}
+	if embed.Fields[0].Name != (30*time.Second).String() || !strings.Contains(embed.Fields[0].Value, "A player died") {
+		t.Errorf("expected a generic death line, got %q: %q", embed.Fields[0].Name, embed.Fields[0].Value)
+	}
+	if !strings.Contains(stats.ToString(), "30s into the game, a player died") {
+		t.Errorf("expected a generic death line in the text summary, got %q", stats.ToString())
+	}
+}
+
+func TestStatsFromGameAndEvents_MalformedPayload(t *testing.T) {
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.ImpostorByKill), EndTime: 1600}
+	died, _ := json.Marshal(game.Player{Action: game.DIED, Name: "Alice", Color: game.Red})
+	events := []*PostgresGameEvent{
+		{EventID: 1, GameID: 1, EventTime: 1000, EventType: int16(capture.State), Payload: TasksCode},
+		{EventID: 2, GameID: 1, EventTime: 1100, EventType: int16(capture.Player), Payload: `{"Action":2,"Name":`},
+		{EventID: 3, GameID: 1, EventTime: 1200, EventType: int16(capture.Player), Payload: string(died)},
+	}
+
+	stats := StatsFromGameAndEvents(pgame, events)
+	if len(stats.PayloadErrors) != 1 {
+		t.Errorf("expected the unreadable payload to be reported, got %d errors", len(stats.PayloadErrors))
+	}
+	if stats.NumDeaths != 1 {
+		t.Errorf("expected only the readable death to be counted, got %d", stats.NumDeaths)
+	}
+}
+
+func TestAverageMeetingsBeforeEndOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// one game with two meetings and one won before anyone called a meeting
+	pgame := &PostgresGame{GameID: 1, GuildID: GuildIDInt, StartTime: 1000, WinType: int16(game.ImpostorByKill), EndTime: 1600}
+	games := [][]*PostgresGameEvent{
+		{
+			{EventID: 1, GameID: 1, EventTime: 1000, EventType: int16(capture.State), Payload: TasksCode},
+			{EventID: 2, GameID: 1, EventTime: 1200, EventType: int16(capture.State), Payload: DiscussCode},
+			{EventID: 3, GameID: 1, EventTime: 1260, EventType: int16(capture.State), Payload: TasksCode},
+			{EventID: 4, GameID: 1, EventTime: 1400, EventType: int16(capture.State), Payload: DiscussCode},
+			{EventID: 5, GameID: 1, EventTime: 1460, EventType: int16(capture.State), Payload: TasksCode},
+		},
+		{
+			{EventID: 6, GameID: 1, EventTime: 1000, EventType: int16(capture.State), Payload: TasksCode},
+			{EventID: 7, GameID: 1, EventTime: 1300, EventType: int16(capture.State), Payload: TasksCode},
+		},
+	}
+	total := 0
+	for _, events := range games {
+		stats := StatsFromGameAndEvents(pgame, events)
+		total += stats.NumMeetings
+	}
+	mock.ExpectQuery("^SELECT COALESCE\\(AVG\\(meetings\\), 0\\) FROM \\(SELECT COUNT\\(ge.event_id\\) AS meetings FROM games LEFT JOIN game_events ge (.+) GROUP BY games.game_id\\) per_game;$").
+		WithArgs(GuildID, int16(capture.State), DiscussCode).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(float64(total) / float64(len(games))))
+
+	r, err := averageMeetingsBeforeEndOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 1.0 {
+		t.Errorf("expected an average of 1.0 meetings, got %f", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestModePlayerCountOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	lobbies := []int64{10, 10, 10, 8, 6, 10}
+	counts := make(map[int64]int)
+	var mode int64
+	for _, v := range lobbies {
+		counts[v]++
+		if counts[v] > counts[mode] {
+			mode = v
+		}
+	}
+	mock.ExpectQuery("^SELECT COALESCE\\(mode\\(\\) WITHIN GROUP \\(ORDER BY players\\), 0\\) FROM \\(SELECT COUNT\\(\\*\\) AS players (.+) GROUP BY users_games.game_id\\) per_game;$").
+		WithArgs(GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(mode))
+
+	r, err := modePlayerCountOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 10 {
+		t.Errorf("expected 10 players to be the most common lobby size, got %d", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAveragePlayersPerGameOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	lobbies := []int{4, 10}
+	total := 0
+	for _, v := range lobbies {
+		total += v
+	}
+	mock.ExpectQuery("^SELECT COALESCE\\(AVG\\(players\\), 0\\) FROM \\(SELECT COUNT\\(\\*\\) AS players (.+) GROUP BY users_games.game_id\\) per_game;$").
+		WithArgs(GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(float64(total) / float64(len(lobbies))))
+	mock.ExpectQuery("^SELECT COALESCE\\(AVG\\(players\\), 0\\) (.+)$").
+		WithArgs(GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(float64(0)))
+
+	r, err := averagePlayersPerGameOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 7.0 {
+		t.Errorf("expected an average of 7.0 players, got %f", r)
+	}
+
+	r, err = averagePlayersPerGameOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 0 {
+		t.Errorf("expected 0 for a server without games, got %f", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTotalWinRankingForServer_ExcludeDisconnects(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// user 1 won 3 of 4 games, but 2 of those wins came from the imposters disconnecting; user 2 won 2 of 3 legitimately
+	columns := []string{"user_id", "win", "total", "win_rate"}
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) FROM users_games WHERE users_games.guild_id = \\$1 GROUP BY user_id (.+)$").
+		WithArgs(GuildIDInt).
+		WillReturnRows(
+			pgxmock.NewRows(columns).
+				AddRow(UserIDInt, int64(3), int64(4), float64(75)).
+				AddRow(UserIDInt+1, int64(2), int64(3), float64(200)/3))
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) FROM users_games INNER JOIN games ON games.game_id = users_games.game_id AND games.win_type NOT IN \\(\\$2, \\$3\\) WHERE users_games.guild_id = \\$1 GROUP BY user_id (.+)$").
+		WithArgs(GuildIDInt, int16(game.HumansDisconnect), int16(game.ImpostorDisconnect)).
+		WillReturnRows(
+			pgxmock.NewRows(columns).
+				AddRow(UserIDInt+1, int64(2), int64(3), float64(200)/3).
+				AddRow(UserIDInt, int64(1), int64(2), float64(50)))
+
+	all, err := totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	competitive, err := totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{ExcludeDisconnects: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(all) != 2 || all[0].UserID != UserIDInt {
+		t.Error("expected user 1 to lead when disconnect games are counted")
+	}
+	if len(competitive) != 2 || competitive[0].UserID != UserIDInt+1 || competitive[1].Count != 2 {
+		t.Error("expected user 2 to lead, and user 1's disconnect games to be dropped, when they're excluded")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTotalWinRankingForServer_MinPlayers(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// user 1 won a 4 player game and lost a 6 player one; with minPlayers=6 only the loss counts
+	columns := []string{"user_id", "win", "total", "win_rate"}
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) FROM users_games WHERE users_games.guild_id = \\$1 AND users_games.game_id IN \\(SELECT game_id FROM users_games WHERE guild_id = \\$1 GROUP BY game_id HAVING COUNT\\(\\*\\) >= \\$2\\) GROUP BY user_id (.+)$").
+		WithArgs(GuildIDInt, 6).
+		WillReturnRows(
+			pgxmock.NewRows(columns).
+				AddRow(UserIDInt, int64(0), int64(1), float64(0)))
+	// combined with ExcludeDisconnects, the floor's placeholder comes after the win types
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) NOT IN \\(\\$2, \\$3\\) (.+) HAVING COUNT\\(\\*\\) >= \\$4\\) GROUP BY user_id (.+)$").
+		WithArgs(GuildIDInt, int16(game.HumansDisconnect), int16(game.ImpostorDisconnect), 6).
+		WillReturnRows(pgxmock.NewRows(columns))
+
+	r, err := totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{MinPlayers: 6})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 1 || r[0].Count != 1 || r[0].WinCount != 0 {
+		t.Error("expected the 4 player game to be excluded")
+	}
+	if _, err := totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{MinPlayers: 6, ExcludeDisconnects: true}); err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGuildsPlayedInByUser(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	guilds := []uint64{GuildIDInt, GuildIDInt + 1, GuildIDInt + 2}
+	rows := pgxmock.NewRows([]string{"guild_id"})
+	for _, g := range guilds {
+		rows.AddRow(g)
+	}
+	mock.ExpectQuery("^SELECT DISTINCT guild_id FROM users_games WHERE user_id=\\$1 ORDER BY guild_id ASC;$").
+		WithArgs(UserID).
+		WillReturnRows(rows)
+	mock.ExpectQuery("^SELECT DISTINCT guild_id FROM users_games (.+)$").
+		WithArgs("1").
+		WillReturnRows(pgxmock.NewRows([]string{"guild_id"}))
+
+	r, err := guildsPlayedInByUser(mock, UserID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != len(guilds) {
+		t.Fatalf("expected %d guilds, got %d", len(guilds), len(r))
+	}
+	for i, g := range guilds {
+		if r[i] != g {
+			t.Errorf("expected guild %d at index %d, got %d", g, i, r[i])
+		}
+	}
+
+	r, err = guildsPlayedInByUser(mock, "1")
+	if err != nil {
+		t.Error(err)
+	}
+	if r == nil || len(r) != 0 {
+		t.Error("expected an empty, non-nil slice for a user without games")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLuckiestColorOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// red won 3 of 4 games and blue 1 of 4
+	type played struct {
+		color int16
+		won   bool
+	}
+	games := []played{
+		{game.Red, true}, {game.Red, true}, {game.Red, true}, {game.Red, false},
+		{game.Blue, true}, {game.Blue, false}, {game.Blue, false}, {game.Blue, false},
+	}
+	totals := make(map[int16]int)
+	wins := make(map[int16]int)
+	for _, g := range games {
+		totals[g.color]++
+		if g.won {
+			wins[g.color]++
+		}
+	}
+	rate := func(c int16) float64 {
+		return float64(wins[c]) / float64(totals[c]) * 100
+	}
+	best := int16(game.Blue)
+	if rate(game.Red) > rate(game.Blue) {
+		best = game.Red
+	}
+
+	mock.ExpectQuery("^SELECT player_color AS color, (.+) AS win_rate FROM users_games WHERE guild_id=\\$1 GROUP BY player_color HAVING COUNT\\(\\*\\) >= \\$2 ORDER BY win_rate DESC, COUNT\\(\\*\\) DESC, color ASC LIMIT 1;$").
+		WithArgs(GuildID, 3).
+		WillReturnRows(pgxmock.NewRows([]string{"color", "win_rate"}).AddRow(game.Color(best), rate(best)))
+
+	color, winRate, err := luckiestColorOnServer(mock, GuildID, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if color != game.Red || winRate != 75 {
+		t.Errorf("expected red with a 75%% win rate, got %s with %f", color, winRate)
+	}
+
+	// neither color was played 5 times
+	mock.ExpectQuery("^SELECT player_color AS color").
+		WithArgs(GuildID, 5).
+		WillReturnRows(pgxmock.NewRows([]string{"color", "win_rate"}))
+
+	if _, _, err := luckiestColorOnServer(mock, GuildID, 5); err == nil {
+		t.Error("expected an error when no color meets the threshold")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestColorRankingDetailedForPlayerOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	counts := map[int16]int64{game.Cyan: 5, game.Red: 3, game.Lime: 1}
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	rows := pgxmock.NewRows([]string{"color", "count", "percent"})
+	for _, c := range []int16{game.Cyan, game.Red, game.Lime} {
+		rows.AddRow(game.Color(c), counts[c], float64(counts[c])/float64(total)*100)
+	}
+	mock.ExpectQuery("^SELECT player_color AS color, COUNT\\(\\*\\) AS count, (.+) AS percent FROM users_games WHERE user_id=\\$1 AND guild_id=\\$2 GROUP BY player_color ORDER BY count DESC, color ASC;$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(rows)
+
+	r, err := colorRankingDetailedForPlayerOnServer(mock, UserID, GuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 3 {
+		t.Fatalf("expected 3 colors, got %d", len(r))
+	}
+	if r[0].Color != game.Cyan || r[0].Color.String() != "cyan" {
+		t.Errorf("expected cyan to be the most played color, got %s", r[0].Color)
+	}
+	sum := 0.0
+	for _, v := range r {
+		sum += v.Percent
+	}
+	if sum < 99.99 || sum > 100.01 {
+		t.Errorf("expected percentages to sum to ~100, got %f", sum)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGameStatistics_NumKilled(t *testing.T) {
+	stats := GameStatistics{NumDeaths: 4, NumVotedOff: 1}
+	if stats.NumKilled() != 3 {
+		t.Errorf("expected 3 kills, got %d", stats.NumKilled())
+	}
+
+	// more exiles than recorded deaths must not render a negative kill count
+	stats = GameStatistics{NumDeaths: 1, NumVotedOff: 2}
+	if stats.NumKilled() != 0 {
+		t.Errorf("expected 0 kills, got %d", stats.NumKilled())
+	}
+	embed := stats.ToDiscordEmbed("ABCDEF:1", settings.MakeGuildSettings())
+	if !strings.Contains(embed.Description, "(2 voted off, 0 kills)") {
+		t.Errorf("expected 0 kills in the embed, got %q", embed.Description)
+	}
+	if strings.Contains(embed.Description, "-1") {
+		t.Errorf("expected no negative counts in the embed, got %q", embed.Description)
+	}
+}
+
+func TestNewPlayersPerWeekOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	weekSecs := int64(time.Hour * 24 * 7 / time.Second)
+	firstWeek := weekSecs * 2700
+	// each player's first game; two joined in the first week, one three weeks later
+	firstGames := map[uint64]int64{
+		UserIDInt:     firstWeek + 100,
+		UserIDInt + 1: firstWeek + weekSecs - 1,
+		UserIDInt + 2: firstWeek + 3*weekSecs + 50,
+	}
+	perWeek := map[int64]int64{}
+	for _, v := range firstGames {
+		perWeek[(v/weekSecs)*weekSecs]++
+	}
+
+	mock.ExpectQuery("^SELECT \\(first_game / \\$2\\) \\* \\$2 AS bucket_start, COUNT\\(\\*\\) AS players FROM \\(SELECT users_games.user_id, MIN\\(games.start_time\\) AS first_game (.+)\\) firsts GROUP BY bucket_start ORDER BY bucket_start ASC;$").
+		WithArgs(GuildID, weekSecs).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"bucket_start", "players"}).
+				AddRow(firstWeek, perWeek[firstWeek]).
+				AddRow(firstWeek+3*weekSecs, perWeek[firstWeek+3*weekSecs]))
+
+	r, err := newPlayersPerWeekOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("expected 2 weeks with new players, got %d", len(r))
+	}
+	if !r[0].Start.Equal(time.Unix(firstWeek, 0)) || r[0].Players != 2 {
+		t.Error("expected 2 new players in the first week")
+	}
+	if r[1].Start.Sub(r[0].Start) != 3*7*24*time.Hour || r[1].Players != 1 {
+		t.Error("expected 1 new player three weeks later")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAverageSurvivalTime(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	deaths := []float64{60, 120}
+	mock.ExpectQuery("^SELECT COALESCE\\(AVG\\(survived\\), 0\\) FROM \\(SELECT MIN\\(ge.event_time\\) - games.start_time AS survived (.+)\\) deaths;$").
+		WithArgs(UserID, GuildID, int16(capture.Player), "2", "6").
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow((deaths[0] + deaths[1]) / 2))
+
+	r, err := averageSurvivalTime(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 90*time.Second {
+		t.Errorf("expected 90s, got %s", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserLongestGame(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	lengths := []int64{300, 845, 610}
+	var longest int64
+	for _, v := range lengths {
+		if v > longest {
+			longest = v
+		}
+	}
+	mock.ExpectQuery("^SELECT COALESCE\\(MAX\\(games.end_time - games.start_time\\), 0\\) FROM users_games INNER JOIN games (.+) AND games.end_time != -1;$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(longest))
+
+	r, err := userLongestGame(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 845*time.Second {
+		t.Errorf("expected 14m5s, got %s", r)
+	}
+
+	mock.ExpectQuery("^SELECT COALESCE\\(MAX\\(games.end_time - games.start_time\\), 0\\)").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(int64(0)))
+
+	r, err = userLongestGame(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 0 {
+		t.Errorf("expected 0 for a user without games, got %s", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserAverageGameDuration(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	lengths := []float64{300, 840, 600}
+	mock.ExpectQuery("^SELECT COALESCE\\(AVG\\(games.end_time - games.start_time\\), 0\\) FROM users_games INNER JOIN games (.+) AND games.end_time != -1;$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow((lengths[0] + lengths[1] + lengths[2]) / 3))
+
+	r, err := userAverageGameDuration(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 580*time.Second {
+		t.Errorf("expected 9m40s, got %s", r)
+	}
+
+	mock.ExpectQuery("^SELECT COALESCE\\(AVG\\(games.end_time - games.start_time\\), 0\\)").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(float64(0)))
+
+	r, err = userAverageGameDuration(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 0 {
+		t.Errorf("expected 0 for a user without games, got %s", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPlayersWithNoWins(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// a veteran who lost all 12 games, a winner with 1 win in 12, and a newcomer who lost their only 2 games
+	type record struct {
+		user        uint64
+		games, wins int
+	}
+	records := []record{{UserIDInt, 12, 0}, {UserIDInt + 1, 12, 1}, {UserIDInt + 2, 2, 0}}
+	rows := pgxmock.NewRows([]string{"user_id"})
+	for _, v := range records {
+		if v.games >= 10 && v.wins == 0 {
+			rows.AddRow(v.user)
+		}
+	}
+	mock.ExpectQuery("^SELECT user_id FROM users_games WHERE guild_id = \\$1 GROUP BY user_id HAVING COUNT\\(\\*\\) >= \\$2 AND COUNT\\(\\*\\) FILTER \\( WHERE player_won = TRUE \\) = 0 (.+);$").
+		WithArgs(GuildID, 10).
+		WillReturnRows(rows)
+
+	r, err := playersWithNoWins(mock, GuildID, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 1 || r[0] != UserIDInt {
+		t.Errorf("expected only the winless veteran, got %v", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserRankOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// the ranking happens in the database, so pin the query: ties share a rank (RANK, not ROW_NUMBER), the highest win
+	// rate ranks first, and only users with at least minGames games (the third argument) are ranked at all
+	query := "WITH ranked AS (" +
+		"SELECT user_id, " +
+		"RANK() OVER (ORDER BY COUNT(*) FILTER ( WHERE player_won = TRUE )::decimal / COUNT(*) DESC) AS rank " +
+		"FROM users_games " +
+		"WHERE guild_id = $1 " +
+		"GROUP BY user_id " +
+		"HAVING COUNT(*) >= $3" +
+		") " +
+		"SELECT COALESCE((SELECT rank FROM ranked WHERE user_id = $2), 0) AS rank, COUNT(*) AS total FROM ranked;"
+	userID := fmt.Sprintf("%d", UserIDInt+3)
+	mock.ExpectQuery("^"+regexp.QuoteMeta(query)+"$").
+		WithArgs(GuildID, userID, 5).
+		WillReturnRows(pgxmock.NewRows([]string{"rank", "total"}).AddRow(int64(3), int64(6)))
+
+	r, total, err := userRankOnServer(mock, userID, GuildID, 5)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 3 || total != 6 {
+		t.Errorf("expected rank 3 of 6, got %d of %d", r, total)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTotalWinRankingForServer_WilsonScore(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	rows := func() *pgxmock.Rows {
+		return pgxmock.NewRows([]string{"user_id", "win", "total", "win_rate"}).
+			AddRow(UserIDInt, int64(1), int64(1), float64(100)).
+			AddRow(UserIDInt+1, int64(70), int64(100), float64(70))
+	}
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) ORDER BY win_rate DESC, total DESC, user_id ASC$").
+		WithArgs(GuildIDInt).
+		WillReturnRows(rows())
+	mock.ExpectQuery("^SELECT DISTINCT user_id,(.+) ORDER BY win_rate DESC, total DESC, user_id ASC$").
+		WithArgs(GuildIDInt).
+		WillReturnRows(rows())
+
+	raw, err := totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	wilson, err := totalWinRankingForServer(mock, GuildIDInt, WinRankingOptions{OrderByWilsonScore: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if raw[0].UserID != UserIDInt {
+		t.Error("expected the 1/1 player to lead by raw win rate")
+	}
+	if wilson[0].UserID != UserIDInt+1 || wilson[1].UserID != UserIDInt {
+		t.Error("expected the 70/100 player to lead by Wilson score")
+	}
+
+	if lb := WilsonLowerBound(70, 100); lb < 0.60 || lb > 0.61 {
+		t.Errorf("expected a lower bound of ~0.604 for 70/100, got %f", lb)
+	}
+	if WilsonLowerBound(0, 0) != 0 {
+		t.Error("expected a lower bound of 0 without any games")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWinRateByPlayerCount(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// the user won 1 of 2 five-player games, and 3 of 4 ten-player games
+	type result struct {
+		players int64
+		won     bool
+	}
+	games := []result{{5, true}, {5, false}, {10, true}, {10, true}, {10, false}, {10, true}}
+	played := make(map[int64]int)
+	won := make(map[int64]int)
+	for _, g := range games {
+		played[g.players]++
+		if g.won {
+			won[g.players]++
+		}
+	}
+	rows := pgxmock.NewRows([]string{"players", "win_rate"})
+	for _, size := range []int64{5, 10} {
+		rows.AddRow(size, float64(won[size])/float64(played[size])*100)
+	}
+	mock.ExpectQuery("^SELECT sizes.players, (.+) AS win_rate FROM users_games INNER JOIN games (.+) INNER JOIN \\(SELECT game_id, COUNT\\(\\*\\) AS players FROM users_games GROUP BY game_id\\) sizes (.+) GROUP BY sizes.players;$").
+		WithArgs(UserID, GuildID).
+		WillReturnRows(rows)
+
+	r, err := winRateByPlayerCount(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 || r[5] != 50 || r[10] != 75 {
+		t.Errorf("expected a 50%% win rate with 5 players and 75%% with 10, got %v", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWinRateVersus(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	opponent := fmt.Sprintf("%d", UserIDInt+1)
+	// the user beat the opponent once and lost once; in the third game they were teammates, so it doesn't count
+	type played struct {
+		role, opponentRole game.GameRole
+		won                bool
+	}
+	games := []played{
+		{game.CrewmateRole, game.ImposterRole, true},
+		{game.ImposterRole, game.CrewmateRole, false},
+		{game.CrewmateRole, game.CrewmateRole, true},
+	}
+	var versus, wins int64
+	for _, g := range games {
+		if g.role != g.opponentRole {
+			versus++
+			if g.won {
+				wins++
+			}
+		}
+	}
+	mock.ExpectQuery("^SELECT COALESCE\\((.+)\\) AS win_rate, COUNT\\(\\*\\) AS games FROM users_games INNER JOIN users_games opponent (.+) AND opponent.player_role <> users_games.player_role INNER JOIN games (.+) WHERE users_games.user_id = \\$1 AND users_games.guild_id = \\$3 AND games.end_time != -1;$").
+		WithArgs(UserID, opponent, GuildID).
+		WillReturnRows(pgxmock.NewRows([]string{"win_rate", "games"}).AddRow(float64(wins)/float64(versus)*100, versus))
+
+	winRate, count, err := winRateVersus(mock, UserID, opponent, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if winRate != 50 || count != 2 {
+		t.Errorf("expected a 50%% win rate over 2 games, got %f over %d", winRate, count)
+	}
+
+	if _, _, err := winRateVersus(mock, UserID, UserID, GuildID); err == nil {
+		t.Error("expected an error for the same user twice")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGamesPerRegionOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) AS count, region AS mode FROM games WHERE guild_id = \\$1 AND end_time != -1 AND region IS NOT NULL GROUP BY region;$").
+		WithArgs(GuildID).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"count", "mode"}).
+				AddRow(int64(12), int16(game.NA)).
+				AddRow(int64(3), int16(game.EU)))
+
+	r, err := gamesPerRegionOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 || r[game.NA] != 12 || r[game.EU] != 3 {
+		t.Errorf("expected 12 NA and 3 EU games, got %v", r)
+	}
+	if _, ok := r[game.AS]; ok {
+		t.Error("expected regions without games to be absent")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGameStatistics_FormatGameStatsPlain(t *testing.T) {
+	stats := GameStatistics{
+		GameDuration: 10 * time.Minute,
+		WinType:      game.ImpostorByKill,
+		NumMeetings:  1,
+		NumDeaths:    2,
+		NumVotedOff:  1,
+		Events: []SimpleEvent{
+			{EventType: Discuss, EventTimeOffset: time.Minute},
+			{EventType: MeetingSkipped, EventTimeOffset: 2 * time.Minute},
+			{EventType: Tasks, EventTimeOffset: 2 * time.Minute},
+			{EventType: PlayerDeath, EventTimeOffset: 3 * time.Minute, Data: `{"Action":2,"Name":"Blue","Color":1}`},
+		},
+	}
+
+	out := stats.FormatGameStatsPlain(settings.MakeGuildSettings())
+	for _, expected := range []string{"Game lasted 10m0s", "Imposters won by killing the last Human", "1 kill)", "No one was ejected", "3m0s: Blue died"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in the plain output:\n%s", expected, out)
+		}
+	}
+	if strings.ContainsAny(out, "*_`") {
+		t.Errorf("expected no markdown in the plain output:\n%s", out)
+	}
+	for _, r := range out {
+		if r > unicode.MaxLatin1 {
+			t.Errorf("expected no emoji in the plain output, found %q", r)
+		}
+	}
+}
+
+func TestGameStatistics_Draw(t *testing.T) {
+	if game.Draw <= game.Unknown {
+		t.Error("expected Draw to be appended after the existing results")
+	}
+	stats := GameStatistics{GameDuration: 4 * time.Minute, WinType: game.Draw}
+
+	if out := stats.FormatDurationAndWin(); !strings.Contains(out, "Game lasted 4m0s and nobody won") {
+		t.Errorf("expected the draw in the description, got:\n%s", out)
+	}
+	if out := stats.FormatGameStatsPlain(settings.MakeGuildSettings()); !strings.Contains(out, "Nobody won") {
+		t.Errorf("expected the draw in the plain output, got:\n%s", out)
+	}
+}
+
+func TestNumGamesPlayedOnGuild_ExcludeDraws(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// 5 finished games, 2 of which were draws
+	results := []game.GameResult{game.HumansByTask, game.Draw, game.ImpostorByKill, game.Draw, game.HumansByVote}
+	var decided int64
+	for _, v := range results {
+		if v != game.Draw {
+			decided++
+		}
+	}
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM games WHERE guild_id=\\$1 AND end_time != -1;$").
+		WithArgs(GuildIDInt).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(len(results))))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM games WHERE guild_id=\\$1 AND end_time != -1 AND win_type != \\$2;$").
+		WithArgs(GuildIDInt, int16(game.Draw)).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(decided))
+
+	all, err := numGamesPlayedOnGuild(mock, GuildIDInt, false)
+	if err != nil {
+		t.Error(err)
+	}
+	withoutDraws, err := numGamesPlayedOnGuild(mock, GuildIDInt, true)
+	if err != nil {
+		t.Error(err)
+	}
+	if all != 5 || withoutDraws != 3 {
+		t.Errorf("expected 5 games, or 3 without draws, got %d and %d", all, withoutDraws)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCollectMetrics(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	// three finished games, one of them today, lasting 5, 10 and 15 minutes
+	type played struct {
+		start, end int64
+	}
+	games := []played{
+		{now.Add(-time.Hour).Unix(), now.Add(-time.Hour).Unix() + 300},
+		{now.Add(-48 * time.Hour).Unix(), now.Add(-48*time.Hour).Unix() + 600},
+		{now.Add(-72 * time.Hour).Unix(), now.Add(-72*time.Hour).Unix() + 900},
+	}
+	var recent, totalDuration int64
+	for _, g := range games {
+		if g.start >= now.Add(-24*time.Hour).Unix() {
+			recent++
+		}
+		totalDuration += g.end - g.start
+	}
+	mock.ExpectQuery("^SELECT \\(SELECT COUNT\\(\\*\\) FROM games WHERE end_time != -1\\) AS total_games, (.+) AS recent_games, \\(SELECT COUNT\\(\\*\\) FROM users\\) AS total_users, (.+) AS average_game_duration;$").
+		WithArgs(now.Add(-24 * time.Hour).Unix()).
+		WillReturnRows(pgxmock.NewRows([]string{"total_games", "recent_games", "total_users", "average_game_duration"}).
+			AddRow(int64(len(games)), recent, int64(12), float64(totalDuration)/float64(len(games))))
+
+	m, err := collectMetrics(mock, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TotalGames != 3 || m.RecentGames != 1 || m.TotalUsers != 12 || m.AverageGameDurationSeconds != 600 {
+		t.Errorf("metrics didn't match what was returned from Postgres: %+v", *m)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAverageKillsPerGameOnServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// the counting happens in the database, so pin the query: only player events are joined, every finished game counts
+	// (even one without events), and a game's exiles come off its deaths without going below 0
+	query := "SELECT COALESCE(AVG(GREATEST(died - exiled, 0)), 0) FROM (" +
+		"SELECT COUNT(ge.event_id) FILTER ( WHERE ge.payload ->> 'Action' = $3 ) AS died, " +
+		"COUNT(ge.event_id) FILTER ( WHERE ge.payload ->> 'Action' = $4 ) AS exiled " +
+		"FROM games " +
+		"LEFT JOIN game_events ge ON ge.game_id = games.game_id AND ge.event_type = $2 " +
+		"WHERE games.guild_id = $1 AND games.end_time != -1 " +
+		"GROUP BY games.game_id" +
+		") per_game;"
+	mock.ExpectQuery("^"+regexp.QuoteMeta(query)+"$").
+		WithArgs(GuildID, int16(capture.Player), "2", "6").
+		WillReturnRows(pgxmock.NewRows([]string{"coalesce"}).AddRow(float64(2)))
+
+	r, err := averageKillsPerGameOnServer(mock, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 2.0 {
+		t.Errorf("expected an average of 2.0 kills, got %f", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTotalGamesPlayed(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// finished games in three guilds, plus one still in progress that shouldn't count
+	perGuild := map[uint64]int64{GuildIDInt: 5, GuildIDInt + 1: 2, GuildIDInt + 2: 1}
+	var expected int64
+	for _, n := range perGuild {
+		expected += n
+	}
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM games WHERE end_time != -1;$").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(expected))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM games (.+)$").
+		WillReturnError(errors.New("connection reset"))
+
+	r, err := totalGamesPlayed(mock)
+	if err != nil {
+		t.Error(err)
+	}
+	if r != 8 {
+		t.Errorf("expected 8 games across all guilds, got %d", r)
+	}
+	if _, err := totalGamesPlayed(mock); err == nil {
+		t.Error("expected the query error to be returned")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGameStatistics_ToDiscordEmbed_SignificantEventsOnly(t *testing.T) {
+	stats := GameStatistics{
+		Events: []SimpleEvent{
+			{EventType: Discuss, EventTimeOffset: time.Minute},
+			{EventType: MeetingSkipped, EventTimeOffset: 2 * time.Minute},
+			{EventType: Tasks, EventTimeOffset: 2 * time.Minute},
+			{EventType: PlayerDeath, EventTimeOffset: 3 * time.Minute, Data: `{"Action":2,"Name":"Blue","Color":1}`},
+			{EventType: Discuss, EventTimeOffset: 4 * time.Minute},
+		},
+	}
+	sett := settings.MakeGuildSettings()
+
+	embed := stats.ToDiscordEmbed("ABCDEF:1", sett)
+	if len(embed.Fields) < len(stats.Events) {
+		t.Errorf("expected every event in the timeline by default, got %d fields", len(embed.Fields))
+	}
+
+	sett.SetSignificantEventsOnly(true)
+	embed = stats.ToDiscordEmbed("ABCDEF:1", sett)
+	if len(embed.Fields) != 1 {
+		t.Fatalf("expected only the death in the timeline, got %d fields", len(embed.Fields))
+	}
+	if !strings.Contains(embed.Fields[0].Value, "Blue") {
+		t.Errorf("expected the death to be kept, got %q", embed.Fields[0].Value)
+	}
+	for _, f := range embed.Fields {
+		if strings.Contains(f.Value, "Begins") || strings.Contains(f.Value, "No one was ejected") {
+			t.Errorf("expected phase events to be excluded, got %q", f.Value)
+		}
+	}
+}
+
+func TestMostFrequentTeammates(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT uG.user_id AS teammate_id, (.+) WHERE users_games.guild_id = \\$1 AND users_games.user_id = \\$2 GROUP BY uG.user_id ORDER BY games DESC, teammate_id ASC LIMIT \\$3;$").
+		WithArgs(GuildID, UserID, 3).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"teammate_id", "games"}).
+				AddRow(UserIDInt+1, int64(42)).
+				AddRow(UserIDInt+2, int64(17)).
+				AddRow(UserIDInt+3, int64(17)))
+
+	r, err := mostFrequentTeammates(mock, UserID, GuildID, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 3 {
+		t.Fatalf("expected 3 teammates, got %d", len(r))
+	}
+	if r[0].TeammateID != UserIDInt+1 || r[0].Games != 42 {
+		t.Error("expected the most frequent teammate first")
+	}
+	for _, v := range r {
+		if v.TeammateID == UserIDInt {
+			t.Error("expected the user not to be listed as their own teammate")
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTopKillerVictimPairsForServer(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("^SELECT imp.user_id AS imposter_id, crew.user_id AS victim_id, (.+) GROUP BY imp.user_id, crew.user_id ORDER BY kills DESC, imposter_id ASC, victim_id ASC LIMIT \\$7;$").
+		WithArgs(GuildID, int16(game.ImposterRole), int16(game.CrewmateRole), int16(capture.Player), "2", "6", 2).
+		WillReturnRows(
+			pgxmock.NewRows([]string{"imposter_id", "victim_id", "kills"}).
+				AddRow(UserIDInt, UserIDInt+1, int64(9)).
+				AddRow(UserIDInt+2, UserIDInt+1, int64(2)))
+
+	r, err := topKillerVictimPairsForServer(mock, GuildID, 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("expected 2 pairs, got %d", len(r))
+	}
+	if r[0].ImposterID != UserIDInt || r[0].VictimID != UserIDInt+1 || r[0].Kills != 9 {
+		t.Error("expected the dominant pair first")
+	}
+	if r[1].Kills > r[0].Kills {
+		t.Error("expected pairs in descending order of kills")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWinRateExcludingDisconnects(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	// 2 wins and 2 losses, but one of the losses was a game the user disconnected from
+	won := []bool{true, true, false, false}
+	disconnected := []bool{false, false, false, true}
+	var wins, total int
+	for i := range won {
+		if disconnected[i] {
+			continue
+		}
+		total++
+		if won[i] {
+			wins++
+		}
+	}
+	mock.ExpectQuery("^SELECT COALESCE\\((.+)\\) AS win_rate FROM users_games WHERE users_games.user_id = \\$1 AND users_games.guild_id = \\$2 AND NOT EXISTS \\((.+)\\);$").
+		WithArgs(UserID, GuildID, int16(capture.Player), "5").
+		WillReturnRows(pgxmock.NewRows([]string{"win_rate"}).AddRow(float64(wins) / float64(total) * 100))
+
+	r, err := winRateExcludingDisconnects(mock, UserID, GuildID)
+	if err != nil {
+		t.Error(err)
+	}
+	if r <= 50 {
+		t.Errorf("expected the win rate to rise above 50%% once the disconnect is excluded, got %f", r)
+	}
+	if r < 66.66 || r > 66.67 {
+		t.Errorf("expected a 66.67%% win rate, got %f", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
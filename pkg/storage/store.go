@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"github.com/automuteus/utils/pkg/game"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/top-gg/go-dbl"
+	"time"
+)
+
+// Store is the set of queries PsqlInterface provides, so consumers can substitute a fake in their own tests.
+// Connection lifecycle methods (Init, LoadAndExecFromFile, Close) are intentionally left out
+type Store interface {
+	// guilds, users and premium
+	GetGuildForDownload(guildID uint64) (*PostgresGuild, error)
+	OptUserByString(userID string, opt bool) error
+	GetUserByString(userID string) (*PostgresUser, error)
+	GetGuildOrUserPremiumStatus(official bool, dbl *dbl.Client, guildID, userID string) (premium.Tier, int, error)
+	EnsureGuildExists(guildID uint64, guildName string) (*PostgresGuild, error)
+	EnsureUserExists(userID uint64) (*PostgresUser, error)
+	ExportUserData(userID string) (*UserDataExport, error)
+	TransferPremium(origin, dest string) error
+	RevertPremiumTransfer(original, transferred string) error
+	AddGoldSubServer(origin, dest string) error
+
+	// games and events
+	GetGame(guildID, connectCode, matchID string) (*PostgresGame, error)
+	GetGameByConnectCode(guildID, connectCode string) (*PostgresGame, error)
+	GetGameEvents(matchID string) ([]*PostgresGameEvent, error)
+	GameEventsPaged(gameID int64, afterEventTime int64, limit int) ([]*PostgresGameEvent, error)
+	GetGameRoster(gameID int64) ([]*PostgresUserGame, error)
+	GetGamesForGuild(guildID uint64) ([]*PostgresGame, error)
+	RecentGamesForServer(guildID string, limit, offset int) ([]*PostgresGame, error)
+	GamesByDurationRangeOnServer(guildID string, min, max time.Duration) ([]*PostgresGame, error)
+	FindDuplicateGames(guildID string) ([]*PostgresGame, error)
+	DuoImposterGames(userA, userB, guildID string) ([]*PostgresGame, error)
+	FastestTaskWinsOnServer(guildID string, limit int) ([]*PostgresGame, error)
+	AdjacentUserGames(userID, guildID string, gameID int64) (prev, next *PostgresGame, err error)
+	ConnectCodesOnServer(guildID string, limit int) ([]string, error)
+	FindMalformedGames(guildID string) ([]*PostgresGame, error)
+	GetGamesEventsForGuild(guildID uint64) ([]*PostgresGameEvent, error)
+	GetUsersForGuild(guildID uint64) ([]*PostgresUser, error)
+	GetUsersGamesForGuild(guildID uint64) ([]*PostgresUserGame, error)
+	AddInitialGame(game *PostgresGame) (uint64, error)
+	AddEvent(event *PostgresGameEvent) error
+	InsertUserGames(ctx context.Context, rows []*PostgresUserGame) error
+	UpdateGameAndPlayers(gameID int64, winType int16, endTime int64, players []*PostgresUserGame) error
+	DeleteAllGamesForServer(guildID string) error
+	DeleteGame(gameID int64) error
+	DeleteAllGamesForUser(userID string) error
+	DeleteAllGamesForUserOnServer(userID, guildID string) error
+	ReassignUserGames(fromUserID, toUserID string) (int64, error)
+
+	// stats
+	PrimeCounters() error
+	Counters() *GameCounters
+	TotalGamesPlayed() (int64, error)
+	RecomputeGameStats(gameID int64) (*GameStatistics, error)
+	CollectMetrics() (*StorageMetrics, error)
+	NumGamesPlayedOnGuild(guildID string) int64
+	NumGamesPlayedOnGuildExcludingDraws(guildID string) int64
+	NumGamesOnServerSince(guildID string, since time.Time) (int64, error)
+	MostActiveDayOnServer(guildID string, tzOffsetMinutes int) (time.Time, int64, error)
+	ServerGameTimeRange(guildID string) (first, last time.Time, err error)
+	GamesPerRegionOnServer(guildID string) (map[game.Region]int64, error)
+	AveragePlayersPerGameOnServer(guildID string) (float64, error)
+	ModePlayerCountOnServer(guildID string) (int, error)
+	AverageMeetingsBeforeEndOnServer(guildID string) (float64, error)
+	AverageKillsPerGameOnServer(guildID string) (float64, error)
+	NewPlayersPerWeekOnServer(guildID string) ([]*PlayerCountBucket, error)
+	DurationHistogramOnServer(guildID string, buckets []time.Duration) ([]int64, error)
+	NumCloseGamesOnServer(guildID string) (int64, error)
+	NumGamesWonAsRoleOnServer(guildID string, role game.GameRole) int64
+	RoleWinBalanceOnServer(guildID string) (crewWins, imposterWins int64, err error)
+	ImposterWinRateTimeSeries(guildID string, bucket time.Duration) ([]*RoleWinRateBucket, error)
+	NumSabotageWinsOnServer(guildID string) (int64, error)
+	UserSabotageWins(userID, guildID string) (int64, error)
+	NumGamesPlayedByUser(userID string) int64
+	NumGuildsPlayedInByUser(userID string) int64
+	GuildsPlayedInByUser(userID string) ([]uint64, error)
+	NumGamesPlayedByUserOnServer(userID, guildID string) int64
+	NumWinsAsRoleOnServer(userID, guildID string, role int16) int64
+	NumWinsAsRole(userID string, role int16) int64
+	NumGamesAsRoleOnServer(userID, guildID string, role int16) int64
+	NumGamesAsRole(userID string, role int16) int64
+	RolePreference(userID, guildID string) (crewGames, imposterGames int64, err error)
+	MostCommonRoleOutcome(userID, guildID string) (role int16, won bool, count int64, err error)
+	NumWinsOnServer(userID, guildID string) int64
+	NumWins(userID string) int64
+	BatchUserWinStats(userIDs []string, guildID string) (map[string]*UserWinStat, error)
+	GlobalWinRate(userID string) (float64, error)
+	WinRateExcludingDisconnects(userID, guildID string) (float64, error)
+	WinRateTimeSeries(userID, guildID string, bucket time.Duration) ([]*WinRateBucket, error)
+	WinRateByPlayerCount(userID, guildID string) (map[int]float64, error)
+	WinRateVersus(userID, opponentID, guildID string) (float64, int64, error)
+	AverageSurvivalTime(userID, guildID string) (time.Duration, error)
+	UserLongestGame(userID, guildID string) (time.Duration, error)
+	UserAverageGameDuration(userID, guildID string) (time.Duration, error)
+	UserCurrentWinStreak(userID, guildID string) (int64, error)
+	NumClutchWins(userID, guildID string) (int64, error)
+	NumKillsAsImposter(userID, guildID string) (int64, error)
+	LongestInGameKillStreak(userID, guildID string) (int, error)
+	MeetingsExperiencedByUser(userID, guildID string) (int64, error)
+	DeathPhaseBreakdown(userID, guildID string) (duringTasks, duringMeetings int64, err error)
+	KillsPerImposterGame(userID, guildID string) (float64, error)
+	UserWinTypeDistribution(userID, guildID string) (map[game.GameResult]int64, error)
+	UserAchievedWinTypes(userID, guildID string) ([]game.GameResult, error)
+
+	// rankings
+	ColorRankingForPlayerOnServer(userID, guildID string) []*Int16ModeCount
+	ColorRankingDetailedForPlayerOnServer(userID, guildID string) ([]*PostgresColorStat, error)
+	ColorRankingForServer(guildID string) ([]*Int16ModeCount, error)
+	LuckiestColorOnServer(guildID string, minGames int) (game.Color, float64, error)
+	NamesRankingForPlayerOnServer(userID, guildID string) []*StringModeCount
+	TotalGamesRankingForServer(guildID uint64) []*Uint64ModeCount
+	OtherPlayersRankingForPlayerOnServer(userID, guildID string) []*PostgresOtherPlayerRanking
+	TotalWinRankingForServerByRole(guildID uint64, role int16) []*PostgresPlayerRanking
+	TotalWinRankingForServer(guildID uint64) []*PostgresPlayerRanking
+	TotalWinRankingForServerExcludingDisconnects(guildID uint64) []*PostgresPlayerRanking
+	TotalWinRankingForServerWithOptions(guildID uint64, opts WinRankingOptions) []*PostgresPlayerRanking
+	PlayersWithNoWins(guildID string, minGames int) ([]uint64, error)
+	UserRankOnServer(userID, guildID string, minGames int) (rank int64, total int64, err error)
+	MostImprovedPlayersForServer(guildID string, minGames int, limit int) ([]*PostgresImprovementRanking, error)
+	BestTeammateByRole(userID, guildID string, role int16, leaderboardMin int) []*PostgresBestTeammatePlayerRanking
+	WorstTeammateByRole(userID, guildID string, role int16, leaderboardMin int) []*PostgresWorstTeammatePlayerRanking
+	BestTeammateForServerByRole(guildID string, role int16, leaderboardMin int) []*PostgresBestTeammatePlayerRanking
+	WorstTeammateForServerByRole(guildID string, role int16, leaderboardMin int) []*PostgresWorstTeammatePlayerRanking
+	MostFrequentTeammates(userID, guildID string, limit int) ([]*PostgresTeammateFrequency, error)
+	UserWinByActionAndRole(userdID, guildID string, action string, role int16) []*PostgresUserActionRanking
+	UserFrequentFirstTarget(userID, guildID string, action string, leaderboardSize int) []*PostgresUserMostFrequentFirstTargetRanking
+	UserMostFrequentFirstTargetForServer(guildID string, action string, leaderboardSize int) []*PostgresUserMostFrequentFirstTargetRanking
+	ImposterKillVoteRatioForServer(guildID string, minGames int) ([]*PostgresImposterStyleRanking, error)
+	TopKillerVictimPairsForServer(guildID string, limit int) ([]*PostgresKillerVictimPair, error)
+	UserMostFrequentKilledBy(userID, guildID string) []*PostgresUserMostFrequentKilledByanking
+	UserMostFrequentKilledByServer(guildID string) []*PostgresUserMostFrequentKilledByanking
+}
+
+var _ Store = (*PsqlInterface)(nil)
+var _ Store = (*CachingPsqlInterface)(nil)
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+)
+
+// fakeStore is an in-memory Store. Embedding the interface satisfies it without stubbing every method; calling a
+// method that isn't overridden here panics, which is the desired failure for a test that strays from what it set up
+type fakeStore struct {
+	Store
+	games map[string][]*PostgresGame
+}
+
+func (f *fakeStore) RecentGamesForServer(guildID string, limit, offset int) ([]*PostgresGame, error) {
+	games := f.games[guildID]
+	if offset >= len(games) {
+		return []*PostgresGame{}, nil
+	}
+	end := offset + limit
+	if end > len(games) {
+		end = len(games)
+	}
+	return games[offset:end], nil
+}
+
+func TestStore_Fake(t *testing.T) {
+	var store Store = &fakeStore{
+		games: map[string][]*PostgresGame{
+			GuildID: {
+				{GameID: 3, GuildID: GuildIDInt, ConnectCode: "CCCCCC"},
+				{GameID: 2, GuildID: GuildIDInt, ConnectCode: "BBBBBB"},
+				{GameID: 1, GuildID: GuildIDInt, ConnectCode: "AAAAAA"},
+			},
+		},
+	}
+
+	games, err := store.RecentGamesForServer(GuildID, 2, 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(games) != 1 || games[0].GameID != 1 {
+		t.Error("expected the fake store to page through its in-memory games")
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// queryContext derives a context that expires after timeout, unless timeout isn't positive or ctx already has a
+// deadline (which is then left alone)
+func queryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// withQueryTimeout wraps conn so every statement run on it gets the DefaultQueryTimeout
+func (psqlInterface *PsqlInterface) withQueryTimeout(conn PgxIface) PgxIface {
+	if psqlInterface.DefaultQueryTimeout <= 0 {
+		return conn
+	}
+	return &timeoutConn{PgxIface: conn, timeout: psqlInterface.DefaultQueryTimeout}
+}
+
+// querier is the pool, for queries that don't acquire a connection first, with the DefaultQueryTimeout applied
+func (psqlInterface *PsqlInterface) querier() pgxscan.Querier {
+	if psqlInterface.DefaultQueryTimeout <= 0 {
+		return psqlInterface.Pool
+	}
+	return &timeoutQuerier{querier: psqlInterface.Pool, timeout: psqlInterface.DefaultQueryTimeout}
+}
+
+// execContext is queryContext with the DefaultQueryTimeout, for statements executed directly on the pool
+func (psqlInterface *PsqlInterface) execContext() (context.Context, context.CancelFunc) {
+	return queryContext(context.Background(), psqlInterface.DefaultQueryTimeout)
+}
+
+type timeoutQuerier struct {
+	querier pgxscan.Querier
+	timeout time.Duration
+}
+
+func (q *timeoutQuerier) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, cancel := queryContext(ctx, q.timeout)
+	rows, err := q.querier.Query(ctx, sql, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the rows are read after Query returns, so the context has to outlive it
+	return &cancelRows{Rows: rows, cancel: cancel}, nil
+}
+
+type cancelRows struct {
+	pgx.Rows
+	cancel context.CancelFunc
+}
+
+func (r *cancelRows) Close() {
+	r.Rows.Close()
+	r.cancel()
+}
+
+type cancelRow struct {
+	row    pgx.Row
+	cancel context.CancelFunc
+}
+
+func (r *cancelRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return r.row.Scan(dest...)
+}
+
+type timeoutConn struct {
+	PgxIface
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Begin(ctx context.Context) (pgx.Tx, error) {
+	bctx, cancel := queryContext(ctx, c.timeout)
+	defer cancel()
+	tx, err := c.PgxIface.Begin(bctx)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutTx{Tx: tx, timeout: c.timeout}, nil
+}
+
+func (c *timeoutConn) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, cancel := queryContext(ctx, c.timeout)
+	defer cancel()
+	return c.PgxIface.Exec(ctx, sql, args...)
+}
+
+func (c *timeoutConn) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, cancel := queryContext(ctx, c.timeout)
+	return &cancelRow{row: c.PgxIface.QueryRow(ctx, sql, args...), cancel: cancel}
+}
+
+func (c *timeoutConn) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	q := timeoutQuerier{querier: c.PgxIface, timeout: c.timeout}
+	return q.Query(ctx, sql, args...)
+}
+
+func (c *timeoutConn) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	ctx, cancel := queryContext(ctx, c.timeout)
+	defer cancel()
+	return c.PgxIface.CopyFrom(ctx, tableName, columnNames, rowSrc)
+}
+
+// timeoutTx applies the timeout to each statement in a transaction, rather than to the transaction as a whole
+type timeoutTx struct {
+	pgx.Tx
+	timeout time.Duration
+}
+
+func (tx *timeoutTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, cancel := queryContext(ctx, tx.timeout)
+	defer cancel()
+	return tx.Tx.Exec(ctx, sql, args...)
+}
+
+func (tx *timeoutTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, cancel := queryContext(ctx, tx.timeout)
+	return &cancelRow{row: tx.Tx.QueryRow(ctx, sql, args...), cancel: cancel}
+}
+
+func (tx *timeoutTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	q := timeoutQuerier{querier: tx.Tx, timeout: tx.timeout}
+	return q.Query(ctx, sql, args...)
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/pashagolub/pgxmock"
+	"testing"
+	"time"
+)
+
+func TestPsqlInterface_DefaultQueryTimeout(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	psql := &PsqlInterface{}
+	if psql.withQueryTimeout(mock) != PgxIface(mock) {
+		t.Error("expected the connection to be used as-is without a timeout")
+	}
+
+	psql.DefaultQueryTimeout = 50 * time.Millisecond
+	conn := psql.withQueryTimeout(mock)
+
+	// a quick query's rows can still be read after Query returns
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM games;$").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(3)))
+	var count int64
+	if err := pgxscan.Get(context.Background(), conn, &count, "SELECT COUNT(*) FROM games;"); err != nil {
+		t.Error(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3, got %d", count)
+	}
+
+	mock.ExpectQuery("^SELECT pg_sleep\\(5\\);$").
+		WillDelayFor(5 * time.Second).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_sleep"}).AddRow(""))
+	start := time.Now()
+	var slept string
+	err = pgxscan.Get(context.Background(), conn, &slept, "SELECT pg_sleep(5);")
+	if err == nil {
+		t.Error("expected the slow query to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the query to be cancelled after the default timeout, took %s", elapsed)
+	}
+
+	// a deadline set by the caller takes precedence
+	mock.ExpectExec("^SELECT pg_sleep\\(0.1\\);$").
+		WillDelayFor(100 * time.Millisecond).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := conn.Exec(ctx, "SELECT pg_sleep(0.1);"); err != nil {
+		t.Errorf("expected the caller's deadline to be used instead of the default, got %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
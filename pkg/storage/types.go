@@ -2,7 +2,9 @@ package storage
 
 import (
 	"bytes"
+	"encoding/csv"
 	"fmt"
+	"github.com/automuteus/utils/pkg/game"
 )
 
 type PostgresGuild struct {
@@ -22,6 +24,27 @@ func nilToEmpty[T int32 | uint64](s *T) string {
 	}
 }
 
+// writeCSV renders the header and rows with the given field delimiter, quoting fields (such as JSON payloads) that
+// contain it. Every line ends in an empty field, matching the trailing comma the serializers have always written
+func writeCSV(comma rune, header []string, rows [][]string) (string, error) {
+	buf := bytes.NewBuffer([]byte{})
+	w := csv.NewWriter(buf)
+	w.Comma = comma
+	if err := w.Write(append(header, "")); err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		if err := w.Write(append(row, "")); err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 func (g *PostgresGuild) ToCSV() string {
 	return fmt.Sprintf("guild_id,guild_name,premium,tx_time_unix,transferred_to,inherits_from,\n"+
 		"%d,%s,%d,%s,%s,%s\n", g.GuildID, g.GuildName, g.Premium,
@@ -35,17 +58,25 @@ type PostgresGame struct {
 	StartTime   int32  `db:"start_time"`
 	WinType     int16  `db:"win_type"`
 	EndTime     int32  `db:"end_time"`
+	// Region is the game.Region the game was hosted in, or nil for games recorded before regions were tracked
+	Region *int16 `db:"region"`
 }
 
 func GamesToCSV(g []*PostgresGame) string {
-	s := bytes.NewBufferString("game_id,guild_id,connect_code,start_time,win_type,end_time,\n")
+	s, _ := GamesToCSVWith(g, ',')
+	return s
+}
+
+// GamesToCSVWith is GamesToCSV with the given field delimiter, such as a guild's GetCSVDelimiter
+func GamesToCSVWith(g []*PostgresGame, comma rune) (string, error) {
+	rows := make([][]string, 0, len(g))
 	for _, v := range g {
 		if v != nil {
-			s.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,\n",
-				v.GameID, v.GuildID, v.ConnectCode, v.StartTime, v.WinType, v.EndTime))
+			rows = append(rows, []string{fmt.Sprintf("%d", v.GameID), fmt.Sprintf("%d", v.GuildID), v.ConnectCode,
+				fmt.Sprintf("%d", v.StartTime), fmt.Sprintf("%d", v.WinType), fmt.Sprintf("%d", v.EndTime)})
 		}
 	}
-	return s.String()
+	return writeCSV(comma, []string{"game_id", "guild_id", "connect_code", "start_time", "win_type", "end_time"}, rows)
 }
 
 type PostgresUser struct {
@@ -55,13 +86,19 @@ type PostgresUser struct {
 }
 
 func UsersToCSV(u []*PostgresUser) string {
-	s := bytes.NewBufferString("user_id,opt,vote_time_unix,\n")
+	s, _ := UsersToCSVWith(u, ',')
+	return s
+}
+
+// UsersToCSVWith is UsersToCSV with the given field delimiter, such as a guild's GetCSVDelimiter
+func UsersToCSVWith(u []*PostgresUser, comma rune) (string, error) {
+	rows := make([][]string, 0, len(u))
 	for _, v := range u {
 		if v != nil {
-			s.WriteString(fmt.Sprintf("%d,%t,%s,\n", v.UserID, v.Opt, nilToEmpty(v.VoteTimeUnix)))
+			rows = append(rows, []string{fmt.Sprintf("%d", v.UserID), fmt.Sprintf("%t", v.Opt), nilToEmpty(v.VoteTimeUnix)})
 		}
 	}
-	return s.String()
+	return writeCSV(comma, []string{"user_id", "opt", "vote_time_unix"}, rows)
 }
 
 type PostgresUserGame struct {
@@ -75,14 +112,22 @@ type PostgresUserGame struct {
 }
 
 func UsersGamesToCSV(ug []*PostgresUserGame) string {
-	s := bytes.NewBufferString("user_id,guild_id,game_id,player_name,player_color,player_role,player_won,\n")
+	s, _ := UsersGamesToCSVWith(ug, ',')
+	return s
+}
+
+// UsersGamesToCSVWith is UsersGamesToCSV with the given field delimiter, such as a guild's GetCSVDelimiter
+func UsersGamesToCSVWith(ug []*PostgresUserGame, comma rune) (string, error) {
+	rows := make([][]string, 0, len(ug))
 	for _, v := range ug {
 		if v != nil {
-			s.WriteString(fmt.Sprintf("%d,%d,%d,%s,%d,%d,%t,\n",
-				v.UserID, v.GuildID, v.GameID, v.PlayerName, v.PlayerColor, v.PlayerRole, v.PlayerWon))
+			rows = append(rows, []string{fmt.Sprintf("%d", v.UserID), fmt.Sprintf("%d", v.GuildID),
+				fmt.Sprintf("%d", v.GameID), v.PlayerName, fmt.Sprintf("%d", v.PlayerColor),
+				fmt.Sprintf("%d", v.PlayerRole), fmt.Sprintf("%t", v.PlayerWon)})
 		}
 	}
-	return s.String()
+	return writeCSV(comma, []string{"user_id", "guild_id", "game_id", "player_name", "player_color", "player_role",
+		"player_won"}, rows)
 }
 
 type PostgresGameEvent struct {
@@ -95,14 +140,55 @@ type PostgresGameEvent struct {
 }
 
 func EventsToCSV(e []*PostgresGameEvent) string {
-	s := bytes.NewBufferString("event_id,user_id,game_id,event_time,event_type,payload,\n")
+	s, _ := EventsToCSVWith(e, ',')
+	return s
+}
+
+// EventsToCSVWith is EventsToCSV with the given field delimiter, such as a guild's GetCSVDelimiter
+func EventsToCSVWith(e []*PostgresGameEvent, comma rune) (string, error) {
+	rows := make([][]string, 0, len(e))
 	for _, v := range e {
 		if v != nil {
-			s.WriteString(fmt.Sprintf("%d,%s,%d,%d,%d,%s,\n",
-				v.EventID, nilToEmpty(v.UserID), v.GameID, v.EventTime, v.EventType, v.Payload))
+			rows = append(rows, []string{fmt.Sprintf("%d", v.EventID), nilToEmpty(v.UserID), fmt.Sprintf("%d", v.GameID),
+				fmt.Sprintf("%d", v.EventTime), fmt.Sprintf("%d", v.EventType), v.Payload})
 		}
 	}
-	return s.String()
+	return writeCSV(comma, []string{"event_id", "user_id", "game_id", "event_time", "event_type", "payload"}, rows)
+}
+
+// UserDataExport is everything stored about a single user, across every guild, as returned for a data access request
+type UserDataExport struct {
+	// User is nil if the user has no row in the users table (for example, after their data was deleted)
+	User       *PostgresUser        `json:"user"`
+	UsersGames []*PostgresUserGame  `json:"usersGames"`
+	Events     []*PostgresGameEvent `json:"events"`
+}
+
+// ToCSV renders each part of the export with the existing serializers, separated by a blank line
+func (e *UserDataExport) ToCSV() string {
+	s, _ := e.ToCSVWith(',')
+	return s
+}
+
+// ToCSVWith is ToCSV with the given field delimiter, such as a guild's GetCSVDelimiter
+func (e *UserDataExport) ToCSVWith(comma rune) (string, error) {
+	var users []*PostgresUser
+	if e.User != nil {
+		users = append(users, e.User)
+	}
+	u, err := UsersToCSVWith(users, comma)
+	if err != nil {
+		return "", err
+	}
+	ug, err := UsersGamesToCSVWith(e.UsersGames, comma)
+	if err != nil {
+		return "", err
+	}
+	ev, err := EventsToCSVWith(e.Events, comma)
+	if err != nil {
+		return "", err
+	}
+	return u + "\n" + ug + "\n" + ev, nil
 }
 
 type PostgresOtherPlayerRanking struct {
@@ -155,3 +241,41 @@ type PostgresUserMostFrequentKilledByanking struct {
 	Encounter  int64   `db:"encounter"`
 	DeathRate  float64 `db:"death_rate"`
 }
+
+type PostgresColorStat struct {
+	Color   game.Color `db:"color"`
+	Count   int64      `db:"count"`
+	Percent float64    `db:"percent"`
+}
+
+type PostgresImprovementRanking struct {
+	UserID    uint64  `db:"user_id"`
+	EarlyRate float64 `db:"early_rate"`
+	LateRate  float64 `db:"late_rate"`
+	Delta     float64 `db:"delta"`
+}
+
+type UserWinStat struct {
+	UserID uint64 `db:"user_id"`
+	Games  int64  `db:"games"`
+	Wins   int64  `db:"wins"`
+}
+
+type PostgresTeammateFrequency struct {
+	TeammateID uint64 `db:"teammate_id"`
+	Games      int64  `db:"games"`
+}
+
+type PostgresKillerVictimPair struct {
+	ImposterID uint64 `db:"imposter_id"`
+	VictimID   uint64 `db:"victim_id"`
+	Kills      int64  `db:"kills"`
+}
+
+type PostgresImposterStyleRanking struct {
+	UserID    uint64  `db:"user_id"`
+	Count     int64   `db:"total"`
+	Kills     int64   `db:"kills"`
+	Exiles    int64   `db:"exiles"`
+	KillRatio float64 `db:"kill_ratio"`
+}
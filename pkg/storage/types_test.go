@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/csv"
 	"github.com/automuteus/utils/pkg/premium"
 	"strings"
 	"testing"
@@ -116,3 +117,62 @@ func TestUsersGamesToCSV(t *testing.T) {
 		t.Error("Users game to csv does not match expected value")
 	}
 }
+
+func TestToCSVWith_Semicolon(t *testing.T) {
+	userID := uint64(5)
+	export := UserDataExport{
+		User:       &PostgresUser{UserID: 5, Opt: true},
+		UsersGames: []*PostgresUserGame{{UserID: 5, GuildID: 1, GameID: 2, PlayerName: "tom", PlayerColor: 3, PlayerRole: 4, PlayerWon: true}},
+		Events:     []*PostgresGameEvent{{EventID: 0, UserID: &userID, GameID: 2, EventTime: 3, EventType: 4, Payload: `{"Name":"a;b","Action":2}`}},
+	}
+	games := []*PostgresGame{{GameID: 0, GuildID: 1, ConnectCode: "a", StartTime: 2, WinType: 3, EndTime: 4}}
+
+	s, err := GamesToCSVWith(games, ';')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "game_id;guild_id;connect_code;start_time;win_type;end_time;\n0;1;a;2;3;4;\n" {
+		t.Errorf("games didn't serialize with semicolons as expected, got %q", s)
+	}
+	s, err = UsersToCSVWith([]*PostgresUser{export.User}, ';')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Split(s, "\n")[1] != "5;true;;" {
+		t.Errorf("users didn't serialize with semicolons as expected, got %q", s)
+	}
+	s, err = UsersGamesToCSVWith(export.UsersGames, ';')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Split(s, "\n")[1] != "5;1;2;tom;3;4;true;" {
+		t.Errorf("users games didn't serialize with semicolons as expected, got %q", s)
+	}
+
+	// a payload containing the delimiter is quoted, so it reads back as a single field
+	s, err = EventsToCSVWith(export.Events, ';')
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := csv.NewReader(strings.NewReader(s))
+	r.Comma = ';'
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || len(records[1]) != 7 || records[1][5] != export.Events[0].Payload {
+		t.Errorf("expected the payload to survive a semicolon round-trip, got %q", records)
+	}
+
+	s, err = export.ToCSVWith(';')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(s, "user_id;opt;vote_time_unix;\n5;true;;\n\nuser_id;guild_id;game_id;player_name;") {
+		t.Errorf("expected every part of the export to use semicolons, got %q", s)
+	}
+
+	if _, err := GamesToCSVWith(games, '"'); err == nil {
+		t.Error("expected an error for a delimiter that can't be used")
+	}
+}